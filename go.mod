@@ -5,6 +5,8 @@ go 1.20
 require (
 	github.com/go-logr/logr v1.2.4
 	github.com/gorilla/websocket v1.5.0
+	github.com/lucsky/cuid v1.2.1
+	github.com/pion/interceptor v0.1.10
 	github.com/pion/ion-sfu v1.11.0
 	github.com/pion/rtp v1.7.13
 	github.com/pion/webrtc/v3 v3.1.25
@@ -25,7 +27,6 @@ require (
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
-	github.com/lucsky/cuid v1.2.1 // indirect
 	github.com/magiconair/properties v1.8.5 // indirect
 	github.com/mattn/go-colorable v0.1.12 // indirect
 	github.com/mattn/go-isatty v0.0.14 // indirect
@@ -35,7 +36,6 @@ require (
 	github.com/pion/datachannel v1.5.2 // indirect
 	github.com/pion/dtls/v2 v2.1.3 // indirect
 	github.com/pion/ice/v2 v2.2.2 // indirect
-	github.com/pion/interceptor v0.1.10 // indirect
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns v0.0.5 // indirect
 	github.com/pion/randutil v0.1.0 // indirect
@@ -0,0 +1,42 @@
+package asr
+
+import (
+	"context"
+	"strings"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+// Backend transcribes and translates speech, and translates text.
+type Backend interface {
+	Transcribe(ctx context.Context, request *router.TranscriptionRequest) (*router.TranscriptionResponse, error)
+}
+
+var (
+	_ Backend = (*Client)(nil)
+	_ Backend = (*OpenAIClient)(nil)
+	_ Backend = (*Pool)(nil)
+)
+
+// openAIScheme prefixes the URLs of services with an OpenAI style API.
+const openAIScheme = "openai+"
+
+// NewBackend returns the backend for url. URLs like openai+http://host:8080/v1 are
+// for services with an OpenAI style audio API, like whisper.cpp's server, LocalAI
+// or vLLM; see NewOpenAIClient. Any other URL is that of a /v1/transcribe endpoint.
+// Several URLs separated by commas make a Pool.
+func NewBackend(url string) (Backend, error) {
+	if strings.Contains(url, ",") {
+		var urls []string
+		for _, u := range strings.Split(url, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, u)
+			}
+		}
+		return NewPool(urls)
+	}
+	if rest, ok := strings.CutPrefix(url, openAIScheme); ok {
+		return NewOpenAIClient(rest)
+	}
+	return NewClient(url)
+}
@@ -2,52 +2,301 @@ package asr
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"math/rand"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/ajbouh/bridge/pkg/router"
 )
 
+const (
+	defaultTimeout    = 60 * time.Second
+	defaultMaxRetries = 3
+	defaultMinBackoff = 250 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+)
+
+// ClientConfig is a configuration of a client.
+type ClientConfig struct {
+	URL        string
+	HTTPClient *http.Client
+
+	// Timeout bounds each attempt at a request, retries aside. Zero means no
+	// timeout beyond that of the context.
+	Timeout time.Duration
+	// MaxRetries is how many times a request is retried after a server error or a
+	// failed connection.
+	MaxRetries int
+	// MinBackoff and MaxBackoff bound how long to wait before retrying. The wait
+	// doubles with every retry and is jittered so clients don't retry in lockstep.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Encoding is how audio is sent, if the service takes it. Services that don't
+	// are sent JSON instead from the first request they turn down on.
+	Encoding Encoding
+}
+
+func DefaultConfig(url string) ClientConfig {
+	return ClientConfig{
+		URL: url,
+
+		HTTPClient: &http.Client{},
+
+		Timeout:    defaultTimeout,
+		MaxRetries: defaultMaxRetries,
+		MinBackoff: defaultMinBackoff,
+		MaxBackoff: defaultMaxBackoff,
+
+		Encoding: EncodingS16,
+	}
+}
+
+// Client speaks the /v1/transcribe and /v1/diarize protocols of the services in this
+// repository. Its URL is that of one of those endpoints.
 type Client struct {
-	url string
+	config ClientConfig
+
+	// mu guards encoding, which is how audio is sent to the service, and settled,
+	// which is whether the service is known to take it.
+	mu       sync.Mutex
+	encoding Encoding
+	settled  bool
 }
 
 func NewClient(url string) (*Client, error) {
-	if url == "" {
-		return nil, fmt.Errorf("invalid url for Client %s", url)
+	return NewClientWithConfig(DefaultConfig(url))
+}
+
+func NewClientWithConfig(config ClientConfig) (*Client, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("invalid url for Client %s", config.URL)
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{}
+	}
+	if config.Encoding == "" {
+		config.Encoding = EncodingJSON
 	}
 	return &Client{
-		url: url,
+		config:   config,
+		encoding: config.Encoding,
+		settled:  config.Encoding == EncodingJSON,
 	}, nil
 }
 
-func (s *Client) Transcribe(request *router.TranscriptionRequest) (*router.TranscriptionResponse, error) {
-	payloadBytes, err := json.Marshal(request)
-	if err != nil {
+// StatusError is the error for a response with a status other than 200 or 201.
+type StatusError struct {
+	StatusCode int
+	// Message is what the server said went wrong.
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("error, status code: %d, message: %s", e.StatusCode, e.Message)
+}
+
+// Temporary reports whether the request may succeed if retried.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500
+}
+
+func (s *Client) Transcribe(ctx context.Context, request *router.TranscriptionRequest) (*router.TranscriptionResponse, error) {
+	response := &router.TranscriptionResponse{}
+	if err := s.do(ctx, request, request.Audio, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (s *Client) Diarize(ctx context.Context, request *router.DiarizationRequest) (*router.DiarizationResponse, error) {
+	response := &router.DiarizationResponse{}
+	if err := s.do(ctx, request, request.Audio, response); err != nil {
 		return nil, err
 	}
+	return response, nil
+}
+
+// do posts request, whose audio is audio, and decodes the response into out. The
+// audio is sent in the encoding the service was found to take.
+func (s *Client) do(ctx context.Context, request any, audio *router.Audio, out any) error {
+	encoding, settled := s.negotiated()
+	if audio == nil {
+		encoding, settled = EncodingJSON, true
+	}
+
+	err := s.post(ctx, request, audio, encoding, out)
+	if settled || encoding == EncodingJSON {
+		return err
+	}
+
+	var statusErr *StatusError
+	switch {
+	case err == nil:
+		s.settle(encoding)
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnsupportedMediaType:
+		fmt.Printf("%s doesn't take %s audio, sending json instead: %s\n", s.config.URL, encoding, err)
+		s.settle(EncodingJSON)
+		return s.post(ctx, request, audio, EncodingJSON, out)
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnprocessableEntity:
+		// Services that only validate requests as JSON answer 422 to anything else,
+		// but so do all of them to a request that's invalid, so JSON is only settled
+		// on if it goes through where the audio didn't.
+		if err := s.post(ctx, request, audio, EncodingJSON, out); err != nil {
+			return err
+		}
+		fmt.Printf("%s doesn't take %s audio, sending json instead\n", s.config.URL, encoding)
+		s.settle(EncodingJSON)
+		return nil
+	}
+	return err
+}
+
+// post sends request, whose audio is audio, in encoding.
+func (s *Client) post(ctx context.Context, request any, audio *router.Audio, encoding Encoding, out any) error {
+	payload, contentType, err := encode(request, audio, encoding)
+	if err != nil {
+		return err
+	}
+	return Post(ctx, s.config, s.config.URL, http.Header{"Content-Type": {contentType}}, payload, out)
+}
+
+func (s *Client) negotiated() (Encoding, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.encoding, s.settled
+}
+
+func (s *Client) settle(encoding Encoding) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encoding = encoding
+	s.settled = true
+}
+
+// post sends payload to url, retrying as configured, and decodes the response into
+// out.
+func Post(ctx context.Context, config ClientConfig, url string, header http.Header, payload []byte, out any) error {
+	for attempt := 0; ; attempt++ {
+		err := send(ctx, config, url, header, payload, out)
+		if err == nil || attempt >= config.MaxRetries || !retryable(ctx, err) {
+			return err
+		}
+
+		wait := backoff(config.MinBackoff, config.MaxBackoff, attempt)
+		fmt.Printf("error posting to %s, retrying in %s: %s\n", url, wait, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return cancelled(ctx, err)
+		}
+	}
+}
+
+// cancelled is the error for giving up on a request that failed with err, because
+// ctx is done before it could be retried.
+func cancelled(ctx context.Context, err error) error {
+	if err == nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("%w, after: %v", ctx.Err(), err)
+}
+
+// send makes a single attempt at a request.
+func send(ctx context.Context, config ClientConfig, url string, header http.Header, payload []byte, out any) error {
+	if config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
 
 	// Send POST request to the API
-	resp, err := http.Post(s.url, "application/json", bytes.NewBuffer(payloadBytes))
+	resp, err := config.HTTPClient.Do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
 
 	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Check the response status code
-	if resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK {
-		response := router.TranscriptionResponse{}
-		err = json.Unmarshal(body, &response)
-		return &response, err
-	} else {
-		return nil, fmt.Errorf("error: %s", body)
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: resp.StatusCode, Message: errorMessage(body)}
+	}
+
+	return json.Unmarshal(body, out)
+}
+
+// retryable reports whether a request that failed with err is worth trying again:
+// the server had a problem, or we never got through to it.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Temporary()
+	}
+
+	// Anything else that isn't a bad response is a failed connection, or an
+	// attempt that timed out.
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr)
+}
+
+// backoff returns how long to wait before retry number attempt, counting from 0.
+func backoff(minWait, maxWait time.Duration, attempt int) time.Duration {
+	d := minWait << attempt
+	if d <= 0 || d > maxWait {
+		d = maxWait
+	}
+	// Wait somewhere between half and all of it.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// errorMessage pulls the message out of an error response. Python services tend to
+// answer with {"detail": ...} or {"error": ...}; anything else is passed on as is.
+func errorMessage(body []byte) string {
+	var v struct {
+		Detail any `json:"detail"`
+		Error  any `json:"error"`
+	}
+	if json.Unmarshal(body, &v) == nil {
+		for _, m := range []any{v.Detail, v.Error} {
+			switch m := m.(type) {
+			case string:
+				return m
+			case nil:
+			default:
+				if b, err := json.Marshal(m); err == nil {
+					return string(b)
+				}
+			}
+		}
 	}
+	return strings.TrimSpace(string(body))
 }
@@ -0,0 +1,393 @@
+package asr_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/asr"
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+func newClient(t *testing.T, url string) *asr.Client {
+	t.Helper()
+	config := asr.DefaultConfig(url)
+	config.Timeout = 100 * time.Millisecond
+	config.MinBackoff = time.Millisecond
+	config.MaxBackoff = 5 * time.Millisecond
+	c, err := asr.NewClientWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestTranscribeRetries(t *testing.T) {
+	testCases := []struct {
+		name string
+		// respond answers attempt n, counting from 0
+		respond  func(w http.ResponseWriter, n int32)
+		attempts int32
+		status   int
+		message  string
+	}{
+		{
+			name: "server errors",
+			respond: func(w http.ResponseWriter, n int32) {
+				if n < 2 {
+					http.Error(w, "overloaded", http.StatusServiceUnavailable)
+					return
+				}
+				json.NewEncoder(w).Encode(router.TranscriptionResponse{SourceLanguage: "en"})
+			},
+			attempts: 3,
+		},
+		{
+			name: "slow server",
+			respond: func(w http.ResponseWriter, n int32) {
+				if n == 0 {
+					time.Sleep(300 * time.Millisecond)
+				}
+				json.NewEncoder(w).Encode(router.TranscriptionResponse{SourceLanguage: "en"})
+			},
+			attempts: 2,
+		},
+		{
+			name: "bad request",
+			respond: func(w http.ResponseWriter, n int32) {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(`{"detail": "audio is empty"}`))
+			},
+			attempts: 1,
+			status:   http.StatusUnprocessableEntity,
+			message:  "audio is empty",
+		},
+		{
+			name: "server down for good",
+			respond: func(w http.ResponseWriter, n int32) {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error": "model failed to load"}`))
+			},
+			attempts: 4,
+			status:   http.StatusInternalServerError,
+			message:  "model failed to load",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tc.respond(w, attempts.Add(1)-1)
+			}))
+			defer srv.Close()
+
+			resp, err := newClient(t, srv.URL).Transcribe(context.Background(), &router.TranscriptionRequest{Task: "transcribe"})
+			if got := attempts.Load(); got != tc.attempts {
+				t.Errorf("%d attempts, want %d", got, tc.attempts)
+			}
+
+			if tc.status == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.SourceLanguage != "en" {
+					t.Errorf("response %+v", resp)
+				}
+				return
+			}
+
+			var statusErr *asr.StatusError
+			if !errors.As(err, &statusErr) {
+				t.Fatalf("error %v isn't a StatusError", err)
+			}
+			if statusErr.StatusCode != tc.status || statusErr.Message != tc.message {
+				t.Errorf("error %+v, want status %d and message %q", statusErr, tc.status, tc.message)
+			}
+		})
+	}
+}
+
+func TestTranscribeCancel(t *testing.T) {
+	var attempts atomic.Int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := newClient(t, srv.URL).Transcribe(ctx, &router.TranscriptionRequest{Task: "transcribe"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error %v, want the context's", err)
+	}
+	if got := attempts.Load(); got != 1 {
+		t.Errorf("%d attempts after the context was done", got)
+	}
+}
+
+// service answers transcription requests like the Python services do, taking binary
+// audio only if binary is set, and records the waveforms it got.
+type service struct {
+	binary bool
+
+	mu        sync.Mutex
+	bytes     int
+	encodings []string
+	waveforms [][]float32
+}
+
+func (s *service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req router.TranscriptionRequest
+	encoding := "json"
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/json":
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+	case mediaType == "multipart/form-data" && s.binary:
+		form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(1 << 20)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var meta struct {
+			Audio struct {
+				SampleRate int    `json:"sample_rate"`
+				Encoding   string `json:"encoding"`
+			} `json:"audio"`
+		}
+		json.Unmarshal([]byte(form.Value["request"][0]), &meta)
+		json.Unmarshal([]byte(form.Value["request"][0]), &req)
+		f, _ := form.File["waveform"][0].Open()
+		pcm, _ := io.ReadAll(f)
+
+		encoding = meta.Audio.Encoding
+		req.Audio = &router.Audio{SampleRate: meta.Audio.SampleRate}
+		switch encoding {
+		case "f32le":
+			for i := 0; i+4 <= len(pcm); i += 4 {
+				req.Audio.Waveform = append(req.Audio.Waveform, math.Float32frombits(binary.LittleEndian.Uint32(pcm[i:])))
+			}
+		case "s16le":
+			for i := 0; i+2 <= len(pcm); i += 2 {
+				req.Audio.Waveform = append(req.Audio.Waveform, float32(int16(binary.LittleEndian.Uint16(pcm[i:])))/math.MaxInt16)
+			}
+		default:
+			http.Error(w, "unsupported audio encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+	default:
+		// FastAPI only validates the body of a request as JSON.
+		http.Error(w, `{"detail": "value is not a valid dict"}`, http.StatusUnprocessableEntity)
+		return
+	}
+
+	if req.SourceLanguage != nil && *req.SourceLanguage == "klingon" {
+		http.Error(w, `{"detail": "unsupported language"}`, http.StatusUnprocessableEntity)
+		return
+	}
+
+	s.mu.Lock()
+	s.bytes += len(body)
+	s.encodings = append(s.encodings, encoding)
+	s.waveforms = append(s.waveforms, req.Audio.Waveform)
+	s.mu.Unlock()
+
+	json.NewEncoder(w).Encode(router.TranscriptionResponse{Duration: float32(len(req.Audio.Waveform)) / float32(req.Audio.SampleRate)})
+}
+
+// speech returns seconds of noisy audio at 16kHz.
+func speech(seconds int) []float32 {
+	rng := rand.New(rand.NewSource(1))
+	pcm := make([]float32, seconds*16000)
+	for i := range pcm {
+		pcm[i] = 0.5 * (rng.Float32()*2 - 1)
+	}
+	return pcm
+}
+
+func TestTranscribeEncodings(t *testing.T) {
+	waveform := speech(1)
+	request := &router.TranscriptionRequest{
+		Audio: &router.Audio{Waveform: waveform, SampleRate: 16000},
+		Task:  "transcribe",
+	}
+
+	testCases := []struct {
+		name      string
+		encoding  asr.Encoding
+		binary    bool
+		want      []string
+		tolerance float64
+	}{
+		{"json", asr.EncodingJSON, true, []string{"json", "json"}, 0},
+		{"f32le", asr.EncodingF32, true, []string{"f32le", "f32le"}, 0},
+		{"s16le", asr.EncodingS16, true, []string{"s16le", "s16le"}, 1.0 / math.MaxInt16},
+		{"json only service", asr.EncodingS16, false, []string{"json", "json"}, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := &service{binary: tc.binary}
+			srv := httptest.NewServer(svc)
+			defer srv.Close()
+
+			config := asr.DefaultConfig(srv.URL)
+			config.Encoding = tc.encoding
+			c, err := asr.NewClientWithConfig(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 2; i++ {
+				resp, err := c.Transcribe(context.Background(), request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.Duration != 1 {
+					t.Errorf("service got %gs of audio", resp.Duration)
+				}
+			}
+
+			if !reflect.DeepEqual(svc.encodings, tc.want) {
+				t.Errorf("service got %v, want %v", svc.encodings, tc.want)
+			}
+			for _, got := range svc.waveforms {
+				for i := range waveform {
+					if math.Abs(float64(got[i]-waveform[i])) > tc.tolerance {
+						t.Fatalf("sample %d is %g, want %g", i, got[i], waveform[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidRequestsKeepEncoding(t *testing.T) {
+	svc := &service{binary: true}
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+
+	config := asr.DefaultConfig(srv.URL)
+	config.Encoding = asr.EncodingF32
+	c, err := asr.NewClientWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	klingon := "klingon"
+	_, err = c.Transcribe(context.Background(), &router.TranscriptionRequest{
+		Audio:          &router.Audio{Waveform: speech(1), SampleRate: 16000},
+		SourceLanguage: &klingon,
+	})
+	var statusErr *asr.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("got error %v, want a 422", err)
+	}
+
+	if _, err := c.Transcribe(context.Background(), &router.TranscriptionRequest{
+		Audio: &router.Audio{Waveform: speech(1), SampleRate: 16000},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"f32le"}; !reflect.DeepEqual(svc.encodings, want) {
+		t.Errorf("service got %v, want %v", svc.encodings, want)
+	}
+}
+
+// BenchmarkTranscribe sends the longest window the VAD passes along, 24 seconds, in
+// every encoding, to a service that decodes it. On a single core VM, the 4.4MB of
+// JSON took 141ms a request, 1.5MB of f32le 11ms and 0.77MB of s16le 10ms.
+func BenchmarkTranscribe(b *testing.B) {
+	request := &router.TranscriptionRequest{
+		Audio: &router.Audio{Waveform: speech(24), SampleRate: 16000},
+		Task:  "transcribe",
+	}
+
+	for _, encoding := range []asr.Encoding{asr.EncodingJSON, asr.EncodingF32, asr.EncodingS16} {
+		b.Run(string(encoding), func(b *testing.B) {
+			svc := &service{binary: true}
+			srv := httptest.NewServer(svc)
+			defer srv.Close()
+
+			config := asr.DefaultConfig(srv.URL)
+			config.Encoding = encoding
+			c, err := asr.NewClientWithConfig(config)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Transcribe(context.Background(), request); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(svc.bytes)/float64(b.N), "bytes/req")
+		})
+	}
+}
+
+func TestDiarize(t *testing.T) {
+	svc := &service{binary: true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The service only looks at the audio.
+		rec := httptest.NewRecorder()
+		svc.ServeHTTP(rec, r)
+		if rec.Code != http.StatusOK {
+			http.Error(w, rec.Body.String(), rec.Code)
+			return
+		}
+		json.NewEncoder(w).Encode(router.DiarizationResponse{
+			Segments: []router.DiarizationSegment{{Start: 0, End: 1, Track: "A", Label: "SPEAKER_00"}},
+		})
+	}))
+	defer srv.Close()
+
+	c, err := asr.NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxSpeakers := 2
+	resp, err := c.Diarize(context.Background(), &router.DiarizationRequest{
+		Audio:       &router.Audio{Waveform: speech(1), SampleRate: 16000},
+		Task:        "diarize",
+		MaxSpeakers: &maxSpeakers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Segments) != 1 || resp.Segments[0].Label != "SPEAKER_00" {
+		t.Errorf("response %+v", resp)
+	}
+	if want := []string{"s16le"}; !reflect.DeepEqual(svc.encodings, want) || len(svc.waveforms[0]) != 16000 {
+		t.Errorf("service got %v audio of %d samples", svc.encodings, len(svc.waveforms[0]))
+	}
+}
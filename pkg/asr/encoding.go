@@ -0,0 +1,121 @@
+package asr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime/multipart"
+	"net/textproto"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+// Encoding is how the audio of a request is sent.
+type Encoding string
+
+const (
+	// EncodingJSON sends the waveform as a JSON array of numbers, which every
+	// service understands.
+	EncodingJSON Encoding = "json"
+	// EncodingF32 and EncodingS16 send the waveform as little endian 32 bit float or
+	// 16 bit integer PCM in a multipart request, next to the rest of the request as
+	// JSON. As text, every sample takes 10 bytes or so.
+	EncodingF32 Encoding = "f32le"
+	EncodingS16 Encoding = "s16le"
+)
+
+// binaryRequest is a TranscriptionRequest whose waveform is sent separately.
+type binaryRequest struct {
+	*router.TranscriptionRequest
+	Audio *binaryAudio `json:"audio,omitempty"`
+}
+
+// binaryDiarizationRequest is a DiarizationRequest whose waveform is sent
+// separately.
+type binaryDiarizationRequest struct {
+	*router.DiarizationRequest
+	Audio *binaryAudio `json:"audio,omitempty"`
+}
+
+type binaryAudio struct {
+	SampleRate int      `json:"sample_rate"`
+	Encoding   Encoding `json:"encoding"`
+}
+
+// encode returns the body of request, whose audio is audio, with the audio sent as
+// encoding, and its content type.
+func encode(request any, audio *router.Audio, encoding Encoding) ([]byte, string, error) {
+	if encoding == EncodingJSON || audio == nil {
+		payload, err := json.Marshal(request)
+		return payload, "application/json", err
+	}
+
+	sent := &binaryAudio{
+		SampleRate: audio.SampleRate,
+		Encoding:   encoding,
+	}
+	var meta []byte
+	var err error
+	switch request := request.(type) {
+	case *router.TranscriptionRequest:
+		meta, err = json.Marshal(binaryRequest{TranscriptionRequest: request, Audio: sent})
+	case *router.DiarizationRequest:
+		meta, err = json.Marshal(binaryDiarizationRequest{DiarizationRequest: request, Audio: sent})
+	default:
+		err = fmt.Errorf("can't send %T with binary audio", request)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	part, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="request"`},
+		"Content-Type":        {"application/json"},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := part.Write(meta); err != nil {
+		return nil, "", err
+	}
+
+	part, err = w.CreateFormFile("waveform", "waveform.pcm")
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := part.Write(pcmBytes(audio.Waveform, encoding)); err != nil {
+		return nil, "", err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return body.Bytes(), w.FormDataContentType(), nil
+}
+
+// pcmBytes packs samples as encoding, which is EncodingF32 or EncodingS16.
+func pcmBytes(samples []float32, encoding Encoding) []byte {
+	if encoding == EncodingF32 {
+		out := make([]byte, 4*len(samples))
+		for i, s := range samples {
+			binary.LittleEndian.PutUint32(out[4*i:], math.Float32bits(s))
+		}
+		return out
+	}
+
+	out := make([]byte, 2*len(samples))
+	for i, s := range samples {
+		if s > 1 {
+			s = 1
+		} else if s < -1 {
+			s = -1
+		}
+		binary.LittleEndian.PutUint16(out[2*i:], uint16(int16(math.Round(float64(s)*math.MaxInt16))))
+	}
+	return out
+}
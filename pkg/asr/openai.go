@@ -0,0 +1,266 @@
+package asr
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+const defaultOpenAIModel = "whisper-1"
+
+// OpenAIConfig is a configuration of an OpenAIClient.
+type OpenAIConfig struct {
+	// ClientConfig holds the timeouts and retries. Its URL is the base of the API,
+	// like http://localhost:8080/v1, and its Encoding is unused: audio is always
+	// uploaded as WAV.
+	ClientConfig
+
+	Model  string
+	APIKey string
+}
+
+func DefaultOpenAIConfig(baseURL string) OpenAIConfig {
+	return OpenAIConfig{
+		ClientConfig: DefaultConfig(baseURL),
+		Model:        defaultOpenAIModel,
+	}
+}
+
+// OpenAIClient speaks the /audio/transcriptions and /audio/translations API of
+// OpenAI, which plenty of other services implement too.
+type OpenAIClient struct {
+	config OpenAIConfig
+}
+
+// NewOpenAIClient returns a client for the API at baseURL. The model defaults to
+// whisper-1 and can be picked with a model query parameter, and the password of the
+// URL, if any, is used as the API key: https://:sk-...@api.openai.com/v1?model=whisper-1
+func NewOpenAIClient(baseURL string) (*OpenAIClient, error) {
+	config, err := openAIConfig(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	return NewOpenAIClientWithConfig(config)
+}
+
+// openAIConfig returns the configuration for the API at baseURL, as NewOpenAIClient
+// takes it.
+func openAIConfig(baseURL string) (OpenAIConfig, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return OpenAIConfig{}, fmt.Errorf("invalid url for OpenAIClient %s: %w", baseURL, err)
+	}
+
+	query := u.Query()
+	model := query.Get("model")
+	query.Del("model")
+	u.RawQuery = query.Encode()
+
+	var apiKey string
+	if u.User != nil {
+		apiKey, _ = u.User.Password()
+		u.User = nil
+	}
+
+	config := DefaultOpenAIConfig(u.String())
+	if model != "" {
+		config.Model = model
+	}
+	config.APIKey = apiKey
+	return config, nil
+}
+
+func NewOpenAIClientWithConfig(config OpenAIConfig) (*OpenAIClient, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("invalid url for OpenAIClient %s", config.URL)
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{}
+	}
+	if config.Model == "" {
+		config.Model = defaultOpenAIModel
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	return &OpenAIClient{config: config}, nil
+}
+
+// openAIResponse is the verbose_json response format.
+type openAIResponse struct {
+	Language string  `json:"language"`
+	Duration float32 `json:"duration"`
+	Text     string  `json:"text"`
+	Segments []struct {
+		ID               uint32  `json:"id"`
+		Seek             uint32  `json:"seek"`
+		Start            float32 `json:"start"`
+		End              float32 `json:"end"`
+		Text             string  `json:"text"`
+		Temperature      float32 `json:"temperature"`
+		AvgLogprob       float32 `json:"avg_logprob"`
+		CompressionRatio float32 `json:"compression_ratio"`
+		NoSpeechProb     float32 `json:"no_speech_prob"`
+	} `json:"segments"`
+	Words []struct {
+		Word        string   `json:"word"`
+		Start       float32  `json:"start"`
+		End         float32  `json:"end"`
+		Probability *float32 `json:"probability"`
+	} `json:"words"`
+}
+
+// Transcribe transcribes or translates audio. The API only translates into English,
+// and can't translate text.
+func (c *OpenAIClient) Transcribe(ctx context.Context, request *router.TranscriptionRequest) (*router.TranscriptionResponse, error) {
+	if request.Audio == nil {
+		return nil, fmt.Errorf("%s can only %s audio", c.config.URL, request.Task)
+	}
+
+	var endpoint string
+	switch request.Task {
+	case "transcribe":
+		endpoint = "/audio/transcriptions"
+	case "translate":
+		if target := request.TargetLanguage; target != nil && *target != "" && languageCode(*target) != "en" {
+			return nil, fmt.Errorf("%s can only translate into English, not %s", c.config.URL, *target)
+		}
+		endpoint = "/audio/translations"
+	default:
+		return nil, fmt.Errorf("unknown task %q", request.Task)
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fields := [][2]string{
+		{"model", c.config.Model},
+		{"response_format", "verbose_json"},
+		{"timestamp_granularities[]", "segment"},
+		{"timestamp_granularities[]", "word"},
+	}
+	// Translations are always of whatever language is spoken.
+	if request.SourceLanguage != nil && *request.SourceLanguage != "" && request.Task == "transcribe" {
+		fields = append(fields, [2]string{"language", languageCode(*request.SourceLanguage)})
+	}
+	if request.Prompt != nil && *request.Prompt != "" {
+		fields = append(fields, [2]string{"prompt", *request.Prompt})
+	}
+	for _, f := range fields {
+		if err := w.WriteField(f[0], f[1]); err != nil {
+			return nil, err
+		}
+	}
+	part, err := w.CreateFormFile("file", "audio.wav")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(wav(request.Audio.Waveform, request.Audio.SampleRate)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	header := http.Header{"Content-Type": {w.FormDataContentType()}}
+	if c.config.APIKey != "" {
+		header.Set("Authorization", "Bearer "+c.config.APIKey)
+	}
+
+	var resp openAIResponse
+	if err := Post(ctx, c.config.ClientConfig, c.config.URL+endpoint, header, body.Bytes(), &resp); err != nil {
+		return nil, err
+	}
+	return resp.transcription(request), nil
+}
+
+// transcription converts resp into a TranscriptionResponse to request.
+func (resp *openAIResponse) transcription(request *router.TranscriptionRequest) *router.TranscriptionResponse {
+	language := languageCode(resp.Language)
+	target := language
+	if request.Task == "translate" {
+		target = "en"
+	}
+
+	out := &router.TranscriptionResponse{
+		SourceLanguage:            language,
+		SourceLanguageProbability: 1,
+		TargetLanguage:            target,
+		Duration:                  resp.Duration,
+	}
+
+	for _, s := range resp.Segments {
+		out.Segments = append(out.Segments, router.TranscriptionSegment{
+			ID:               s.ID,
+			Seek:             s.Seek,
+			Start:            s.Start,
+			End:              s.End,
+			Text:             s.Text,
+			Temperature:      s.Temperature,
+			AvgLogprob:       s.AvgLogprob,
+			CompressionRatio: s.CompressionRatio,
+			NoSpeechProb:     s.NoSpeechProb,
+		})
+	}
+	if len(out.Segments) == 0 && resp.Text != "" {
+		// Some servers leave out segments for short audio.
+		out.Segments = []router.TranscriptionSegment{{Start: 0, End: resp.Duration, Text: resp.Text}}
+	}
+
+	// Words come in one list for the whole audio, so hand each to the segment it
+	// starts in.
+	if len(out.Segments) == 0 {
+		return out
+	}
+	i := 0
+	for _, word := range resp.Words {
+		for i < len(out.Segments)-1 && word.Start >= out.Segments[i].End {
+			i++
+		}
+		// Unlike Whisper's, OpenAI's words come without their leading space.
+		text := word.Word
+		if !strings.HasPrefix(text, " ") {
+			text = " " + text
+		}
+		// OpenAI doesn't say how sure it is of a word, though whisper.cpp does.
+		var probability float32 = 1
+		if word.Probability != nil {
+			probability = *word.Probability
+		}
+		out.Segments[i].Words = append(out.Segments[i].Words, router.Word{
+			Start:       word.Start,
+			End:         word.End,
+			Word:        text,
+			Probability: probability,
+		})
+	}
+
+	return out
+}
+
+// wav packs samples as a 16 bit mono WAV file.
+func wav(samples []float32, sampleRate int) []byte {
+	pcm := pcmBytes(samples, EncodingS16)
+
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	b.WriteString("RIFF")
+	binary.Write(&b, le, uint32(36+len(pcm)))
+	b.WriteString("WAVE")
+	b.WriteString("fmt ")
+	binary.Write(&b, le, uint32(16))           // size of the fmt chunk
+	binary.Write(&b, le, uint16(1))            // PCM
+	binary.Write(&b, le, uint16(1))            // channels
+	binary.Write(&b, le, uint32(sampleRate))   // sample rate
+	binary.Write(&b, le, uint32(sampleRate*2)) // bytes per second
+	binary.Write(&b, le, uint16(2))            // bytes per frame
+	binary.Write(&b, le, uint16(16))           // bits per sample
+	b.WriteString("data")
+	binary.Write(&b, le, uint32(len(pcm)))
+	b.Write(pcm)
+	return b.Bytes()
+}
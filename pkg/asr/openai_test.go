@@ -0,0 +1,171 @@
+package asr_test
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/ajbouh/bridge/pkg/asr"
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+// openAIService answers like whisper.cpp's server does, with the segments and words
+// of the same sentence every time.
+type openAIService struct {
+	paths  []string
+	forms  []map[string][]string
+	auth   string
+	pcm    []float32
+	format []uint16
+}
+
+func (s *openAIService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, `{"error": {"message": "`+err.Error()+`"}}`, http.StatusBadRequest)
+		return
+	}
+	s.paths = append(s.paths, r.URL.Path)
+	s.forms = append(s.forms, r.MultipartForm.Value)
+	s.auth = r.Header.Get("Authorization")
+
+	f, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, `{"error": {"message": "no file"}}`, http.StatusBadRequest)
+		return
+	}
+	wav, _ := io.ReadAll(f)
+	if len(wav) < 44 || string(wav[:4]) != "RIFF" || string(wav[8:12]) != "WAVE" {
+		http.Error(w, `{"error": {"message": "not a wav file"}}`, http.StatusBadRequest)
+		return
+	}
+	le := binary.LittleEndian
+	// format, channels, sample rate and bits per sample
+	s.format = []uint16{le.Uint16(wav[20:]), le.Uint16(wav[22:]), uint16(le.Uint32(wav[24:])), le.Uint16(wav[34:])}
+	s.pcm = nil
+	for i := 44; i+2 <= len(wav); i += 2 {
+		s.pcm = append(s.pcm, float32(int16(le.Uint16(wav[i:])))/math.MaxInt16)
+	}
+
+	json.NewEncoder(w).Encode(map[string]any{
+		"task":     "transcribe",
+		"language": "english",
+		"duration": 2.5,
+		"text":     "Hello there. How are you?",
+		"segments": []map[string]any{
+			{"id": 0, "start": 0.0, "end": 1.2, "text": " Hello there.", "avg_logprob": -0.2, "no_speech_prob": 0.01},
+			{"id": 1, "start": 1.2, "end": 2.5, "text": " How are you?", "avg_logprob": -0.3, "no_speech_prob": 0.02},
+		},
+		"words": []map[string]any{
+			{"word": "Hello", "start": 0.1, "end": 0.5},
+			{"word": "there.", "start": 0.5, "end": 1.1},
+			{"word": "How", "start": 1.3, "end": 1.5, "probability": 0.9},
+			{"word": "are", "start": 1.5, "end": 1.8},
+			{"word": "you?", "start": 1.8, "end": 2.4},
+		},
+	})
+}
+
+func TestOpenAIClient(t *testing.T) {
+	svc := &openAIService{}
+	srv := httptest.NewServer(svc)
+	defer srv.Close()
+
+	// The scheme picks the backend, and the URL carries the key and model.
+	backend, err := asr.NewBackend("openai+http://:secret@" + srv.Listener.Addr().String() + "/v1?model=large-v3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waveform := speech(1)
+	english := "en"
+	resp, err := backend.Transcribe(context.Background(), &router.TranscriptionRequest{
+		Audio:          &router.Audio{Waveform: waveform, SampleRate: 16000},
+		Task:           "transcribe",
+		SourceLanguage: &english,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if svc.paths[0] != "/v1/audio/transcriptions" {
+		t.Errorf("request to %s", svc.paths[0])
+	}
+	if svc.auth != "Bearer secret" {
+		t.Errorf("authorization %q", svc.auth)
+	}
+	form := svc.forms[0]
+	if form["model"][0] != "large-v3" || form["response_format"][0] != "verbose_json" || form["language"][0] != "en" {
+		t.Errorf("form %v", form)
+	}
+	if !reflect.DeepEqual(form["timestamp_granularities[]"], []string{"segment", "word"}) {
+		t.Errorf("timestamp granularities %v", form["timestamp_granularities[]"])
+	}
+	if !reflect.DeepEqual(svc.format, []uint16{1, 1, 16000, 16}) {
+		t.Errorf("wav format, channels, sample rate and bits %v", svc.format)
+	}
+	if len(svc.pcm) != len(waveform) {
+		t.Fatalf("service got %d samples, want %d", len(svc.pcm), len(waveform))
+	}
+	for i := range waveform {
+		if math.Abs(float64(svc.pcm[i]-waveform[i])) > 1.0/math.MaxInt16 {
+			t.Fatalf("sample %d is %g, want %g", i, svc.pcm[i], waveform[i])
+		}
+	}
+
+	if resp.SourceLanguage != "en" || resp.TargetLanguage != "en" || resp.Duration != 2.5 {
+		t.Errorf("response %+v", resp)
+	}
+	var words [][]string
+	for _, s := range resp.Segments {
+		var ws []string
+		for _, w := range s.Words {
+			ws = append(ws, w.Word)
+		}
+		words = append(words, ws)
+	}
+	if want := [][]string{{" Hello", " there."}, {" How", " are", " you?"}}; !reflect.DeepEqual(words, want) {
+		t.Errorf("words %q, want %q", words, want)
+	}
+	if p := resp.Segments[1].Words[0].Probability; p != 0.9 {
+		t.Errorf("probability %g, want 0.9", p)
+	}
+
+	// Translations go to their own endpoint, in whatever language was spoken.
+	resp, err = backend.Transcribe(context.Background(), &router.TranscriptionRequest{
+		Audio:          &router.Audio{Waveform: waveform, SampleRate: 16000},
+		Task:           "translate",
+		TargetLanguage: &english,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.paths[1] != "/v1/audio/translations" {
+		t.Errorf("request to %s", svc.paths[1])
+	}
+	if _, ok := svc.forms[1]["language"]; ok {
+		t.Errorf("translation of %v", svc.forms[1]["language"])
+	}
+	if resp.TargetLanguage != "en" {
+		t.Errorf("translated into %s", resp.TargetLanguage)
+	}
+
+	// Text can't be translated, nor audio into anything but English.
+	text, german := "Hallo", "de"
+	for _, request := range []*router.TranscriptionRequest{
+		{Text: &text, Task: "translate", TargetLanguage: &english},
+		{Audio: &router.Audio{Waveform: waveform, SampleRate: 16000}, Task: "translate", TargetLanguage: &german},
+	} {
+		if _, err := backend.Transcribe(context.Background(), request); err == nil {
+			t.Errorf("no error for %+v", request)
+		}
+	}
+	if len(svc.paths) != 2 {
+		t.Errorf("%d requests, want 2", len(svc.paths))
+	}
+}
@@ -0,0 +1,396 @@
+package asr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	logr "github.com/ajbouh/bridge/pkg/log"
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+var Logger = logr.New()
+
+const (
+	defaultMaxFailures  = 3
+	defaultMinCooldown  = 5 * time.Second
+	defaultMaxCooldown  = 2 * time.Minute
+	defaultProbeTimeout = 30 * time.Second
+)
+
+// ErrUnavailable is the error for requests to a pool whose endpoints are all down.
+var ErrUnavailable = errors.New("no asr endpoint is available")
+
+// PoolConfig is a configuration of a Pool.
+type PoolConfig struct {
+	// URLs are the endpoints, as NewBackend takes them.
+	URLs []string
+
+	// MaxRetries is how many times a request is retried after a server error or a
+	// failed connection, on another endpoint if there is one. MinBackoff and
+	// MaxBackoff bound how long to wait before retrying on an endpoint that was
+	// already tried.
+	MaxRetries int
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxFailures is how many requests in a row have to fail for an endpoint to be
+	// taken out of the pool.
+	MaxFailures int
+	// An endpoint that was taken out is probed after MinCooldown, and again after
+	// twice as long every time the probe fails, up to MaxCooldown. It is put back
+	// once a probe succeeds.
+	MinCooldown time.Duration
+	MaxCooldown time.Duration
+
+	// Probe is the request sent to probe an endpoint, and ProbeTimeout how long the
+	// endpoint has to answer it.
+	Probe        *router.TranscriptionRequest
+	ProbeTimeout time.Duration
+}
+
+func DefaultPoolConfig(urls []string) PoolConfig {
+	return PoolConfig{
+		URLs: urls,
+
+		MaxRetries: defaultMaxRetries,
+		MinBackoff: defaultMinBackoff,
+		MaxBackoff: defaultMaxBackoff,
+
+		MaxFailures: defaultMaxFailures,
+		MinCooldown: defaultMinCooldown,
+		MaxCooldown: defaultMaxCooldown,
+
+		// Half a second of silence
+		Probe: &router.TranscriptionRequest{
+			Audio: &router.Audio{Waveform: make([]float32, 8000), SampleRate: 16000},
+			Task:  "transcribe",
+		},
+		ProbeTimeout: defaultProbeTimeout,
+	}
+}
+
+// EndpointState is whether a Pool sends requests to an endpoint.
+type EndpointState string
+
+const (
+	// EndpointUp endpoints take requests.
+	EndpointUp EndpointState = "up"
+	// EndpointDown endpoints failed too many requests in a row, and wait to be
+	// probed.
+	EndpointDown EndpointState = "down"
+	// EndpointProbing endpoints are down and being probed.
+	EndpointProbing EndpointState = "probing"
+)
+
+// EndpointStats describe how an endpoint of a Pool has been doing.
+type EndpointStats struct {
+	URL   string        `json:"url"`
+	State EndpointState `json:"state"`
+
+	// Outstanding is how many requests are waiting on the endpoint.
+	Outstanding int `json:"outstanding"`
+
+	Requests uint64 `json:"requests"`
+	// Errors counts failed requests, Failures only those the endpoint is to blame
+	// for: server errors, failed connections and timeouts.
+	Errors              uint64 `json:"errors"`
+	Failures            uint64 `json:"failures"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	// Ejections is how many times the endpoint was taken out of the pool.
+	Ejections uint64 `json:"ejections"`
+	LastError string `json:"last_error,omitempty"`
+
+	// Latency is a moving average of how long successful requests took, and
+	// MaxLatency the longest any took.
+	Latency    time.Duration `json:"latency"`
+	MaxLatency time.Duration `json:"max_latency"`
+}
+
+// latencyWeight is how much the latest request counts towards the moving average.
+const latencyWeight = 0.2
+
+type endpoint struct {
+	backend Backend
+
+	// guarded by the pool's mutex
+	stats    EndpointStats
+	cooldown time.Duration
+	probe    *time.Timer
+}
+
+// Pool spreads requests over several endpoints, sending each to the endpoint with
+// the fewest requests outstanding. Endpoints that keep failing are taken out of the
+// pool until a probe finds them working again, and requests fail right away while
+// every endpoint is out.
+type Pool struct {
+	config PoolConfig
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	// next is where the search for the least busy endpoint starts, so ties go
+	// round robin.
+	next   int
+	closed bool
+}
+
+// NewPool returns a pool of the endpoints at urls.
+func NewPool(urls []string) (*Pool, error) {
+	return NewPoolWithConfig(DefaultPoolConfig(urls))
+}
+
+func NewPoolWithConfig(config PoolConfig) (*Pool, error) {
+	if len(config.URLs) == 0 {
+		return nil, errors.New("no urls for Pool")
+	}
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = 1
+	}
+
+	p := &Pool{config: config}
+	for _, u := range config.URLs {
+		backend, err := newEndpointBackend(u)
+		if err != nil {
+			return nil, err
+		}
+		p.endpoints = append(p.endpoints, &endpoint{
+			backend:  backend,
+			stats:    EndpointStats{URL: redact(u), State: EndpointUp},
+			cooldown: config.MinCooldown,
+		})
+	}
+	return p, nil
+}
+
+// newEndpointBackend returns the backend for url, leaving retries to the pool.
+func newEndpointBackend(u string) (Backend, error) {
+	if rest, ok := strings.CutPrefix(u, openAIScheme); ok {
+		config, err := openAIConfig(rest)
+		if err != nil {
+			return nil, err
+		}
+		config.MaxRetries = 0
+		return NewOpenAIClientWithConfig(config)
+	}
+	config := DefaultConfig(u)
+	config.MaxRetries = 0
+	return NewClientWithConfig(config)
+}
+
+// redact hides the password, like an API key, in u.
+func redact(u string) string {
+	scheme, rest, ok := strings.Cut(u, "+")
+	if !ok || strings.Contains(scheme, "://") {
+		scheme, rest = "", u
+	} else {
+		scheme += "+"
+	}
+	parsed, err := url.Parse(rest)
+	if err != nil {
+		return u
+	}
+	return scheme + parsed.Redacted()
+}
+
+func (p *Pool) Transcribe(ctx context.Context, request *router.TranscriptionRequest) (*router.TranscriptionResponse, error) {
+	tried := map[*endpoint]bool{}
+	var lastErr error
+	for attempt := 0; attempt <= p.config.MaxRetries; attempt++ {
+		e := p.acquire(tried)
+		if e == nil {
+			break
+		}
+
+		if tried[e] {
+			// Every endpoint that's up was tried already, so give this one a moment.
+			timer := time.NewTimer(backoff(p.config.MinBackoff, p.config.MaxBackoff, attempt-1))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				p.release(e, 0, ctx, ctx.Err())
+				return nil, cancelled(ctx, lastErr)
+			}
+		}
+		tried[e] = true
+
+		start := time.Now()
+		resp, err := e.backend.Transcribe(ctx, request)
+		p.release(e, time.Since(start), ctx, err)
+		if err == nil {
+			return resp, nil
+		}
+
+		lastErr = err
+		if !retryable(ctx, err) {
+			return nil, err
+		}
+		Logger.Error(err, "error transcribing, trying another endpoint", "endpoint", e.stats.URL)
+	}
+
+	if lastErr == nil {
+		return nil, ErrUnavailable
+	}
+	return nil, lastErr
+}
+
+// acquire picks the endpoint that's up with the fewest requests outstanding,
+// preferring those that weren't tried yet, and counts a request to it. It returns nil
+// if every endpoint is down.
+func (p *Pool) acquire(tried map[*endpoint]bool) *endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var best *endpoint
+	n := len(p.endpoints)
+	for i := 0; i < n; i++ {
+		e := p.endpoints[(p.next+i)%n]
+		if e.stats.State != EndpointUp {
+			continue
+		}
+		if best == nil ||
+			(tried[best] && !tried[e]) ||
+			(tried[best] == tried[e] && e.stats.Outstanding < best.stats.Outstanding) {
+			best = e
+		}
+	}
+	p.next = (p.next + 1) % n
+
+	if best != nil {
+		best.stats.Outstanding++
+		best.stats.Requests++
+	}
+	return best
+}
+
+// release records the outcome of a request to e that took latency.
+func (p *Pool) release(e *endpoint, latency time.Duration, ctx context.Context, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := &e.stats
+	s.Outstanding--
+
+	if err == nil {
+		s.ConsecutiveFailures = 0
+		if s.Latency == 0 {
+			s.Latency = latency
+		} else {
+			s.Latency += time.Duration(latencyWeight * float64(latency-s.Latency))
+		}
+		if latency > s.MaxLatency {
+			s.MaxLatency = latency
+		}
+		return
+	}
+
+	if ctx.Err() != nil {
+		// Whoever made the request gave up on it, which says nothing about the
+		// endpoint.
+		s.Requests--
+		return
+	}
+
+	s.Errors++
+	s.LastError = err.Error()
+	if !retryable(ctx, err) {
+		// The endpoint turned the request down, which it wouldn't if it were broken.
+		s.ConsecutiveFailures = 0
+		return
+	}
+
+	s.Failures++
+	s.ConsecutiveFailures++
+	if s.State == EndpointUp && s.ConsecutiveFailures >= p.config.MaxFailures {
+		s.State = EndpointDown
+		s.Ejections++
+		Logger.Infof("%s failed %d requests in a row, probing it again in %s", s.URL, s.ConsecutiveFailures, e.cooldown)
+		p.scheduleProbe(e)
+	}
+}
+
+// scheduleProbe probes e once its cooldown is over. p.mu must be held.
+func (p *Pool) scheduleProbe(e *endpoint) {
+	if p.closed {
+		return
+	}
+	e.probe = time.AfterFunc(e.cooldown, func() { p.probe(e) })
+}
+
+// probe sends the probe request to e, and puts e back in the pool if it answers.
+func (p *Pool) probe(e *endpoint) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	e.stats.State = EndpointProbing
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.ProbeTimeout)
+	_, err := e.backend.Transcribe(ctx, p.config.Probe)
+	cancel()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		Logger.Infof("%s answered its probe, putting it back", e.stats.URL)
+		e.stats.State = EndpointUp
+		e.stats.ConsecutiveFailures = 0
+		e.cooldown = p.config.MinCooldown
+		return
+	}
+
+	e.stats.State = EndpointDown
+	e.stats.LastError = err.Error()
+	e.cooldown *= 2
+	if e.cooldown <= 0 || e.cooldown > p.config.MaxCooldown {
+		e.cooldown = p.config.MaxCooldown
+	}
+	Logger.Error(err, "endpoint failed its probe", "endpoint", e.stats.URL, "cooldown", e.cooldown)
+	p.scheduleProbe(e)
+}
+
+// Stats returns the stats of every endpoint, in the order of the URLs.
+func (p *Pool) Stats() []EndpointStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]EndpointStats, len(p.endpoints))
+	for i, e := range p.endpoints {
+		stats[i] = e.stats
+	}
+	return stats
+}
+
+// ServeHTTP serves the stats of every endpoint as JSON, with latencies in
+// nanoseconds.
+func (p *Pool) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(p.Stats()); err != nil {
+		Logger.Error(err, "error writing response")
+	}
+}
+
+// Close stops probing endpoints.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	for _, e := range p.endpoints {
+		if e.probe != nil {
+			e.probe.Stop()
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package asr_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/asr"
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+// replica is a transcription service whose answers can be switched between working,
+// failing and hanging.
+type replica struct {
+	*httptest.Server
+
+	status   atomic.Int32
+	requests atomic.Int32
+	hold     chan struct{}
+}
+
+func newReplica(t *testing.T) *replica {
+	r := &replica{hold: make(chan struct{})}
+	r.status.Store(http.StatusOK)
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.requests.Add(1)
+		<-r.hold
+		if status := int(r.status.Load()); status != http.StatusOK {
+			http.Error(w, `{"detail": "no"}`, status)
+			return
+		}
+		json.NewEncoder(w).Encode(router.TranscriptionResponse{SourceLanguage: "en"})
+	}))
+	t.Cleanup(r.Server.Close)
+	return r
+}
+
+func newPool(t *testing.T, replicas ...*replica) *asr.Pool {
+	t.Helper()
+	var urls []string
+	for _, r := range replicas {
+		urls = append(urls, r.URL)
+	}
+	config := asr.DefaultPoolConfig(urls)
+	config.MinBackoff = time.Millisecond
+	config.MaxBackoff = 5 * time.Millisecond
+	config.MaxFailures = 2
+	config.MinCooldown = 20 * time.Millisecond
+	config.MaxCooldown = 40 * time.Millisecond
+	p, err := asr.NewPoolWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+var request = &router.TranscriptionRequest{Task: "transcribe"}
+
+func TestPoolBalancesOutstandingRequests(t *testing.T) {
+	a, b, c := newReplica(t), newReplica(t), newReplica(t)
+	p := newPool(t, a, b, c)
+
+	// Every replica holds on to its requests, so each new one goes to whichever
+	// has the fewest.
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Transcribe(context.Background(), request); err != nil {
+				t.Error(err)
+			}
+		}()
+		waitFor(t, func() bool {
+			return a.requests.Load()+b.requests.Load()+c.requests.Load() == int32(i+1)
+		})
+	}
+	for _, r := range []*replica{a, b, c} {
+		if got := r.requests.Load(); got != 2 {
+			t.Errorf("%s got %d requests, want 2", r.URL, got)
+		}
+	}
+	for _, s := range p.Stats() {
+		if s.Outstanding != 2 {
+			t.Errorf("%s has %d requests outstanding, want 2", s.URL, s.Outstanding)
+		}
+	}
+
+	for _, r := range []*replica{a, b, c} {
+		close(r.hold)
+	}
+	wg.Wait()
+
+	for _, s := range p.Stats() {
+		if s.Outstanding != 0 || s.Requests != 2 || s.Errors != 0 || s.Latency <= 0 || s.MaxLatency < s.Latency {
+			t.Errorf("stats %+v", s)
+		}
+	}
+}
+
+func TestPoolEjectsAndReadmits(t *testing.T) {
+	good, bad := newReplica(t), newReplica(t)
+	close(good.hold)
+	close(bad.hold)
+	bad.status.Store(http.StatusServiceUnavailable)
+	p := newPool(t, bad, good)
+
+	// Requests fail over to the good replica until the bad one is taken out.
+	for i := 0; i < 10; i++ {
+		if _, err := p.Transcribe(context.Background(), request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := bad.requests.Load(); got != 2 {
+		t.Errorf("bad replica got %d requests, want 2", got)
+	}
+	stats := p.Stats()
+	if s := stats[0]; s.State == asr.EndpointUp || s.Ejections != 1 || s.Failures != 2 || s.LastError == "" {
+		t.Errorf("bad replica stats %+v", s)
+	}
+	if s := stats[1]; s.State != asr.EndpointUp || s.Requests != 10 || s.Errors != 0 {
+		t.Errorf("good replica stats %+v", s)
+	}
+
+	// Probes keep it out while it's failing, and put it back once it works.
+	waitFor(t, func() bool { return bad.requests.Load() >= 4 })
+	if s := p.Stats()[0]; s.State == asr.EndpointUp {
+		t.Errorf("bad replica is back while failing its probes")
+	}
+	bad.status.Store(http.StatusOK)
+	waitFor(t, func() bool { return p.Stats()[0].State == asr.EndpointUp })
+
+	before := bad.requests.Load()
+	for i := 0; i < 4; i++ {
+		if _, err := p.Transcribe(context.Background(), request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := bad.requests.Load() - before; got != 2 {
+		t.Errorf("readmitted replica got %d of 4 requests, want 2", got)
+	}
+}
+
+func TestPoolFailsFastWhenAllDown(t *testing.T) {
+	a, b := newReplica(t), newReplica(t)
+	close(a.hold)
+	close(b.hold)
+	a.status.Store(http.StatusInternalServerError)
+	b.status.Store(http.StatusInternalServerError)
+	p := newPool(t, a, b)
+
+	// The first request is retried on each replica until both are out.
+	var statusErr *asr.StatusError
+	if _, err := p.Transcribe(context.Background(), request); !errors.As(err, &statusErr) {
+		t.Fatalf("error %v, want a StatusError", err)
+	}
+	for i, s := range p.Stats() {
+		if s.State == asr.EndpointUp {
+			t.Errorf("replica %d is still up", i)
+		}
+	}
+
+	sent := a.requests.Load() + b.requests.Load()
+	if _, err := p.Transcribe(context.Background(), request); !errors.Is(err, asr.ErrUnavailable) {
+		t.Errorf("error %v, want ErrUnavailable", err)
+	}
+	if got := a.requests.Load() + b.requests.Load(); got != sent {
+		t.Errorf("%d requests sent while every replica was out", got-sent)
+	}
+}
+
+func TestPoolDoesNotFailOverBadRequests(t *testing.T) {
+	a, b := newReplica(t), newReplica(t)
+	close(a.hold)
+	close(b.hold)
+	a.status.Store(http.StatusUnprocessableEntity)
+	b.status.Store(http.StatusUnprocessableEntity)
+	p := newPool(t, a, b)
+
+	for i := 0; i < 4; i++ {
+		var statusErr *asr.StatusError
+		if _, err := p.Transcribe(context.Background(), request); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("error %v, want a 422", err)
+		}
+	}
+	if got := a.requests.Load() + b.requests.Load(); got != 4 {
+		t.Errorf("%d requests for 4 bad ones", got)
+	}
+	for _, s := range p.Stats() {
+		if s.State != asr.EndpointUp || s.Errors != 2 || s.Failures != 0 {
+			t.Errorf("stats %+v", s)
+		}
+	}
+}
+
+func TestPoolReportsCancellation(t *testing.T) {
+	a := newReplica(t)
+	close(a.hold)
+	a.status.Store(http.StatusInternalServerError)
+
+	config := asr.DefaultPoolConfig([]string{a.URL})
+	config.MinBackoff = time.Hour
+	config.MaxBackoff = time.Hour
+	p, err := asr.NewPoolWithConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// The request fails and is cancelled while it waits to be retried.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for a.requests.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err = p.Transcribe(ctx, request)
+	var statusErr *asr.StatusError
+	if !errors.Is(err, context.Canceled) || errors.As(err, &statusErr) {
+		t.Errorf("error %v, want the context's", err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
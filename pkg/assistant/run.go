@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/ajbouh/bridge/pkg/chat"
 	"github.com/ajbouh/bridge/pkg/chat/jsonschema"
@@ -20,23 +21,48 @@ type Assistant struct {
 	MaxTokens       int
 
 	systemMessage string
+
+	// mu guards cancel, which stops the chat completion in flight, if any, and
+	// heard, the IDs of our replies its prompt takes as heard in full.
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	heard  map[string]bool
 }
 
 func New(name, url string) router.MiddlewareFunc {
+	// Every router the middleware is installed into shares one client.
+	client := chat.NewClientWithConfig(chat.DefaultConfig(url))
+
 	return func(ctx context.Context, emit router.Emitters) (router.Listeners, error) {
-		assist := NewAssistant(
-			name,
-			chat.NewClientWithConfig(chat.DefaultConfig(url)),
-		)
+		assist := NewAssistant(name, client)
 		listener := make(chan router.Document, 100)
-		go assist.Run(emit.Transcription, listener)
+		interruptions := make(chan *router.Interruption, 100)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			assist.Run(emit.Transcription, listener)
+		}()
+		go assist.Listen(interruptions)
 
 		return router.Listeners{
 			FinalDocument: listener,
+			Interruption:  interruptions,
+			Participant: &router.Participant{
+				ID:          ParticipantID(name),
+				Label:       name,
+				IsAssistant: true,
+			},
+			Done: done,
 		}, nil
 	}
 }
 
+// ParticipantID is the ID of the participant the assistant called name takes part
+// in the session as.
+func ParticipantID(name string) string {
+	return "assistant/" + name
+}
+
 func NewAssistant(name string, client *chat.Client) *Assistant {
 	return &Assistant{
 		Name:            name,
@@ -90,12 +116,12 @@ func (o *Assistant) newRequest(includeFunctions bool) *chat.ChatCompletionReques
 	}
 }
 
-func (o *Assistant) generate(req *chat.ChatCompletionRequest) (string, *chat.FunctionCall, error) {
+func (o *Assistant) generate(ctx context.Context, req *chat.ChatCompletionRequest) (string, *chat.FunctionCall, error) {
 	var (
 		chunk string
 		err   error
 	)
-	resp, err := o.Client.CreateChatCompletion(context.Background(), *req)
+	resp, err := o.Client.CreateChatCompletion(ctx, *req)
 
 	if err != nil {
 		return chunk, nil, err
@@ -180,31 +206,45 @@ func transcriptionAsCompletionMessages(t *router.Transcription, roleFunc func(s
 	return messages
 }
 
+// shouldRespond marks the final transcriptions in doc that weren't observed yet as
+// observed, and returns the latest of them that mentions name. People's speech
+// overlaps, so it finalizes out of order and needn't be the last entry of doc.
 func shouldRespond(name string, observed map[string]bool, doc router.Document) (*router.Transcription, bool) {
-	var t *router.Transcription
-	for i := len(doc.Transcriptions) - 1; i >= 0; i-- {
-		t = doc.Transcriptions[i]
-
+	var mention *router.Transcription
+	for i := 0; i < doc.Len(); i++ {
+		t := doc.At(i)
 		if !t.Final {
-			return t, false
+			continue
+		}
+
+		// we'll fall behind as we wait for an answer. don't try to respond to one of these messages after we've seen it.
+		if observed[t.ID] {
+			continue
 		}
+		observed[t.ID] = true
 
-		break
+		if mentions(name, t) {
+			mention = t
+		}
 	}
 
+	return mention, mention != nil
+}
+
+func mentions(name string, t *router.Transcription) bool {
 	// Only respond to things that aren't based on other parts of the transcript. This avoids loops.
-	if t == nil || len(t.TranscriptSources) > 0 {
-		return t, false
+	if len(t.TranscriptSources) > 0 {
+		return false
 	}
 
-	// we'll fall behind as we wait for an answer. don't try to respond to one of these messages after we've seen it.
-	if observed[t.ID] {
-		return t, false
+	// Nor to ourselves or anyone else played into the session, picked up again by
+	// somebody's microphone.
+	for _, audio := range t.AudioSources {
+		if audio.EchoOf != "" {
+			return false
+		}
 	}
 
-	observed[t.ID] = true
-
-	mentioned := false
 	// Only consider text said by a person.
 	// For now only say something if the word "bridge" occurs in the text.
 	for _, msg := range transcriptionAsCompletionMessages(t, func(s *router.TranscriptionSegment) string {
@@ -216,16 +256,11 @@ func shouldRespond(name string, observed map[string]bool, doc router.Document) (
 	}) {
 		fmt.Printf("msg=%#v\n", msg)
 		if strings.Contains(strings.ToLower(msg.Content), name) {
-			mentioned = true
-			break
+			return true
 		}
 	}
 
-	if !mentioned {
-		return t, false
-	}
-
-	return t, true
+	return false
 }
 
 func (a *Assistant) greedilyPopulateMessageHistory(doc router.Document, req *chat.ChatCompletionRequest, limit int) ([]*router.Transcription, uint64) {
@@ -236,8 +271,8 @@ func (a *Assistant) greedilyPopulateMessageHistory(doc router.Document, req *cha
 	var start uint64
 	remaining := limit
 
-	for i := len(doc.Transcriptions) - 1; i >= 0 && remaining > 0; i-- {
-		t := doc.Transcriptions[i]
+	for i := doc.Len() - 1; i >= 0 && remaining > 0; i-- {
+		t := doc.At(i)
 		nextMessages := transcriptionAsCompletionMessages(t, func(s *router.TranscriptionSegment) string {
 			if !s.IsAssistant {
 				return "user"
@@ -278,11 +313,14 @@ func (a *Assistant) respondToDocument(doc router.Document) (*router.Transcriptio
 	reqWithoutFunctions := a.newRequest(false)
 	transcriptSourcesWithoutFunctions, startWithoutFunctions := a.greedilyPopulateMessageHistory(doc, reqWithoutFunctions, 2000)
 
+	ctx := a.begin(a.heardIn(transcriptSourcesWithoutFunctions))
+	defer a.end()
+
 	var transcriptSources []*router.Transcription
 	var start uint64
 	var gen string
 
-	genWithFunctions, fnCall, err := a.generate(reqWithFunctions)
+	genWithFunctions, fnCall, err := a.generate(ctx, reqWithFunctions)
 	if err == nil {
 		if fnCall != nil {
 			transcriptSources = transcriptSourcesWithFunctions
@@ -293,8 +331,13 @@ func (a *Assistant) respondToDocument(doc router.Document) (*router.Transcriptio
 		fmt.Printf("error generating with functions: %s\n", err)
 	}
 
+	if ctx.Err() != nil {
+		fmt.Printf("assistant %s was interrupted\n", a.Name)
+		return nil, false
+	}
+
 	if fnCall == nil || err != nil {
-		genWithoutFunctions, _, err := a.generate(reqWithoutFunctions)
+		genWithoutFunctions, _, err := a.generate(ctx, reqWithoutFunctions)
 		if err != nil {
 			fmt.Printf("error generating without functions: %s\n", err)
 			return nil, false
@@ -335,3 +378,58 @@ func (a *Assistant) Run(transcriptionStream chan<- *router.Transcription, listen
 		}
 	}
 }
+
+// Listen cancels the chat completion in flight when somebody talks over a reply its
+// prompt takes as heard in full, until interruptions is closed. Whatever it would
+// have said is stale by the time they're done. A completion that started once the
+// reply was known to be cut off goes on.
+func (a *Assistant) Listen(interruptions <-chan *router.Interruption) {
+	for i := range interruptions {
+		if i.Source != ParticipantID(a.Name) {
+			continue
+		}
+
+		a.mu.Lock()
+		if a.cancel != nil && a.heard[i.TranscriptionID] {
+			fmt.Printf("assistant %s was talked over in %s\n", a.Name, i.TranscriptionID)
+			a.cancel()
+		}
+		a.mu.Unlock()
+	}
+}
+
+// heardIn returns the IDs of our replies among sources that weren't cut off.
+func (a *Assistant) heardIn(sources []*router.Transcription) map[string]bool {
+	heard := map[string]bool{}
+	for _, t := range sources {
+		if t.Truncated {
+			continue
+		}
+		for _, segment := range t.Segments {
+			if segment.IsAssistant && segment.Speaker == a.Name {
+				heard[t.ID] = true
+			}
+		}
+	}
+	return heard
+}
+
+// begin returns the context for a new chat completion whose prompt takes the replies
+// in heard as heard in full. It's cancelled when one of them is talked over.
+func (a *Assistant) begin(heard map[string]bool) context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cancel = cancel
+	a.heard = heard
+	return ctx
+}
+
+func (a *Assistant) end() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cancel()
+	a.cancel = nil
+	a.heard = nil
+}
@@ -0,0 +1,46 @@
+package assistant
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+func TestListenCancelsCompletionsThatHeardTheReply(t *testing.T) {
+	a := NewAssistant("Bridge", nil)
+	interruptions := make(chan *router.Interruption)
+	go a.Listen(interruptions)
+	defer close(interruptions)
+
+	reply := func(id string, truncated bool) *router.Transcription {
+		return &router.Transcription{
+			ID:        id,
+			Truncated: truncated,
+			Segments:  []router.TranscriptionSegment{{Speaker: "Bridge", IsAssistant: true, Text: "Once upon a time"}},
+		}
+	}
+	question := &router.Transcription{
+		ID:       "question",
+		Segments: []router.TranscriptionSegment{{Speaker: "alice", Text: "Bridge, stop."}},
+	}
+
+	// The completion started after the story was cut off knows it was.
+	ctx := a.begin(a.heardIn([]*router.Transcription{question, reply("story", true)}))
+	interruptions <- &router.Interruption{Source: ParticipantID("Bridge"), TranscriptionID: "story"}
+	interruptions <- &router.Interruption{Source: "somebody else", TranscriptionID: "question"}
+	if ctx.Err() != nil {
+		t.Error("completion was cancelled by an interruption of a reply it knew was cut off")
+	}
+	a.end()
+
+	// One that took the story as heard in full is stale.
+	ctx = a.begin(a.heardIn([]*router.Transcription{question, reply("story", false)}))
+	interruptions <- &router.Interruption{Source: ParticipantID("Bridge"), TranscriptionID: "story"}
+	// Listen is done with an interruption once it takes the next one.
+	interruptions <- &router.Interruption{}
+	if ctx.Err() != context.Canceled {
+		t.Error("completion wasn't cancelled when the reply it took as heard was talked over")
+	}
+	a.end()
+}
@@ -0,0 +1,108 @@
+package diarization
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+// turn is a stretch of audio spoken by speaker, in seconds from the start of the
+// audio.
+type turn struct {
+	start, end float32
+	speaker    int
+}
+
+// speakerAt returns the speaker of the turn overlapping start to end the most, or
+// of the nearest turn if none overlap it, or 0 if there are no turns.
+func speakerAt(turns []turn, start, end float32) int {
+	var speaker int
+	best := float32(-1)
+	for _, t := range turns {
+		// Overlap is positive, the gap between them negative.
+		overlap := t.end - start
+		if end-t.start < overlap {
+			overlap = end - t.start
+		}
+		if t.end-t.start < overlap {
+			overlap = t.end - t.start
+		}
+		if end-start < overlap {
+			overlap = end - start
+		}
+		if speaker == 0 || overlap > best {
+			speaker, best = t.speaker, overlap
+		}
+	}
+	return speaker
+}
+
+// label names speaker number n of the participant whose speech is labelled base.
+// The first speaker keeps the participant's label.
+func label(base string, n int) string {
+	if base == "" || base == "Unknown" {
+		return fmt.Sprintf("Speaker %d", n)
+	}
+	if n == 1 {
+		return base
+	}
+	return fmt.Sprintf("%s (%d)", base, n)
+}
+
+// relabel returns a copy of t with its segments attributed to the speakers of turns.
+// Segments are split where the speaker changes between words.
+func relabel(t *router.Transcription, turns []turn) *router.Transcription {
+	out := *t
+	out.Segments = nil
+
+	for _, segment := range t.Segments {
+		base := segment.Speaker
+
+		if len(segment.Words) == 0 {
+			if n := speakerAt(turns, segment.Start, segment.End); n != 0 {
+				segment.Speaker = label(base, n)
+			}
+			out.Segments = append(out.Segments, segment)
+			continue
+		}
+
+		// Split the words into runs by the same speaker.
+		var runs [][]router.Word
+		var speakers []int
+		for i, word := range segment.Words {
+			n := speakerAt(turns, word.Start, word.End)
+			if i == 0 || n != speakers[len(speakers)-1] {
+				runs = append(runs, nil)
+				speakers = append(speakers, n)
+			}
+			runs[len(runs)-1] = append(runs[len(runs)-1], word)
+		}
+
+		if len(runs) == 1 {
+			if speakers[0] != 0 {
+				segment.Speaker = label(base, speakers[0])
+			}
+			out.Segments = append(out.Segments, segment)
+			continue
+		}
+
+		for i, words := range runs {
+			part := segment
+			part.Words = words
+			part.Start = words[0].Start
+			part.End = words[len(words)-1].End
+			var text strings.Builder
+			for _, w := range words {
+				text.WriteString(w.Word)
+			}
+			part.Text = text.String()
+			if speakers[i] != 0 {
+				part.Speaker = label(base, speakers[i])
+			}
+			out.Segments = append(out.Segments, part)
+		}
+	}
+
+	return &out
+}
@@ -0,0 +1,206 @@
+// Package diarization tells apart the people speaking into the same microphone.
+package diarization
+
+import (
+	"context"
+
+	"github.com/ajbouh/bridge/pkg/asr"
+	logr "github.com/ajbouh/bridge/pkg/log"
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+var Logger = logr.New()
+
+const (
+	// defaultThreshold is how similar the embeddings of the same speaker are, at
+	// least, with the pyannote/embedding model.
+	defaultThreshold = 0.5
+
+	// staleAfter is how long diarized audio waits for its transcription, and the
+	// other way around, in milliseconds of media time before it's forgotten.
+	staleAfter = 5 * 60 * 1000
+)
+
+// Backend diarizes audio.
+type Backend interface {
+	Diarize(ctx context.Context, request *router.DiarizationRequest) (*router.DiarizationResponse, error)
+}
+
+var _ Backend = (*asr.Client)(nil)
+
+// New returns a middleware that diarizes final captured audio with the /v1/diarize
+// endpoint at url, and attributes the segments of its transcription to the speakers
+// found in it.
+func New(url string) (router.MiddlewareFunc, error) {
+	client, err := asr.NewClient(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, emit router.Emitters) (router.Listeners, error) {
+		captured := make(chan *router.CapturedAudio, 100)
+		changes := make(chan *router.DocumentChange, 100)
+		// Speakers are told apart for as long as the session lasts.
+		d := NewDiarizer(client, defaultThreshold)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			d.Run(emit.Transcription, captured, changes)
+		}()
+
+		return router.Listeners{
+			CapturedAudio:  captured,
+			DocumentChange: changes,
+			Done:           done,
+		}, nil
+	}, nil
+}
+
+type Diarizer struct {
+	backend Backend
+	voices  *Voices
+}
+
+func NewDiarizer(backend Backend, threshold float32) *Diarizer {
+	return &Diarizer{
+		backend: backend,
+		voices:  NewVoices(threshold),
+	}
+}
+
+// diarized is audio whose speaker turns are known.
+type diarized struct {
+	audio *router.CapturedAudio
+	turns []turn
+	err   error
+}
+
+// Run diarizes final audio from captured and, once the transcription of the same
+// audio shows up in changes, emits it again with its speakers relabelled. It returns
+// once both are closed and the audio already captured is diarized.
+func (d *Diarizer) Run(transcriptions chan<- *router.Transcription, captured <-chan *router.CapturedAudio, changes <-chan *router.DocumentChange) {
+	// Diarization takes a while, so it happens on the side while we keep up with
+	// the document.
+	requests := make(chan *router.CapturedAudio, 100)
+	results := make(chan *diarized)
+	go func() {
+		defer close(results)
+		for audio := range requests {
+			results <- d.diarize(audio)
+		}
+	}()
+
+	// transcribed holds final transcriptions of audio that isn't diarized yet, and
+	// untranscribed the diarized audio whose transcription hasn't shown up yet, by
+	// audio ID.
+	transcribed := map[string]*router.Transcription{}
+	untranscribed := map[string]*diarized{}
+	// relabelled holds when the transcriptions we emitted end, until they come back
+	// as changes.
+	relabelled := map[string]uint64{}
+
+	emit := func(t *router.Transcription, turns []turn) {
+		out := relabel(t, turns)
+		relabelled[out.ID] = out.EndTimestamp
+		transcriptions <- out
+	}
+
+	// Audio that fails to be transcribed or diarized leaves the other half waiting,
+	// until it's given up on.
+	prune := func(now uint64) {
+		for id, t := range transcribed {
+			if t.EndTimestamp+staleAfter < now {
+				delete(transcribed, id)
+			}
+		}
+		for id, r := range untranscribed {
+			if r.audio.EndTimestamp+staleAfter < now {
+				delete(untranscribed, id)
+			}
+		}
+		for id, end := range relabelled {
+			if end+staleAfter < now {
+				delete(relabelled, id)
+			}
+		}
+	}
+
+	for captured != nil || changes != nil || results != nil {
+		select {
+		case audio, ok := <-captured:
+			if !ok {
+				captured = nil
+				close(requests)
+				continue
+			}
+			if !audio.Final || audio.EchoOf != "" || len(audio.PCM) == 0 {
+				continue
+			}
+			prune(audio.StartTimestamp)
+			requests <- audio
+		case change, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+
+			// Our own transcriptions coming back are done with, as are removed ones.
+			if _, ok := relabelled[change.ID()]; ok {
+				delete(relabelled, change.ID())
+				continue
+			}
+
+			t := change.Transcription
+			if t == nil || !t.Final || len(t.AudioSources) != 1 || len(t.TranscriptSources) > 0 {
+				continue
+			}
+			audioID := t.AudioSources[0].ID
+			if r, ok := untranscribed[audioID]; ok {
+				delete(untranscribed, audioID)
+				emit(t, r.turns)
+				continue
+			}
+			transcribed[audioID] = t
+		case r, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+			if r.err != nil {
+				Logger.Error(r.err, "error diarizing", "audio", r.audio.ID)
+				continue
+			}
+
+			if t, ok := transcribed[r.audio.ID]; ok {
+				delete(transcribed, r.audio.ID)
+				emit(t, r.turns)
+				continue
+			}
+			untranscribed[r.audio.ID] = r
+		}
+	}
+}
+
+// diarize finds the speaker turns in audio.
+func (d *Diarizer) diarize(audio *router.CapturedAudio) *diarized {
+	// The middleware's context is cancelled as soon as shutdown starts, but audio
+	// that was already captured should still be diarized.
+	response, err := d.backend.Diarize(context.Background(), &router.DiarizationRequest{
+		Audio: &router.Audio{
+			Waveform:   audio.PCM,
+			SampleRate: 16000,
+		},
+		Task: "diarize",
+	})
+	if err != nil {
+		return &diarized{audio: audio, err: err}
+	}
+
+	numbers := d.voices.Identify(audio.Source, response)
+	turns := make([]turn, 0, len(response.Segments))
+	for _, s := range response.Segments {
+		turns = append(turns, turn{start: s.Start, end: s.End, speaker: numbers[s.Label]})
+	}
+	return &diarized{audio: audio, turns: turns}
+}
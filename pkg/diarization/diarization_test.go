@@ -0,0 +1,126 @@
+package diarization
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+// backendFunc diarizes audio by the number of samples in it.
+type backendFunc func(n int) *router.DiarizationResponse
+
+func (f backendFunc) Diarize(ctx context.Context, request *router.DiarizationRequest) (*router.DiarizationResponse, error) {
+	return f(len(request.Audio.Waveform)), nil
+}
+
+func TestDiarizerRelabelsTranscriptions(t *testing.T) {
+	alice := []float32{1, 0.1, 0}
+	bob := []float32{0, 0.2, 1}
+
+	// Two utterances with Alice and Bob talking into the same microphone. The
+	// service labels them in the order they speak, so differently each time.
+	backend := backendFunc(func(n int) *router.DiarizationResponse {
+		if n == 1 {
+			return &router.DiarizationResponse{
+				Segments: []router.DiarizationSegment{
+					{Start: 0, End: 1.5, Label: "SPEAKER_00"},
+					{Start: 1.5, End: 3, Label: "SPEAKER_01"},
+				},
+				Embeddings: map[string][]float32{"SPEAKER_00": alice, "SPEAKER_01": bob},
+			}
+		}
+		return &router.DiarizationResponse{
+			Segments: []router.DiarizationSegment{
+				{Start: 0, End: 2, Label: "SPEAKER_00"},
+			},
+			Embeddings: map[string][]float32{"SPEAKER_00": {0.1, 0.1, 0.9}},
+		}
+	})
+
+	d := NewDiarizer(backend, defaultThreshold)
+	captured := make(chan *router.CapturedAudio)
+	changes := make(chan *router.DocumentChange)
+	transcriptions := make(chan *router.Transcription, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Run(transcriptions, captured, changes)
+	}()
+
+	first := &router.CapturedAudio{ID: "a", Source: "room", PCM: make([]float32, 1), Final: true}
+	second := &router.CapturedAudio{ID: "b", Source: "room", PCM: make([]float32, 2), Final: true}
+
+	captured <- first
+	changes <- &router.DocumentChange{Kind: router.TranscriptionAdded, Transcription: &router.Transcription{
+		ID:           "a/transcription",
+		Final:        true,
+		AudioSources: []*router.CapturedAudio{first},
+		Segments: []router.TranscriptionSegment{
+			{Start: 0, End: 3, Speaker: "Room", Text: " Hi Bob. Hi Alice.", Words: []router.Word{
+				{Start: 0.1, End: 0.4, Word: " Hi"},
+				{Start: 0.4, End: 1.0, Word: " Bob."},
+				{Start: 1.6, End: 1.9, Word: " Hi"},
+				{Start: 1.9, End: 2.5, Word: " Alice."},
+			}},
+		},
+	}}
+
+	got := <-transcriptions
+	var speakers, texts []string
+	for _, s := range got.Segments {
+		speakers = append(speakers, s.Speaker)
+		texts = append(texts, s.Text)
+	}
+	if want := []string{"Room", "Room (2)"}; !reflect.DeepEqual(speakers, want) {
+		t.Errorf("speakers %q, want %q", speakers, want)
+	}
+	if want := []string{" Hi Bob.", " Hi Alice."}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("texts %q, want %q", texts, want)
+	}
+
+	// Our own transcription coming back isn't relabelled again.
+	changes <- &router.DocumentChange{Kind: router.TranscriptionReplaced, Transcription: got}
+
+	// Drafts aren't diarized.
+	captured <- &router.CapturedAudio{ID: "draft", Source: "room", PCM: make([]float32, 3)}
+	captured <- second
+	changes <- &router.DocumentChange{Kind: router.TranscriptionAdded, Transcription: &router.Transcription{
+		ID:           "b/transcription",
+		Final:        true,
+		AudioSources: []*router.CapturedAudio{second},
+		Segments: []router.TranscriptionSegment{
+			{Start: 0, End: 2, Speaker: "Room", Text: " Bye."},
+		},
+	}}
+
+	got = <-transcriptions
+	if got.ID != "b/transcription" || got.Segments[0].Speaker != "Room (2)" {
+		t.Errorf("second transcription %+v, want it said by Bob", got)
+	}
+
+	close(captured)
+	close(changes)
+	<-done
+	if len(transcriptions) != 0 {
+		t.Errorf("%d more transcriptions", len(transcriptions))
+	}
+}
+
+func TestRelabelUnknownSpeakers(t *testing.T) {
+	in := &router.Transcription{
+		Segments: []router.TranscriptionSegment{
+			{Start: 0, End: 1, Speaker: "Unknown"},
+			{Start: 4, End: 5, Speaker: "Unknown"},
+		},
+	}
+	// The second segment falls between turns and goes to the nearest.
+	out := relabel(in, []turn{{0, 1, 1}, {1, 2, 2}, {5.5, 6, 1}})
+	if out.Segments[0].Speaker != "Speaker 1" || out.Segments[1].Speaker != "Speaker 1" {
+		t.Errorf("segments %+v", out.Segments)
+	}
+	if in.Segments[0].Speaker != "Unknown" {
+		t.Error("the transcription in the document was modified")
+	}
+}
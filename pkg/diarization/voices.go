@@ -0,0 +1,158 @@
+package diarization
+
+import (
+	"math"
+	"sort"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+// maxWeight caps how many embeddings a voice is averaged over, so it keeps adapting
+// to how the speaker sounds now.
+const maxWeight = 20
+
+// Voices tells the speakers heard from each source apart across diarizations, which
+// only label speakers consistently within a single response. Speakers are numbered
+// from 1 per source, in the order they're first heard.
+type Voices struct {
+	// threshold is the least cosine similarity between embeddings of the same
+	// speaker.
+	threshold float32
+	sources   map[string]*sourceVoices
+}
+
+type sourceVoices struct {
+	voices []*voice
+	// byLabel numbers the labels of responses without embeddings. Diarization
+	// labels speakers in the order they're heard, so the first speaker of an
+	// utterance is taken to be the same person every time.
+	byLabel map[string]int
+	next    int
+}
+
+type voice struct {
+	number    int
+	embedding []float32
+	weight    int
+}
+
+func NewVoices(threshold float32) *Voices {
+	return &Voices{
+		threshold: threshold,
+		sources:   map[string]*sourceVoices{},
+	}
+}
+
+// Identify returns the number of the speaker behind each label of response, which
+// diarized audio from source.
+func (v *Voices) Identify(source string, response *router.DiarizationResponse) map[string]int {
+	s, ok := v.sources[source]
+	if !ok {
+		s = &sourceVoices{byLabel: map[string]int{}, next: 1}
+		v.sources[source] = s
+	}
+
+	var labels []string
+	seen := map[string]bool{}
+	for _, segment := range response.Segments {
+		if !seen[segment.Label] {
+			seen[segment.Label] = true
+			labels = append(labels, segment.Label)
+		}
+	}
+
+	// Match each label to the most similar voice, most similar pairs first, so two
+	// labels never end up with the same speaker.
+	type match struct {
+		label      string
+		voice      *voice
+		similarity float32
+	}
+	var matches []match
+	embeddings := map[string][]float32{}
+	for _, label := range labels {
+		e := normalize(response.Embeddings[label])
+		if e == nil {
+			continue
+		}
+		embeddings[label] = e
+		for _, vc := range s.voices {
+			if sim := dot(e, vc.embedding); sim >= v.threshold {
+				matches = append(matches, match{label, vc, sim})
+			}
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].similarity > matches[j].similarity })
+
+	numbers := map[string]int{}
+	taken := map[*voice]bool{}
+	for _, m := range matches {
+		if _, ok := numbers[m.label]; ok || taken[m.voice] {
+			continue
+		}
+		taken[m.voice] = true
+		numbers[m.label] = m.voice.number
+		m.voice.add(embeddings[m.label])
+	}
+
+	for _, label := range labels {
+		if _, ok := numbers[label]; ok {
+			continue
+		}
+		if e, ok := embeddings[label]; ok {
+			vc := &voice{number: s.next, embedding: e, weight: 1}
+			s.next++
+			s.voices = append(s.voices, vc)
+			numbers[label] = vc.number
+			continue
+		}
+		n, ok := s.byLabel[label]
+		if !ok {
+			n = s.next
+			s.next++
+			s.byLabel[label] = n
+		}
+		numbers[label] = n
+	}
+	return numbers
+}
+
+// add averages e into the embedding of v.
+func (v *voice) add(e []float32) {
+	if v.weight < maxWeight {
+		v.weight++
+	}
+	w := 1 / float32(v.weight)
+	for i := range v.embedding {
+		v.embedding[i] += w * (e[i] - v.embedding[i])
+	}
+	v.embedding = normalize(v.embedding)
+}
+
+// normalize returns e scaled to unit length, or nil if it's empty or zero.
+func normalize(e []float32) []float32 {
+	var sum float64
+	for _, x := range e {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return nil
+	}
+	norm := float32(1 / math.Sqrt(sum))
+	out := make([]float32, len(e))
+	for i, x := range e {
+		out[i] = x * norm
+	}
+	return out
+}
+
+func dot(a, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var sum float32
+	for i := range a {
+		sum += a[i] * b[i]
+	}
+	return sum
+}
@@ -0,0 +1,254 @@
+// Package echo recognizes audio played into the session coming back through the
+// microphones of participants, so that the assistant doesn't hear itself as somebody
+// else.
+//
+// Rather than the waveforms, which the room, the microphone and two trips through a
+// lossy codec leave little of, it compares loudness envelopes: speech played into a
+// room comes back louder and quieter in step with the original, a little later.
+package echo
+
+import (
+	"math"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+type Config struct {
+	// History is how long played audio is remembered. Defaults to DefaultHistory.
+	History time.Duration
+	// MaxDelay is how long played audio may take to come back through a
+	// microphone. Defaults to DefaultMaxDelay.
+	MaxDelay time.Duration
+	// Threshold is how closely, from 0 to 1, the envelope of captured audio has to
+	// follow that of played audio to be its echo. Defaults to DefaultThreshold.
+	Threshold float64
+	// Coverage is how much of the sound in captured audio, from 0 to 1, has to
+	// overlap played audio to be its echo. Somebody talking before or after it
+	// doesn't, while quiet stretches, like those around speech, don't count.
+	// Defaults to DefaultCoverage.
+	Coverage float64
+}
+
+const (
+	DefaultHistory   = 30 * time.Second
+	DefaultMaxDelay  = 500 * time.Millisecond
+	DefaultThreshold = 0.7
+	DefaultCoverage  = 0.9
+)
+
+func (c Config) withDefaults() Config {
+	if c.History == 0 {
+		c.History = DefaultHistory
+	}
+	if c.MaxDelay == 0 {
+		c.MaxDelay = DefaultMaxDelay
+	}
+	if c.Threshold == 0 {
+		c.Threshold = DefaultThreshold
+	}
+	if c.Coverage == 0 {
+		c.Coverage = DefaultCoverage
+	}
+	return c
+}
+
+const (
+	// frameMs is the length of each step of an envelope.
+	frameMs = 10
+	// floorDB is the quietest an envelope gets, so silence is just quiet and
+	// doesn't swamp the correlation.
+	floorDB = -60
+	// minFrames is the least overlap worth comparing.
+	minFrames = 20
+	// audibleRange is how far, in dB, a step of an envelope may be below its loudest
+	// to count as sound rather than quiet.
+	audibleRange = 20
+)
+
+// Detector remembers what was played and checks captured audio against it. It isn't
+// safe for concurrent use.
+type Detector struct {
+	config Config
+	played []*played
+}
+
+// played is played audio along with its envelope.
+type played struct {
+	audio *router.PlayedAudio
+	// start is the media time of the first step of the envelope, in frames.
+	start    int64
+	envelope []float64
+}
+
+func NewDetector(config Config) *Detector {
+	return &Detector{config: config.withDefaults()}
+}
+
+// Played remembers audio played into the session.
+func (d *Detector) Played(audio *router.PlayedAudio) {
+	d.played = append(d.played, &played{
+		audio:    audio,
+		start:    int64(audio.StartTimestamp / frameMs),
+		envelope: envelope(audio.PCM, audio.SampleRate),
+	})
+
+	// Forget whatever is too old to come back.
+	horizon := int64(audio.StartTimestamp) - d.config.History.Milliseconds()
+	i := 0
+	for i < len(d.played) && int64(d.played[i].audio.EndTimestamp) < horizon {
+		i++
+	}
+	d.played = d.played[i:]
+}
+
+// Check returns the ID of the played audio that captured audio, sampled at
+// sampleRate, is an echo of, along with how closely it follows it. The ID is empty
+// if it isn't an echo of anything.
+func (d *Detector) Check(audio *router.CapturedAudio, sampleRate int) (string, float64) {
+	if len(d.played) == 0 {
+		return "", 0
+	}
+
+	captured := envelope(audio.PCM, sampleRate)
+	sound, audible := audibleSteps(captured)
+	start := int64(audio.StartTimestamp / frameMs)
+	maxLag := d.config.MaxDelay.Milliseconds() / frameMs
+
+	// Lay what was played around the time of the captured audio out on one
+	// timeline, so echoes spanning several pieces of played audio are compared as a
+	// whole. from is where the timeline starts and owner says which played audio
+	// each step came from.
+	from := start - maxLag
+	timeline := make([]float64, int64(len(captured))+maxLag)
+	owner := make([]*played, len(timeline))
+	for i := range timeline {
+		timeline[i] = floorDB
+	}
+	for _, p := range d.played {
+		for i, v := range p.envelope {
+			t := p.start + int64(i) - from
+			if t < 0 || t >= int64(len(timeline)) {
+				continue
+			}
+			timeline[t] = v
+			owner[t] = p
+		}
+	}
+
+	var best float64
+	var bestLag int64 = -1
+	for lag := int64(0); lag <= maxLag; lag++ {
+		// Captured step i lines up with the played step lag before it.
+		offset := maxLag - lag
+		covered, heard := 0, 0
+		for i := range captured {
+			if owner[offset+int64(i)] != nil {
+				covered++
+				if sound[i] {
+					heard++
+				}
+			}
+		}
+		if covered < minFrames || float64(heard) < d.config.Coverage*float64(audible) {
+			continue
+		}
+
+		if r := correlate(captured, timeline[offset:offset+int64(len(captured))]); r > best {
+			best = r
+			bestLag = lag
+		}
+	}
+
+	if bestLag < 0 || best < d.config.Threshold {
+		return "", best
+	}
+
+	// The echo is of whatever played audio it overlaps the most.
+	offset := maxLag - bestLag
+	overlap := map[*played]int{}
+	var match *played
+	for i := range captured {
+		if p := owner[offset+int64(i)]; p != nil {
+			overlap[p]++
+			if match == nil || overlap[p] > overlap[match] {
+				match = p
+			}
+		}
+	}
+	return match.audio.AudioID, best
+}
+
+// envelope returns the loudness of pcm, in dBFS, every frameMs.
+func envelope(pcm []float32, sampleRate int) []float64 {
+	if sampleRate <= 0 {
+		return nil
+	}
+
+	n := int64(len(pcm)) * 1000 / frameMs / int64(sampleRate)
+	env := make([]float64, n)
+	for i := range env {
+		// Computing the bounds of every frame from scratch keeps sample rates that
+		// aren't a multiple of 100Hz from drifting.
+		lo := int64(i) * int64(sampleRate) * frameMs / 1000
+		hi := int64(i+1) * int64(sampleRate) * frameMs / 1000
+
+		var sum float64
+		for _, s := range pcm[lo:hi] {
+			sum += float64(s) * float64(s)
+		}
+		db := float64(floorDB)
+		if sum > 0 {
+			db = 10 * math.Log10(sum/float64(hi-lo))
+		}
+		if db < floorDB {
+			db = floorDB
+		}
+		env[i] = db
+	}
+	return env
+}
+
+// audibleSteps marks the steps of env within audibleRange of its loudest, and
+// returns how many there are.
+func audibleSteps(env []float64) ([]bool, int) {
+	loudest := float64(floorDB)
+	for _, v := range env {
+		if v > loudest {
+			loudest = v
+		}
+	}
+
+	sound := make([]bool, len(env))
+	n := 0
+	for i, v := range env {
+		if v > floorDB && v >= loudest-audibleRange {
+			sound[i] = true
+			n++
+		}
+	}
+	return sound, n
+}
+
+// correlate returns the Pearson correlation of a and b, which have the same length.
+func correlate(a, b []float64) float64 {
+	n := float64(len(a))
+	var sumA, sumB float64
+	for i := range a {
+		sumA += a[i]
+		sumB += b[i]
+	}
+	meanA, meanB := sumA/n, sumB/n
+
+	var cov, varA, varB float64
+	for i := range a {
+		da, db := a[i]-meanA, b[i]-meanB
+		cov += da * db
+		varA += da * da
+		varB += db * db
+	}
+	if varA == 0 || varB == 0 {
+		return 0
+	}
+	return cov / math.Sqrt(varA*varB)
+}
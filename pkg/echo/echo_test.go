@@ -0,0 +1,131 @@
+package echo_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/ajbouh/bridge/pkg/echo"
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+// syllables returns a speech-like loudness pattern: bursts of 100-300ms separated by
+// gaps of 50-200ms, as on/off per millisecond.
+func syllables(rng *rand.Rand, ms int) []bool {
+	on := make([]bool, ms)
+	for t := 0; t < ms; {
+		n := 100 + rng.Intn(200)
+		for i := t; i < t+n && i < ms; i++ {
+			on[i] = true
+		}
+		t += n + 50 + rng.Intn(150)
+	}
+	return on
+}
+
+// render fills pcm at sampleRate with noise at amplitude where pattern is on,
+// starting delay milliseconds in, over a noise floor.
+func render(rng *rand.Rand, pcm []float32, sampleRate int, pattern []bool, delay int, amplitude, floor float32) {
+	for i := range pcm {
+		ms := i*1000/sampleRate - delay
+		s := floor * (rng.Float32()*2 - 1)
+		if ms >= 0 && ms < len(pattern) && pattern[ms] {
+			s += amplitude * (rng.Float32()*2 - 1)
+		}
+		pcm[i] = s
+	}
+}
+
+func TestDetector(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	// Three seconds of speech played at 24kHz starting 1s into the session
+	speech := syllables(rng, 3000)
+	played := &router.PlayedAudio{
+		AudioID:        "reply/speech",
+		Source:         "assistant/Bridge",
+		PCM:            make([]float32, 3*24000),
+		SampleRate:     24000,
+		StartTimestamp: 1000,
+		EndTimestamp:   4000,
+	}
+	render(rng, played.PCM, 24000, speech, 0, 0.5, 0)
+
+	d := echo.NewDetector(echo.Config{})
+	d.Played(played)
+
+	// Captured audio starts with half a second of pre-roll and runs on a little
+	// after the speech.
+	captured := func(pattern []bool, delay int, amplitude float32) *router.CapturedAudio {
+		audio := &router.CapturedAudio{
+			ID:             "captured",
+			PCM:            make([]float32, 4*16000),
+			StartTimestamp: 500,
+			EndTimestamp:   4500,
+		}
+		render(rng, audio.PCM, 16000, pattern, 500+delay, amplitude, 0.003)
+		return audio
+	}
+
+	testCases := []struct {
+		name  string
+		audio *router.CapturedAudio
+		want  string
+	}{
+		{
+			name:  "echo",
+			audio: captured(speech, 150, 0.05),
+			want:  "reply/speech",
+		},
+		{
+			name:  "loud echo with a long delay",
+			audio: captured(speech, 400, 0.3),
+			want:  "reply/speech",
+		},
+		{
+			name:  "somebody else talking at the same time",
+			audio: captured(syllables(rng, 3000), 150, 0.05),
+		},
+		{
+			name:  "echo delayed beyond the maximum",
+			audio: captured(speech, 900, 0.05),
+		},
+	}
+
+	for _, tc := range testCases {
+		got, correlation := d.Check(tc.audio, 16000)
+		if got != tc.want {
+			t.Errorf("%s: echo of %q with correlation %.2f, want %q", tc.name, got, correlation, tc.want)
+		}
+	}
+
+	// Somebody talking over the speech, into a microphone that also picks it up, is
+	// still somebody talking, be it all along or on past the end of the speech.
+	overlapping := func(ms, delay int, amplitude float32) *router.CapturedAudio {
+		audio := captured(speech, 150, 0.05)
+		if n := (500 + delay + ms) * 16; n > len(audio.PCM) {
+			audio.PCM = append(audio.PCM, make([]float32, n-len(audio.PCM))...)
+			audio.EndTimestamp = audio.StartTimestamp + uint64(n/16)
+		}
+		talking := make([]float32, len(audio.PCM))
+		render(rng, talking, 16000, syllables(rng, ms), 500+delay, amplitude, 0)
+		for i := range audio.PCM {
+			audio.PCM[i] += talking[i]
+		}
+		return audio
+	}
+	for name, audio := range map[string]*router.CapturedAudio{
+		"talking over the speech":     overlapping(3000, 0, 0.3),
+		"talking on after the speech": overlapping(1000, 2800, 0.05),
+	} {
+		if got, correlation := d.Check(audio, 16000); got != "" {
+			t.Errorf("%s: echo of %q with correlation %.2f, want none", name, got, correlation)
+		}
+	}
+
+	// Audio captured long before anything was played is never an echo.
+	early := &router.CapturedAudio{PCM: make([]float32, 16000), StartTimestamp: 0, EndTimestamp: 1000}
+	render(rng, early.PCM, 16000, speech, 0, 0.05, 0.003)
+	if got, _ := d.Check(early, 16000); got != "" {
+		t.Errorf("audio from before anything played is an echo of %q", got)
+	}
+}
@@ -0,0 +1,110 @@
+// Package mediaclock measures media time: milliseconds since the document of a room
+// started. Every timestamp on captured samples, captured audio and transcriptions is
+// in media time, so audio from different speakers lines up, and adding it to the
+// epoch gives the wall clock time it was spoken at.
+package mediaclock
+
+import "time"
+
+// Clock turns wall clock times into media time.
+type Clock struct {
+	epoch time.Time
+}
+
+func New(epoch time.Time) *Clock {
+	return &Clock{epoch: epoch}
+}
+
+// Epoch is the wall clock time media time is measured from.
+func (c *Clock) Epoch() time.Time {
+	return c.epoch
+}
+
+// Now returns the current media time.
+func (c *Clock) Now() uint64 {
+	return c.At(time.Now())
+}
+
+// At returns the media time of t. Times before the epoch are clamped to 0.
+func (c *Clock) At(t time.Time) uint64 {
+	d := t.Sub(c.epoch)
+	if d < 0 {
+		return 0
+	}
+	return uint64(d.Milliseconds())
+}
+
+// Time returns the wall clock time of media time ts.
+func (c *Clock) Time(ts uint64) time.Time {
+	return c.epoch.Add(time.Duration(ts) * time.Millisecond)
+}
+
+// Unwrapper extends the 32 bit timestamps of an RTP stream to 64 bits, so they keep
+// counting up across wraparound. Timestamps are placed relative to the highest one
+// seen so far, which means packets that arrive out of order, even across a wrap,
+// get the timestamp they were sent with.
+type Unwrapper struct {
+	highest int64
+	started bool
+}
+
+func (u *Unwrapper) Unwrap(ts uint32) int64 {
+	if !u.started {
+		u.highest = int64(ts)
+		u.started = true
+		return u.highest
+	}
+
+	// The difference from the highest timestamp, as a signed 32 bit number, is the
+	// shortest way around the wrap.
+	ext := u.highest + int64(int32(ts-uint32(u.highest)))
+	if ext > u.highest {
+		u.highest = ext
+	}
+	return ext
+}
+
+// RTPClock maps the timestamps of one RTP stream to media time. The first packet is
+// taken to have been captured when it arrived; every later packet is placed by how
+// far its RTP timestamp is from the first, so jitter in arrival doesn't move it.
+type RTPClock struct {
+	clock     *Clock
+	clockRate int64
+
+	unwrap Unwrapper
+	// base is the unwrapped timestamp of the first packet and anchor its media
+	// time, in units of the clock rate.
+	base    int64
+	anchor  int64
+	started bool
+}
+
+// RTP returns a clock for a stream whose timestamps count clockRate per second.
+func (c *Clock) RTP(clockRate int) *RTPClock {
+	return &RTPClock{clock: c, clockRate: int64(clockRate)}
+}
+
+// Span returns the media time at which the packet with RTP timestamp ts starts, and
+// the one at which it ends if it holds samples at sampleRate. Both are computed from
+// the position of the packet in the stream rather than added up packet by packet, so
+// rounding never accumulates.
+func (r *RTPClock) Span(ts uint32, samples, sampleRate int) (start, end uint64) {
+	ext := r.unwrap.Unwrap(ts)
+	if !r.started {
+		r.base = ext
+		r.anchor = int64(r.clock.Now()) * r.clockRate / 1000
+		r.started = true
+	}
+
+	pos := r.anchor + ext - r.base
+	length := int64(samples) * r.clockRate / int64(sampleRate)
+	return r.millis(pos), r.millis(pos + length)
+}
+
+func (r *RTPClock) millis(pos int64) uint64 {
+	if pos < 0 {
+		// Reordered packets from before the first one
+		return 0
+	}
+	return uint64(pos * 1000 / r.clockRate)
+}
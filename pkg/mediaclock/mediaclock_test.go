@@ -0,0 +1,73 @@
+package mediaclock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/mediaclock"
+)
+
+func TestUnwrap(t *testing.T) {
+	testCases := []struct {
+		name string
+		in   []uint32
+		want []int64
+	}{
+		{
+			name: "in order",
+			in:   []uint32{100, 1060, 2020},
+			want: []int64{100, 1060, 2020},
+		},
+		{
+			name: "wraparound",
+			in:   []uint32{0xffffff00, 0xfffffff0, 0x10, 0x100},
+			want: []int64{0xffffff00, 0xfffffff0, 0x100000010, 0x100000100},
+		},
+		{
+			name: "out of order",
+			in:   []uint32{1000, 3000, 2000, 4000},
+			want: []int64{1000, 3000, 2000, 4000},
+		},
+		{
+			name: "out of order across the wrap",
+			in:   []uint32{0xfffffc00, 0x200, 0xfffffe00, 0x400},
+			want: []int64{0xfffffc00, 0x100000200, 0xfffffe00, 0x100000400},
+		},
+	}
+
+	for _, tc := range testCases {
+		var u mediaclock.Unwrapper
+		for i, ts := range tc.in {
+			if got := u.Unwrap(ts); got != tc.want[i] {
+				t.Errorf("%s: Unwrap(%#x) = %#x, want %#x", tc.name, ts, got, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestRTPClock(t *testing.T) {
+	// The stream joins 2s into the session, with timestamps about to wrap.
+	clock := mediaclock.New(time.Now().Add(-2 * time.Second))
+	rtp := clock.RTP(48000)
+
+	var first uint32 = 0xffffffff - 48000 // 1s before the wrap
+	start, end := rtp.Span(first, 960, 16000)
+	if start < 2000 || start > 2100 {
+		t.Fatalf("first packet starts at %dms, want about 2000ms", start)
+	}
+	if end-start != 60 {
+		t.Errorf("60ms of audio spans %dms", end-start)
+	}
+
+	// A packet 1.5s later, past the wrap, arriving whenever it likes.
+	later, _ := rtp.Span(first+72000, 960, 16000)
+	if later-start != 1500 {
+		t.Errorf("packet 1.5s later is %dms later", later-start)
+	}
+
+	// A late packet from between them
+	between, _ := rtp.Span(first+48000, 960, 16000)
+	if between-start != 1000 {
+		t.Errorf("packet 1s later is %dms later", between-start)
+	}
+}
@@ -0,0 +1,65 @@
+package rooms
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type roomInfo struct {
+	Name   string `json:"name"`
+	Pinned bool   `json:"pinned"`
+}
+
+// ServeHTTP serves the admin API:
+//
+//	GET    /rooms        lists open rooms
+//	PUT    /rooms/{name} opens and pins a room
+//	DELETE /rooms/{name} closes a room
+func (m *Manager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(req.URL.Path, "/rooms"), "/")
+
+	switch {
+	case name == "" && req.Method == http.MethodGet:
+		m.mu.Lock()
+		rooms := []roomInfo{}
+		for _, rm := range m.rooms {
+			rooms = append(rooms, roomInfo{Name: rm.Name, Pinned: rm.pinned})
+		}
+		m.mu.Unlock()
+
+		writeJSON(w, http.StatusOK, rooms)
+	case name != "" && req.Method == http.MethodPut:
+		rm, err := m.Open(name, true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, roomInfo{Name: rm.Name, Pinned: true})
+	case name != "" && req.Method == http.MethodDelete:
+		if _, ok := m.get(name); !ok {
+			http.NotFound(w, req)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), 10*time.Second)
+		defer cancel()
+		if err := m.Close(ctx, name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		Logger.Error(err, "error writing response")
+	}
+}
@@ -0,0 +1,221 @@
+// Package rooms runs an isolated router, with its own middleware stack, for each
+// room a single process serves.
+package rooms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	logr "github.com/ajbouh/bridge/pkg/log"
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+var Logger = logr.New()
+
+// Stack installs the middlewares for room into r. Middlewares that talk to shared
+// services should be created once, outside of Stack, so every room reuses the same
+// clients.
+type Stack func(room string, r *router.Router) error
+
+// rollbackTimeout bounds how long shutting down a room that couldn't be set up may
+// take.
+const rollbackTimeout = 10 * time.Second
+
+// Room is a router serving a single room.
+type Room struct {
+	Name   string
+	Router *router.Router
+
+	// pinned rooms were opened explicitly and are only closed explicitly.
+	pinned bool
+
+	// ready is closed once the room is set up, or failed to be, in which case err
+	// says why. Until then Router is nil.
+	ready chan struct{}
+	err   error
+}
+
+type Manager struct {
+	ctx   context.Context
+	stack Stack
+
+	mu     sync.Mutex
+	rooms  map[string]*Room
+	closed bool
+}
+
+func NewManager(ctx context.Context, stack Stack) *Manager {
+	return &Manager{
+		ctx:   ctx,
+		stack: stack,
+		rooms: map[string]*Room{},
+	}
+}
+
+// Open starts a router for room unless one is already running. Pinned rooms stay
+// open until Close is called for them, even if the SFU reports them empty.
+//
+// The room is set up without holding up other rooms. Opening a room that's still
+// being set up waits for it.
+func (m *Manager) Open(room string, pinned bool) (*Room, error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, errors.New("room manager is shut down")
+	}
+
+	if existing, ok := m.rooms[room]; ok {
+		existing.pinned = existing.pinned || pinned
+		m.mu.Unlock()
+		<-existing.ready
+		if existing.err != nil {
+			return nil, existing.err
+		}
+		return existing, nil
+	}
+
+	rm := &Room{Name: room, pinned: pinned, ready: make(chan struct{})}
+	m.rooms[room] = rm
+	m.mu.Unlock()
+
+	Logger.Infof("opening room %s", room)
+
+	r := router.New(m.ctx)
+	r.Start()
+	err := m.stack(room, r)
+	if err != nil {
+		err = fmt.Errorf("setting up room %s: %w", room, err)
+	}
+
+	// Close takes the room off the list under the lock too, so either it finds the
+	// room ready and shuts it down, or we find it gone and do.
+	m.mu.Lock()
+	if err == nil && m.rooms[room] != rm {
+		err = fmt.Errorf("room %s was closed while it was being set up", room)
+	}
+	if err != nil {
+		if m.rooms[room] == rm {
+			delete(m.rooms, room)
+		}
+		rm.err = err
+		close(rm.ready)
+		m.mu.Unlock()
+
+		// Stack may have installed some middlewares, or all of them, before we gave
+		// up on the room.
+		ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+		defer cancel()
+		if err := r.Shutdown(ctx); err != nil {
+			Logger.Error(err, "error shutting down room", "room", room)
+		}
+		return nil, rm.err
+	}
+	rm.Router = r
+	close(rm.ready)
+	m.mu.Unlock()
+
+	return rm, nil
+}
+
+// Close shuts down the router for room. A room that's still being set up is shut
+// down as soon as it is.
+func (m *Manager) Close(ctx context.Context, room string) error {
+	m.mu.Lock()
+	rm, ok := m.rooms[room]
+	delete(m.rooms, room)
+	m.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("no such room %s", room)
+	}
+
+	Logger.Infof("closing room %s", room)
+	return rm.shutdown(ctx)
+}
+
+// shutdown shuts down the router of rm, if it has one by now. Once rm is no longer
+// listed, Open shuts down the router of a room still being set up itself.
+func (rm *Room) shutdown(ctx context.Context) error {
+	select {
+	case <-rm.ready:
+	default:
+		return nil
+	}
+	if rm.err != nil {
+		return nil
+	}
+	return rm.Router.Shutdown(ctx)
+}
+
+// closeUnpinned is like Close for rooms that weren't opened explicitly, and leaves
+// alone any room that is pinned by the time it's looked up. A room that's gone is
+// not an error.
+func (m *Manager) closeUnpinned(ctx context.Context, room string) error {
+	m.mu.Lock()
+	rm, ok := m.rooms[room]
+	if !ok || rm.pinned {
+		m.mu.Unlock()
+		return nil
+	}
+	delete(m.rooms, room)
+	m.mu.Unlock()
+
+	Logger.Infof("closing room %s", room)
+	return rm.shutdown(ctx)
+}
+
+func (m *Manager) get(room string) (*Room, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rm, ok := m.rooms[room]
+	return rm, ok
+}
+
+// Rooms returns the open rooms, sorted by name.
+func (m *Manager) Rooms() []*Room {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rooms := make([]*Room, 0, len(m.rooms))
+	for _, rm := range m.rooms {
+		if rm.Router != nil {
+			rooms = append(rooms, rm)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms
+}
+
+// Shutdown closes every room and refuses to open new ones.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.closed = true
+	rooms := m.rooms
+	m.rooms = map[string]*Room{}
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(rooms))
+	for _, rm := range rooms {
+		wg.Add(1)
+		go func(rm *Room) {
+			defer wg.Done()
+			if err := rm.shutdown(ctx); err != nil {
+				errs <- fmt.Errorf("shutting down room %s: %w", rm.Name, err)
+			}
+		}(rm)
+	}
+	wg.Wait()
+	close(errs)
+
+	var err error
+	for e := range errs {
+		err = errors.Join(err, e)
+	}
+	return err
+}
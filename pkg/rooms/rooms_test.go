@@ -0,0 +1,228 @@
+package rooms
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+func newTestManager(t *testing.T) (*Manager, func() []string) {
+	var mu sync.Mutex
+	var stacked []string
+	m := NewManager(context.Background(), func(room string, r *router.Router) error {
+		mu.Lock()
+		defer mu.Unlock()
+		stacked = append(stacked, room)
+		return nil
+	})
+	t.Cleanup(func() { m.Shutdown(context.Background()) })
+
+	return m, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), stacked...)
+	}
+}
+
+func names(m *Manager) []string {
+	var names []string
+	for _, rm := range m.Rooms() {
+		names = append(names, rm.Name)
+	}
+	return names
+}
+
+func TestOpenIsIdempotent(t *testing.T) {
+	m, stacked := newTestManager(t)
+
+	a, err := m.Open("a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := m.Open("a", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != again || len(stacked()) != 1 {
+		t.Errorf("opening a room twice built %d stacks", len(stacked()))
+	}
+
+	if _, err := m.Open("b", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(m); len(got) != 1 || got[0] != "b" {
+		t.Errorf("rooms after closing a = %v, want [b]", got)
+	}
+
+	if err := m.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Open("c", false); err == nil {
+		t.Error("opened a room after shutdown")
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	m, _ := newTestManager(t)
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+
+	do := func(method, path string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	if resp := do(http.MethodPut, "/rooms/lobby"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT status %d", resp.StatusCode)
+	}
+
+	resp := do(http.MethodGet, "/rooms")
+	var rooms []roomInfo
+	json.NewDecoder(resp.Body).Decode(&rooms)
+	resp.Body.Close()
+	if len(rooms) != 1 || rooms[0].Name != "lobby" || !rooms[0].Pinned {
+		t.Errorf("GET /rooms = %+v", rooms)
+	}
+
+	if resp := do(http.MethodDelete, "/rooms/lobby"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE status %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodDelete, "/rooms/lobby"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second DELETE status %d", resp.StatusCode)
+	}
+}
+
+func TestWatcherFollowsSFU(t *testing.T) {
+	m, _ := newTestManager(t)
+
+	var mu sync.Mutex
+	sfu := []sfuRoom{
+		{ID: "busy", Peers: []string{"alice", "us"}},
+		{ID: "lonely", Peers: []string{"us"}},
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		json.NewEncoder(w).Encode(sfu)
+	}))
+	defer srv.Close()
+
+	w := &Watcher{URL: srv.URL, Ignore: "us", EmptyTimeout: time.Hour}
+	lastSeen := map[string]time.Time{}
+	if err := w.poll(context.Background(), m, lastSeen); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(m); len(got) != 1 || got[0] != "busy" {
+		t.Fatalf("rooms = %v, want [busy]", got)
+	}
+
+	if _, err := m.Open("pinned", true); err != nil {
+		t.Fatal(err)
+	}
+	lastSeen["pinned"] = time.Time{}
+
+	mu.Lock()
+	sfu = []sfuRoom{{ID: "busy", Peers: []string{"us"}}}
+	mu.Unlock()
+
+	w.EmptyTimeout = 0
+	if err := w.poll(context.Background(), m, lastSeen); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(m); len(got) != 1 || got[0] != "pinned" {
+		t.Errorf("rooms after busy emptied = %v, want [pinned]", got)
+	}
+}
+
+func TestWatcherLeavesRoomsPinnedWhilePolling(t *testing.T) {
+	m, _ := newTestManager(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode([]sfuRoom{})
+	}))
+	defer srv.Close()
+
+	// The watcher keeps finding the room empty while it's opened, pinned and closed
+	// over and over. It may close the room before it's pinned, but never after.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	polled := make(chan struct{})
+	go func() {
+		defer close(polled)
+		w := &Watcher{URL: srv.URL, Ignore: "us"}
+		for ctx.Err() == nil {
+			w.poll(ctx, m, map[string]time.Time{"room": {}})
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		if _, err := m.Open("room", false); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.Open("room", true); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Close(context.Background(), "room"); err != nil {
+			t.Fatalf("closing pinned room: %v", err)
+		}
+	}
+	cancel()
+	<-polled
+}
+
+func TestSlowSetupDoesNotBlockOtherRooms(t *testing.T) {
+	release := make(chan struct{})
+	m := NewManager(context.Background(), func(room string, r *router.Router) error {
+		if room == "slow" {
+			<-release
+		}
+		return nil
+	})
+	t.Cleanup(func() { m.Shutdown(context.Background()) })
+
+	opened := make(chan error)
+	go func() {
+		_, err := m.Open("slow", false)
+		opened <- err
+	}()
+
+	// Wait for the slow room to be reserved.
+	for {
+		if _, ok := m.get("slow"); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := m.Open("fast", false); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(m); len(got) != 1 || got[0] != "fast" {
+		t.Errorf("rooms while slow is being set up = %v, want [fast]", got)
+	}
+
+	// Closing a room that's being set up has it shut down once it's done.
+	if err := m.Close(context.Background(), "slow"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-opened; err == nil {
+		t.Error("opened a room that was closed while it was being set up")
+	}
+	if got := names(m); len(got) != 1 || got[0] != "fast" {
+		t.Errorf("rooms after closing slow = %v, want [fast]", got)
+	}
+}
@@ -0,0 +1,116 @@
+package rooms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Watcher opens a room whenever the SFU reports it has participants, and closes it
+// once it has been empty for EmptyTimeout.
+type Watcher struct {
+	// URL of the SFU's /rooms endpoint.
+	URL string
+	// Ignore is the peer ID our own peers join rooms as, so they don't keep a room
+	// open by themselves.
+	Ignore string
+
+	Interval     time.Duration
+	EmptyTimeout time.Duration
+
+	Client *http.Client
+}
+
+type sfuRoom struct {
+	ID    string   `json:"id"`
+	Peers []string `json:"peers"`
+}
+
+// Run polls the SFU until ctx is done.
+func (w *Watcher) Run(ctx context.Context, m *Manager) {
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	// When each room we opened was last seen with participants.
+	lastSeen := map[string]time.Time{}
+	for {
+		if err := w.poll(ctx, m, lastSeen); err != nil {
+			Logger.Error(err, "error polling sfu rooms", "url", w.URL)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *Watcher) poll(ctx context.Context, m *Manager, lastSeen map[string]time.Time) error {
+	rooms, err := w.fetch(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, rm := range rooms {
+		if !w.occupied(rm) {
+			continue
+		}
+		lastSeen[rm.ID] = now
+		if _, err := m.Open(rm.ID, false); err != nil {
+			Logger.Error(err, "error opening room", "room", rm.ID)
+		}
+	}
+
+	for id, seen := range lastSeen {
+		if now.Sub(seen) < w.EmptyTimeout {
+			continue
+		}
+		delete(lastSeen, id)
+
+		if err := m.closeUnpinned(ctx, id); err != nil {
+			Logger.Error(err, "error closing empty room", "room", id)
+		}
+	}
+
+	return nil
+}
+
+func (w *Watcher) occupied(rm sfuRoom) bool {
+	for _, p := range rm.Peers {
+		if p != w.Ignore {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Watcher) fetch(ctx context.Context) ([]sfuRoom, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var rooms []sfuRoom
+	if err := json.NewDecoder(resp.Body).Decode(&rooms); err != nil {
+		return nil, err
+	}
+	return rooms, nil
+}
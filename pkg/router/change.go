@@ -0,0 +1,38 @@
+package router
+
+// ChangeKind says what happened to a transcription in a Document.
+type ChangeKind string
+
+const (
+	// TranscriptionAdded is a transcription with an ID the document hadn't seen.
+	TranscriptionAdded ChangeKind = "added"
+	// TranscriptionReplaced is a new version of a transcription already in the document.
+	TranscriptionReplaced ChangeKind = "replaced"
+	// TranscriptionFinalized is a final version of a transcription that was a draft.
+	TranscriptionFinalized ChangeKind = "finalized"
+	// TranscriptionRemoved is a transcription dropped from the document.
+	TranscriptionRemoved ChangeKind = "removed"
+)
+
+// DocumentChange describes a single update to the router's Document.
+type DocumentChange struct {
+	Kind ChangeKind `json:"kind"`
+
+	// Transcription is the version now in the document. It is nil when Kind is
+	// TranscriptionRemoved.
+	Transcription *Transcription `json:"transcription,omitempty"`
+	// Previous is the version the change replaced or removed. It is nil when Kind is
+	// TranscriptionAdded.
+	Previous *Transcription `json:"previous,omitempty"`
+
+	// Document is a snapshot of the document with the change applied.
+	Document Document `json:"-"`
+}
+
+// ID returns the ID of the transcription that changed.
+func (c *DocumentChange) ID() string {
+	if c.Transcription != nil {
+		return c.Transcription.ID
+	}
+	return c.Previous.ID
+}
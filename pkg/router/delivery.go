@@ -0,0 +1,287 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Policy decides what the router does when a listener isn't keeping up.
+type Policy int
+
+const (
+	// PolicyBlock waits until the listener accepts each value. A slow listener stalls
+	// every other listener of the same stream.
+	PolicyBlock Policy = iota
+	// PolicyDropNewest discards the incoming value if the listener's channel is full.
+	PolicyDropNewest
+	// PolicyDropOldest queues values for the listener and discards the oldest queued
+	// value once the queue is full.
+	PolicyDropOldest
+	// PolicyCoalesceLatest keeps at most one pending value for the listener, replacing
+	// it with each newer value. Good for streams where only the latest value matters,
+	// like DraftDocument.
+	PolicyCoalesceLatest
+)
+
+// queueSize bounds the number of values PolicyDropOldest holds for a listener on top
+// of whatever the listener's own channel buffers.
+const queueSize = 100
+
+func (p Policy) String() string {
+	switch p {
+	case PolicyBlock:
+		return "block"
+	case PolicyDropNewest:
+		return "drop-newest"
+	case PolicyDropOldest:
+		return "drop-oldest"
+	case PolicyCoalesceLatest:
+		return "coalesce-latest"
+	}
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// Policies selects a delivery Policy for each of a middleware's listeners. The zero
+// value blocks on every stream.
+type Policies struct {
+	DraftDocument  Policy
+	FinalDocument  Policy
+	DocumentChange Policy
+	CapturedAudio  Policy
+	CapturedSample Policy
+	Status         Policy
+
+	SynthesizedAudio Policy
+	PlayedAudio      Policy
+	Interruption     Policy
+}
+
+// DeliveryStats counts what the router did with the values meant for one listener.
+type DeliveryStats struct {
+	Middleware string
+	Stream     string
+	Policy     Policy
+	Delivered  uint64
+	Dropped    uint64
+}
+
+// outlet delivers values to a single listener channel according to its policy.
+type outlet[T any] struct {
+	ch     chan<- T
+	policy Policy
+
+	mu      sync.Mutex
+	pending []T
+	wake    chan struct{}
+	closed  bool
+	// queued counts values the outlet has accepted but not yet delivered or dropped,
+	// and idle is closed whenever it's zero.
+	queued int
+	idle   chan struct{}
+
+	// done is closed to abandon any send that is still waiting on the listener.
+	done      chan struct{}
+	pumping   sync.WaitGroup
+	closeOnce sync.Once
+
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+}
+
+func newOutlet[T any](ch chan<- T, policy Policy) *outlet[T] {
+	if ch == nil {
+		return nil
+	}
+
+	o := &outlet[T]{
+		ch:     ch,
+		policy: policy,
+		wake:   make(chan struct{}, 1),
+		idle:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	close(o.idle)
+
+	switch policy {
+	case PolicyDropOldest, PolicyCoalesceLatest:
+		o.pumping.Add(1)
+		go o.pump()
+	}
+
+	return o
+}
+
+// offer hands v to the listener. It only blocks for PolicyBlock, and never once the
+// outlet is closed.
+func (o *outlet[T]) offer(v T) {
+	if o == nil {
+		return
+	}
+
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return
+	}
+
+	switch o.policy {
+	case PolicyDropNewest:
+		defer o.mu.Unlock()
+		select {
+		case o.ch <- v:
+			o.delivered.Add(1)
+		default:
+			o.dropped.Add(1)
+		}
+	case PolicyDropOldest, PolicyCoalesceLatest:
+		limit := queueSize
+		if o.policy == PolicyCoalesceLatest {
+			limit = 1
+		}
+
+		if len(o.pending) >= limit {
+			// v takes the place of the value it evicts, so as many are queued as before.
+			var zero T
+			o.pending[0] = zero
+			o.pending = o.pending[1:]
+			o.dropped.Add(1)
+		} else {
+			if o.queued == 0 {
+				o.idle = make(chan struct{})
+			}
+			o.queued++
+		}
+		o.pending = append(o.pending, v)
+		o.mu.Unlock()
+
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+	default:
+		// Holding mu while we wait lets close know when no send is in flight.
+		defer o.mu.Unlock()
+		select {
+		case o.ch <- v:
+			o.delivered.Add(1)
+		case <-o.done:
+		}
+	}
+}
+
+// pump forwards queued values to the listener, blocking on the listener instead of
+// on the router.
+func (o *outlet[T]) pump() {
+	defer o.pumping.Done()
+
+	for {
+		select {
+		case <-o.wake:
+		case <-o.done:
+			return
+		}
+
+		for {
+			o.mu.Lock()
+			if len(o.pending) == 0 {
+				o.mu.Unlock()
+				break
+			}
+			v := o.pending[0]
+			var zero T
+			o.pending[0] = zero
+			o.pending = o.pending[1:]
+			o.mu.Unlock()
+
+			select {
+			case o.ch <- v:
+				o.delivered.Add(1)
+			case <-o.done:
+				return
+			}
+
+			o.mu.Lock()
+			o.queued--
+			if o.queued == 0 {
+				close(o.idle)
+			}
+			o.mu.Unlock()
+		}
+	}
+}
+
+// flush waits until everything the outlet has queued reached the listener, or the
+// outlet is closed.
+func (o *outlet[T]) flush(ctx context.Context) error {
+	if o == nil {
+		return nil
+	}
+
+	switch o.policy {
+	case PolicyDropOldest, PolicyCoalesceLatest:
+	default:
+		// Nothing is queued: values are handed to the listener as they're offered.
+		return nil
+	}
+
+	o.mu.Lock()
+	idle := o.idle
+	o.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-o.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops delivery and closes the listener's channel. Anything still queued is
+// discarded.
+func (o *outlet[T]) close() {
+	if o == nil {
+		return
+	}
+
+	o.closeOnce.Do(func() {
+		close(o.done)
+
+		o.mu.Lock()
+		o.closed = true
+		o.mu.Unlock()
+
+		o.pumping.Wait()
+		close(o.ch)
+	})
+}
+
+func (o *outlet[T]) isClosed() bool {
+	if o == nil {
+		return true
+	}
+
+	select {
+	case <-o.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (o *outlet[T]) stats(middleware, stream string) (DeliveryStats, bool) {
+	if o == nil {
+		return DeliveryStats{}, false
+	}
+
+	return DeliveryStats{
+		Middleware: middleware,
+		Stream:     stream,
+		Policy:     o.policy,
+		Delivered:  o.delivered.Load(),
+		Dropped:    o.dropped.Load(),
+	}, true
+}
@@ -0,0 +1,159 @@
+package router
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestOutletDropNewest(t *testing.T) {
+	ch := make(chan int, 2)
+	o := newOutlet[int](ch, PolicyDropNewest)
+
+	for i := 0; i < 5; i++ {
+		o.offer(i)
+	}
+
+	if got := <-ch; got != 0 {
+		t.Errorf("first value = %d, want 0", got)
+	}
+	if got := <-ch; got != 1 {
+		t.Errorf("second value = %d, want 1", got)
+	}
+
+	s, _ := o.stats("m", "s")
+	if s.Delivered != 2 || s.Dropped != 3 {
+		t.Errorf("stats = %+v, want 2 delivered and 3 dropped", s)
+	}
+}
+
+func TestOutletCoalesceLatest(t *testing.T) {
+	ch := make(chan int)
+	o := newOutlet[int](ch, PolicyCoalesceLatest)
+
+	// The pump takes the first value and blocks on the unbuffered channel, so later
+	// values replace each other while they wait.
+	o.offer(0)
+	time.Sleep(10 * time.Millisecond)
+	for i := 1; i < 5; i++ {
+		o.offer(i)
+	}
+
+	if got := receive(t, ch); got != 0 {
+		t.Errorf("first value = %d, want 0", got)
+	}
+	if got := receive(t, ch); got != 4 {
+		t.Errorf("second value = %d, want 4", got)
+	}
+
+	s, _ := o.stats("m", "s")
+	if s.Dropped != 3 {
+		t.Errorf("dropped = %d, want 3", s.Dropped)
+	}
+}
+
+func TestOutletDropOldest(t *testing.T) {
+	ch := make(chan int)
+	o := newOutlet[int](ch, PolicyDropOldest)
+
+	o.offer(-1)
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < queueSize+10; i++ {
+		o.offer(i)
+	}
+
+	if got := receive(t, ch); got != -1 {
+		t.Errorf("first value = %d, want -1", got)
+	}
+	if got := receive(t, ch); got != 10 {
+		t.Errorf("oldest kept value = %d, want 10", got)
+	}
+
+	s, _ := o.stats("m", "s")
+	if s.Dropped != 10 {
+		t.Errorf("dropped = %d, want 10", s.Dropped)
+	}
+}
+
+func TestOutletFlushWaitsForListener(t *testing.T) {
+	ch := make(chan int)
+	o := newOutlet[int](ch, PolicyDropOldest)
+	for i := 0; i < 3; i++ {
+		o.offer(i)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	flushed := make(chan error, 1)
+	go func() { flushed <- o.flush(ctx) }()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-flushed:
+			t.Fatalf("flush returned %v with %d values still queued", err, 3-i)
+		default:
+		}
+		if got := receive(t, ch); got != i {
+			t.Errorf("value = %d, want %d", got, i)
+		}
+	}
+
+	if err := <-flushed; err != nil {
+		t.Errorf("flush = %v, want nil", err)
+	}
+}
+
+func TestOutletFlushRacingOffers(t *testing.T) {
+	for _, policy := range []Policy{PolicyDropOldest, PolicyCoalesceLatest} {
+		t.Run(policy.String(), func(t *testing.T) {
+			ch := make(chan int, queueSize+1)
+			// The pump is held back until the flush is waiting and an offer has evicted
+			// a value it was waiting for.
+			o := &outlet[int]{
+				ch:     ch,
+				policy: policy,
+				wake:   make(chan struct{}, 1),
+				idle:   make(chan struct{}),
+				done:   make(chan struct{}),
+			}
+			close(o.idle)
+
+			limit := queueSize
+			if policy == PolicyCoalesceLatest {
+				limit = 1
+			}
+			for i := 0; i < limit; i++ {
+				o.offer(i)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			flushed := make(chan error, 1)
+			go func() { flushed <- o.flush(ctx) }()
+			time.Sleep(10 * time.Millisecond)
+
+			o.offer(limit)
+			o.pumping.Add(1)
+			go o.pump()
+
+			if err := <-flushed; err != nil {
+				t.Fatalf("flush: %v", err)
+			}
+			if got := len(ch); got != limit {
+				t.Errorf("delivered %d values, want %d", got, limit)
+			}
+			o.close()
+		})
+	}
+}
+
+func receive(t *testing.T, ch <-chan int) int {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for value")
+		return 0
+	}
+}
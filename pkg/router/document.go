@@ -1,52 +1,192 @@
 package router
 
+import "encoding/json"
+
+// Document is the transcript of a session: every Transcription, ordered by
+// StartTimestamp and indexed by ID. Documents are immutable snapshots; Update
+// replaces the receiver's contents without disturbing copies taken earlier, and
+// copies share storage, so handing a Document to every listener is cheap.
 type Document struct {
-	Transcriptions []*Transcription `json:"transcriptions"`
-	StartedAt      int64            `json:"startedAt"`
+	// StartedAt is when the session started, in unix milliseconds. Transcription
+	// timestamps are measured from it.
+	StartedAt int64
+
+	byStart ptree[position, *Transcription]
+	byID    ptree[transcriptionID, position]
+	nextSeq uint64
 }
 
-type Participant struct {
-	Label       string `json:"label"`
-	IsAssistant bool   `json:"isAssistent"`
+// position orders transcriptions by start time. Transcriptions starting at the same
+// time keep the order they were first added in.
+type position struct {
+	start uint64
+	seq   uint64
 }
 
-type Status struct {
-	Participants *[]Participant
+func (p position) less(o position) bool {
+	if p.start != o.start {
+		return p.start < o.start
+	}
+	return p.seq < o.seq
 }
 
-func (d *Document) Clone() *Document {
-	return &Document{
-		StartedAt:      d.StartedAt,
-		Transcriptions: append([]*Transcription{}, d.Transcriptions...),
+type transcriptionID string
+
+func (a transcriptionID) less(b transcriptionID) bool {
+	return a < b
+}
+
+// Len returns the number of transcriptions.
+func (d Document) Len() int {
+	return d.byStart.len()
+}
+
+// At returns the i'th transcription in start order.
+func (d Document) At(i int) *Transcription {
+	return d.byStart.at(i)
+}
+
+// Last returns the transcription that started last, or nil if there are none.
+func (d Document) Last() *Transcription {
+	if d.Len() == 0 {
+		return nil
 	}
+	return d.At(d.Len() - 1)
+}
+
+// Get returns the transcription with the given ID.
+func (d Document) Get(id string) (*Transcription, bool) {
+	pos, ok := d.byID.get(transcriptionID(id))
+	if !ok {
+		return nil, false
+	}
+	return d.byStart.get(pos)
+}
+
+// Each calls fn with every transcription in start order until fn returns false.
+func (d Document) Each(fn func(*Transcription) bool) {
+	d.byStart.each(fn)
+}
+
+// Transcriptions returns all transcriptions in start order.
+func (d Document) Transcriptions() []*Transcription {
+	transcriptions := make([]*Transcription, 0, d.Len())
+	d.Each(func(t *Transcription) bool {
+		transcriptions = append(transcriptions, t)
+		return true
+	})
+	return transcriptions
+}
+
+func (d *Document) Clone() *Document {
+	c := *d
+	return &c
 }
 
 func (d *Document) CloneFinal() *Document {
-	transcriptions := make([]*Transcription, 0, len(d.Transcriptions))
-	for _, t := range d.Transcriptions {
+	final := &Document{
+		StartedAt: d.StartedAt,
+	}
+	d.Each(func(t *Transcription) bool {
 		if t.Final {
-			transcriptions = append(transcriptions, t)
+			final.Update(t)
 		}
+		return true
+	})
+	return final
+}
+
+// Update adds transcription, or replaces the transcription with the same ID, and
+// describes what changed.
+func (d *Document) Update(transcription *Transcription) *DocumentChange {
+	id := transcriptionID(transcription.ID)
+
+	pos, ok := d.byID.get(id)
+	var previous *Transcription
+	if ok {
+		previous, _ = d.byStart.get(pos)
 	}
 
-	return &Document{
-		StartedAt:      d.StartedAt,
-		Transcriptions: transcriptions,
+	change := &DocumentChange{
+		Kind:          TranscriptionAdded,
+		Transcription: transcription,
+		Previous:      previous,
+	}
+	switch {
+	case previous == nil:
+	case transcription.Final && !previous.Final:
+		change.Kind = TranscriptionFinalized
+	default:
+		change.Kind = TranscriptionReplaced
+	}
+
+	if ok && pos.start == transcription.StartTimestamp {
+		d.byStart = d.byStart.set(pos, transcription)
+		return change
+	}
+
+	if ok {
+		d.byStart = d.byStart.delete(pos)
+		pos.start = transcription.StartTimestamp
+	} else {
+		pos = position{start: transcription.StartTimestamp, seq: d.nextSeq}
+		d.nextSeq++
 	}
+
+	d.byStart = d.byStart.set(pos, transcription)
+	d.byID = d.byID.set(id, pos)
+	return change
 }
 
-func (d *Document) Update(transcription *Transcription) {
-	// TODO should insert in sorted order...
-	used := false
-	for i, ex := range d.Transcriptions {
-		if ex.ID == transcription.ID {
-			d.Transcriptions[i] = transcription
-			used = true
-			break
-		}
+// Remove drops the transcription with the given ID. It returns nil if there was no
+// such transcription.
+func (d *Document) Remove(id string) *DocumentChange {
+	pos, ok := d.byID.get(transcriptionID(id))
+	if !ok {
+		return nil
+	}
+
+	previous, _ := d.byStart.get(pos)
+	d.byStart = d.byStart.delete(pos)
+	d.byID = d.byID.delete(transcriptionID(id))
+
+	return &DocumentChange{
+		Kind:     TranscriptionRemoved,
+		Previous: previous,
+	}
+}
+
+// Apply replays a change made to another document, so a listener can keep its own
+// copy up to date from DocumentChanges alone.
+func (d *Document) Apply(change *DocumentChange) {
+	if change.Kind == TranscriptionRemoved {
+		d.Remove(change.Previous.ID)
+		return
 	}
-	if !used {
-		d.Transcriptions = append(d.Transcriptions, transcription)
-		used = true
+	d.Update(change.Transcription)
+}
+
+type documentJSON struct {
+	Transcriptions []*Transcription `json:"transcriptions"`
+	StartedAt      int64            `json:"startedAt"`
+}
+
+func (d Document) MarshalJSON() ([]byte, error) {
+	return json.Marshal(documentJSON{
+		Transcriptions: d.Transcriptions(),
+		StartedAt:      d.StartedAt,
+	})
+}
+
+func (d *Document) UnmarshalJSON(data []byte) error {
+	var v documentJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*d = Document{StartedAt: v.StartedAt}
+	for _, t := range v.Transcriptions {
+		d.Update(t)
 	}
+	return nil
 }
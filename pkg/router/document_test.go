@@ -0,0 +1,158 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func ids(d Document) []string {
+	var ids []string
+	d.Each(func(t *Transcription) bool {
+		ids = append(ids, t.ID)
+		return true
+	})
+	return ids
+}
+
+func TestDocumentKeepsStartOrder(t *testing.T) {
+	var d Document
+	d.Update(&Transcription{ID: "b", StartTimestamp: 200})
+	d.Update(&Transcription{ID: "a", StartTimestamp: 100})
+	d.Update(&Transcription{ID: "c", StartTimestamp: 300})
+	d.Update(&Transcription{ID: "a2", StartTimestamp: 100})
+
+	if got, want := fmt.Sprint(ids(d)), "[a a2 b c]"; got != want {
+		t.Errorf("order = %s, want %s", got, want)
+	}
+
+	// Replacing keeps the position, moving the start time moves it.
+	d.Update(&Transcription{ID: "a", StartTimestamp: 100, Final: true})
+	d.Update(&Transcription{ID: "b", StartTimestamp: 400})
+
+	if got, want := fmt.Sprint(ids(d)), "[a a2 c b]"; got != want {
+		t.Errorf("order = %s, want %s", got, want)
+	}
+	if a, _ := d.Get("a"); !a.Final {
+		t.Error("replacement of a not visible through Get")
+	}
+	if d.Len() != 4 {
+		t.Errorf("Len() = %d, want 4", d.Len())
+	}
+	if d.Last().ID != "b" {
+		t.Errorf("Last() = %s, want b", d.Last().ID)
+	}
+}
+
+func TestDocumentSnapshotsAreImmutable(t *testing.T) {
+	var d Document
+	for i := 0; i < 10; i++ {
+		d.Update(&Transcription{ID: fmt.Sprint(i), StartTimestamp: uint64(i)})
+	}
+
+	snapshot := d
+	d.Update(&Transcription{ID: "3", StartTimestamp: 3, Final: true})
+	d.Update(&Transcription{ID: "new", StartTimestamp: 5})
+	d.Remove("7")
+
+	if snapshot.Len() != 10 {
+		t.Errorf("snapshot Len() = %d, want 10", snapshot.Len())
+	}
+	if tr, _ := snapshot.Get("3"); tr.Final {
+		t.Error("snapshot saw a later replacement")
+	}
+	if _, ok := snapshot.Get("7"); !ok {
+		t.Error("snapshot lost a later removal")
+	}
+	if _, ok := d.Get("7"); ok {
+		t.Error("removed transcription still present")
+	}
+}
+
+func TestDocumentRandomUpdates(t *testing.T) {
+	var d Document
+	want := map[string]uint64{}
+	for i := 0; i < 2000; i++ {
+		id := fmt.Sprint(rand.Intn(300))
+		start := uint64(rand.Intn(1000))
+		if rand.Intn(10) == 0 {
+			d.Remove(id)
+			delete(want, id)
+			continue
+		}
+		d.Update(&Transcription{ID: id, StartTimestamp: start})
+		want[id] = start
+	}
+
+	if d.Len() != len(want) {
+		t.Fatalf("Len() = %d, want %d", d.Len(), len(want))
+	}
+
+	got := d.Transcriptions()
+	if !sort.SliceIsSorted(got, func(i, j int) bool { return got[i].StartTimestamp < got[j].StartTimestamp }) {
+		t.Error("transcriptions are not sorted by start")
+	}
+	for i, tr := range got {
+		if d.At(i) != tr {
+			t.Errorf("At(%d) disagrees with Transcriptions()", i)
+		}
+		if want[tr.ID] != tr.StartTimestamp {
+			t.Errorf("%s starts at %d, want %d", tr.ID, tr.StartTimestamp, want[tr.ID])
+		}
+	}
+}
+
+func TestDocumentJSON(t *testing.T) {
+	d := Document{StartedAt: 42}
+	d.Update(&Transcription{ID: "b", StartTimestamp: 2})
+	d.Update(&Transcription{ID: "a", StartTimestamp: 1})
+
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Document
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.StartedAt != 42 || fmt.Sprint(ids(got)) != "[a b]" {
+		t.Errorf("round trip of %s gave startedAt=%d ids=%v", data, got.StartedAt, ids(got))
+	}
+}
+
+func TestDocumentChanges(t *testing.T) {
+	var d, mirror Document
+
+	steps := []struct {
+		apply func() *DocumentChange
+		kind  ChangeKind
+		prev  bool
+	}{
+		{func() *DocumentChange { return d.Update(&Transcription{ID: "a", StartTimestamp: 1}) }, TranscriptionAdded, false},
+		{func() *DocumentChange { return d.Update(&Transcription{ID: "a", StartTimestamp: 1}) }, TranscriptionReplaced, true},
+		{func() *DocumentChange { return d.Update(&Transcription{ID: "a", StartTimestamp: 1, Final: true}) }, TranscriptionFinalized, true},
+		{func() *DocumentChange { return d.Update(&Transcription{ID: "b", StartTimestamp: 2}) }, TranscriptionAdded, false},
+		{func() *DocumentChange { return d.Remove("b") }, TranscriptionRemoved, true},
+	}
+
+	for i, step := range steps {
+		change := step.apply()
+		if change.Kind != step.kind {
+			t.Errorf("step %d: kind = %s, want %s", i, change.Kind, step.kind)
+		}
+		if (change.Previous != nil) != step.prev {
+			t.Errorf("step %d: previous = %v, want present=%v", i, change.Previous, step.prev)
+		}
+		mirror.Apply(change)
+	}
+
+	if d.Remove("missing") != nil {
+		t.Error("removing a missing transcription reported a change")
+	}
+	if got, want := fmt.Sprint(ids(mirror)), fmt.Sprint(ids(d)); got != want {
+		t.Errorf("mirror = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Handle refers to one installed middleware, so it can be stopped or restarted
+// independently of the rest of the router.
+type Handle struct {
+	r        *Router
+	name     string
+	start    MiddlewareFunc
+	policies Policies
+
+	mu     sync.Mutex
+	in     *installed
+	cancel context.CancelFunc
+}
+
+// Name describes the middleware, for logs and DeliveryStats.
+func (h *Handle) Name() string {
+	return h.name
+}
+
+// run starts the middleware with a fresh context and registers its listeners.
+func (h *Handle) run() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.in != nil {
+		return fmt.Errorf("middleware %s is already running", h.name)
+	}
+
+	fmt.Printf("adding middleware: %s...\n", h.name)
+
+	ctx, cancel := context.WithCancel(h.r.ctx)
+	listener, err := h.start(ctx, h.r.emitters)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	in := newInstalled(h.name, listener, h.policies)
+	if err := h.r.add(in); err != nil {
+		cancel()
+		in.close()
+		return err
+	}
+
+	h.in = in
+	h.cancel = cancel
+
+	fmt.Printf("added middleware: %s -> %#v.\n", h.name, listener)
+	return nil
+}
+
+// Stop cancels the middleware's context, closes its listener channels and stops
+// delivering to it. Values that were queued for it are discarded. It does not wait
+// for the middleware's goroutines to exit; use Done for that.
+func (h *Handle) Stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.in == nil {
+		return
+	}
+
+	fmt.Printf("stopping middleware: %s...\n", h.name)
+
+	h.cancel()
+	// Close first so that a repeater stuck sending to this middleware lets go of the
+	// router before we try to remove it.
+	h.in.close()
+	h.r.remove(h.in)
+
+	h.in = nil
+	h.cancel = nil
+}
+
+// Restart stops the middleware if it is running and starts it again with new
+// listeners.
+func (h *Handle) Restart() error {
+	h.Stop()
+	return h.run()
+}
+
+// Done returns the channel the middleware closes once it will not emit anything
+// else, or nil if the middleware is not running or doesn't provide one.
+func (h *Handle) Done() <-chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.in == nil {
+		return nil
+	}
+	return h.in.done
+}
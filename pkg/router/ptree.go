@@ -0,0 +1,137 @@
+package router
+
+import "math/rand"
+
+// ordered is implemented by ptree keys.
+type ordered[K any] interface {
+	less(K) bool
+}
+
+// ptree is a persistent treap. Updates return a new tree and leave the old one
+// untouched, sharing every node that wasn't on the updated path, so keeping old
+// versions around costs O(log n) per update.
+type ptree[K ordered[K], V any] struct {
+	root *pnode[K, V]
+}
+
+type pnode[K ordered[K], V any] struct {
+	key   K
+	val   V
+	prio  uint32
+	size  int
+	left  *pnode[K, V]
+	right *pnode[K, V]
+}
+
+func (n *pnode[K, V]) len() int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+// with returns a copy of n with new children.
+func (n *pnode[K, V]) with(left, right *pnode[K, V]) *pnode[K, V] {
+	c := *n
+	c.left = left
+	c.right = right
+	c.size = 1 + left.len() + right.len()
+	return &c
+}
+
+func (t ptree[K, V]) len() int {
+	return t.root.len()
+}
+
+func (t ptree[K, V]) get(k K) (V, bool) {
+	n := t.root
+	for n != nil {
+		switch {
+		case k.less(n.key):
+			n = n.left
+		case n.key.less(k):
+			n = n.right
+		default:
+			return n.val, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// at returns the i'th value in key order.
+func (t ptree[K, V]) at(i int) V {
+	n := t.root
+	for n != nil {
+		l := n.left.len()
+		switch {
+		case i < l:
+			n = n.left
+		case i == l:
+			return n.val
+		default:
+			i -= l + 1
+			n = n.right
+		}
+	}
+	panic("router: index out of range")
+}
+
+// each calls fn with every value in key order until fn returns false.
+func (t ptree[K, V]) each(fn func(V) bool) {
+	each(t.root, fn)
+}
+
+func each[K ordered[K], V any](n *pnode[K, V], fn func(V) bool) bool {
+	if n == nil {
+		return true
+	}
+	return each(n.left, fn) && fn(n.val) && each(n.right, fn)
+}
+
+// set returns a tree with k mapped to v.
+func (t ptree[K, V]) set(k K, v V) ptree[K, V] {
+	l, r := split(t.root, k, false)
+	_, r = split(r, k, true)
+	n := &pnode[K, V]{key: k, val: v, prio: rand.Uint32(), size: 1}
+	return ptree[K, V]{root: merge(merge(l, n), r)}
+}
+
+// delete returns a tree without k.
+func (t ptree[K, V]) delete(k K) ptree[K, V] {
+	l, r := split(t.root, k, false)
+	_, r = split(r, k, true)
+	return ptree[K, V]{root: merge(l, r)}
+}
+
+// split divides n into the keys before k and the rest. If inclusive, k itself goes
+// to the first part.
+func split[K ordered[K], V any](n *pnode[K, V], k K, inclusive bool) (*pnode[K, V], *pnode[K, V]) {
+	if n == nil {
+		return nil, nil
+	}
+
+	before := n.key.less(k) || (inclusive && !k.less(n.key))
+	if before {
+		l, r := split(n.right, k, inclusive)
+		return n.with(n.left, l), r
+	}
+
+	l, r := split(n.left, k, inclusive)
+	return l, n.with(r, n.right)
+}
+
+// merge joins a and b, where every key in a is before every key in b.
+func merge[K ordered[K], V any](a, b *pnode[K, V]) *pnode[K, V] {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+
+	if a.prio > b.prio {
+		return a.with(a.left, merge(a.right, b))
+	}
+	return b.with(merge(a, b.left), b.right)
+}
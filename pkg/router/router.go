@@ -3,26 +3,90 @@ package router
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"runtime"
 	"sync"
 	"time"
+
+	"github.com/ajbouh/bridge/pkg/mediaclock"
 )
 
 type Emitters struct {
 	CapturedSample chan<- *CapturedSample
 	CapturedAudio  chan<- *CapturedAudio
 	Transcription  chan<- *Transcription
+	// RemoveTranscription takes the ID of a transcription to drop from the document.
+	RemoveTranscription chan<- string
+	// Participant adds a participant to the Status, or updates the one with the same
+	// ID.
+	Participant chan<- *Participant
+	// RemoveParticipant takes the ID of a participant who left.
+	RemoveParticipant chan<- string
+	// SynthesizedAudio takes speech generated to be played into the session.
+	SynthesizedAudio chan<- *SynthesizedAudio
+	// PlayedAudio takes audio as it starts playing into the session.
+	PlayedAudio chan<- *PlayedAudio
+	// Interruption takes word that somebody talked over speech being played.
+	Interruption chan<- *Interruption
+
+	// Clock is what timestamps are measured with. Its epoch is the StartedAt of
+	// the document.
+	Clock *mediaclock.Clock
 }
 
 type Listeners struct {
 	DraftDocument  chan<- Document
 	FinalDocument  chan<- Document
+	DocumentChange chan<- *DocumentChange
 	CapturedAudio  chan<- *CapturedAudio
 	CapturedSample chan<- *CapturedSample
 	Status         chan<- *Status
+	// SynthesizedAudio hears the speech played into the session, whoever
+	// generated it.
+	SynthesizedAudio chan<- *SynthesizedAudio
+	// PlayedAudio hears what was actually played into the session and when, which
+	// is what participants' microphones may pick up again.
+	PlayedAudio chan<- *PlayedAudio
+	// Interruption hears whenever somebody talks over speech being played, so
+	// whoever plays or generates it can stop.
+	Interruption chan<- *Interruption
+
+	// Participant, if set, is listed in the Status for as long as the middleware is
+	// installed. Assistants and translators use it to announce themselves.
+	Participant *Participant
+
+	// Done, if set, is closed by the middleware once it will not emit anything else.
+	// Shutdown waits for it before closing the listeners of later streams.
+	Done <-chan struct{}
 }
 
 type MiddlewareFunc func(ctx context.Context, emit Emitters) (Listeners, error)
 
+// stream identifies one of the kinds of values the router repeats. Shutdown closes
+// listeners one stream at a time, in this order, so that values emitted while
+// earlier streams drain still reach their listeners.
+type stream int
+
+const (
+	streamCapturedSample stream = iota
+	streamCapturedAudio
+	streamDocument
+	streamSynthesizedAudio
+	streamPlayedAudio
+	streamInterruption
+	streamStatus
+)
+
+var shutdownOrder = []stream{
+	streamCapturedSample,
+	streamCapturedAudio,
+	streamDocument,
+	streamSynthesizedAudio,
+	streamPlayedAudio,
+	streamInterruption,
+	streamStatus,
+}
+
 type Router struct {
 	ctx       context.Context
 	ctxCancel context.CancelFunc
@@ -30,22 +94,178 @@ type Router struct {
 	capturedAudio  chan *CapturedAudio
 	capturedSample chan *CapturedSample
 	transcription  chan *Transcription
+	removal        chan string
+
+	synthesizedAudio chan *SynthesizedAudio
+	playedAudio      chan *PlayedAudio
+	interruption     chan *Interruption
+
+	participant        chan *Participant
+	participantRemoval chan string
+	roster             *roster
+
+	clock *mediaclock.Clock
+
+	// flushes asks the repeater for a stream to repeat everything already emitted.
+	flushes [streamStatus + 1]chan chan struct{}
 
 	emitters Emitters
 
-	middlewares []MiddlewareFunc
+	mu           sync.RWMutex
+	started      bool
+	shuttingDown bool
+	listeners    []*installed
+
+	repeaters sync.WaitGroup
+	quit      chan struct{}
+	done      chan struct{}
+}
+
+// installed holds the outlets the router delivers to for one middleware.
+type installed struct {
+	name        string
+	done        <-chan struct{}
+	participant *Participant
+
+	draftDocument  *outlet[Document]
+	finalDocument  *outlet[Document]
+	documentChange *outlet[*DocumentChange]
+	capturedAudio  *outlet[*CapturedAudio]
+	capturedSample *outlet[*CapturedSample]
+	status         *outlet[*Status]
+
+	synthesizedAudio *outlet[*SynthesizedAudio]
+	playedAudio      *outlet[*PlayedAudio]
+	interruption     *outlet[*Interruption]
+}
+
+func newInstalled(name string, l Listeners, p Policies) *installed {
+	var participant *Participant
+	if l.Participant != nil {
+		p := *l.Participant
+		if p.ID == "" {
+			p.ID = name
+		}
+		participant = &p
+	}
+
+	return &installed{
+		name:           name,
+		done:           l.Done,
+		participant:    participant,
+		draftDocument:  newOutlet(l.DraftDocument, p.DraftDocument),
+		finalDocument:  newOutlet(l.FinalDocument, p.FinalDocument),
+		documentChange: newOutlet(l.DocumentChange, p.DocumentChange),
+		capturedAudio:  newOutlet(l.CapturedAudio, p.CapturedAudio),
+		capturedSample: newOutlet(l.CapturedSample, p.CapturedSample),
+		status:         newOutlet(l.Status, p.Status),
 
-	mu        sync.RWMutex
-	started   bool
-	listeners []Listeners
+		synthesizedAudio: newOutlet(l.SynthesizedAudio, p.SynthesizedAudio),
+		playedAudio:      newOutlet(l.PlayedAudio, p.PlayedAudio),
+		interruption:     newOutlet(l.Interruption, p.Interruption),
+	}
+}
+
+func (in *installed) stats() []DeliveryStats {
+	var stats []DeliveryStats
+	add := func(s DeliveryStats, ok bool) {
+		if ok {
+			stats = append(stats, s)
+		}
+	}
+	add(in.draftDocument.stats(in.name, "DraftDocument"))
+	add(in.finalDocument.stats(in.name, "FinalDocument"))
+	add(in.documentChange.stats(in.name, "DocumentChange"))
+	add(in.capturedAudio.stats(in.name, "CapturedAudio"))
+	add(in.capturedSample.stats(in.name, "CapturedSample"))
+	add(in.synthesizedAudio.stats(in.name, "SynthesizedAudio"))
+	add(in.playedAudio.stats(in.name, "PlayedAudio"))
+	add(in.interruption.stats(in.name, "Interruption"))
+	add(in.status.stats(in.name, "Status"))
+	return stats
+}
+
+// drain delivers whatever is queued for s and then closes the listeners for s.
+func (in *installed) drain(ctx context.Context, s stream) error {
+	var err error
+	flushAndClose := func(flush func(context.Context) error, close func()) {
+		if e := flush(ctx); e != nil && err == nil {
+			err = e
+		}
+		close()
+	}
+
+	switch s {
+	case streamCapturedSample:
+		flushAndClose(in.capturedSample.flush, in.capturedSample.close)
+	case streamCapturedAudio:
+		flushAndClose(in.capturedAudio.flush, in.capturedAudio.close)
+	case streamDocument:
+		flushAndClose(in.draftDocument.flush, in.draftDocument.close)
+		flushAndClose(in.finalDocument.flush, in.finalDocument.close)
+		flushAndClose(in.documentChange.flush, in.documentChange.close)
+	case streamSynthesizedAudio:
+		flushAndClose(in.synthesizedAudio.flush, in.synthesizedAudio.close)
+	case streamPlayedAudio:
+		flushAndClose(in.playedAudio.flush, in.playedAudio.close)
+	case streamInterruption:
+		flushAndClose(in.interruption.flush, in.interruption.close)
+	case streamStatus:
+		flushAndClose(in.status.flush, in.status.close)
+	}
+	return err
+}
+
+// close closes every listener without delivering what's still queued.
+func (in *installed) close() {
+	in.capturedSample.close()
+	in.capturedAudio.close()
+	in.draftDocument.close()
+	in.finalDocument.close()
+	in.documentChange.close()
+	in.synthesizedAudio.close()
+	in.playedAudio.close()
+	in.interruption.close()
+	in.status.close()
+}
+
+func (in *installed) closed() bool {
+	return in.capturedSample.isClosed() &&
+		in.capturedAudio.isClosed() &&
+		in.draftDocument.isClosed() &&
+		in.finalDocument.isClosed() &&
+		in.documentChange.isClosed() &&
+		in.synthesizedAudio.isClosed() &&
+		in.playedAudio.isClosed() &&
+		in.interruption.isClosed() &&
+		in.status.isClosed()
+}
+
+func middlewareName(fn MiddlewareFunc) string {
+	if f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()); f != nil {
+		return f.Name()
+	}
+	return fmt.Sprintf("%p", fn)
 }
 
 func New(parentCtx context.Context) *Router {
 	capturedAudio := make(chan *CapturedAudio, 100)
 	capturedSample := make(chan *CapturedSample, 100)
 	transcription := make(chan *Transcription, 100)
+	removal := make(chan string, 100)
+	participant := make(chan *Participant, 100)
+	participantRemoval := make(chan string, 100)
+	synthesizedAudio := make(chan *SynthesizedAudio, 100)
+	playedAudio := make(chan *PlayedAudio, 100)
+	interruption := make(chan *Interruption, 100)
 
 	ctx, ctxCancel := context.WithCancel(parentCtx)
+	clock := mediaclock.New(time.Now())
+
+	var flushes [streamStatus + 1]chan chan struct{}
+	for i := range flushes {
+		flushes[i] = make(chan chan struct{})
+	}
 
 	return &Router{
 		ctx:       ctx,
@@ -54,38 +274,122 @@ func New(parentCtx context.Context) *Router {
 		capturedAudio:  capturedAudio,
 		capturedSample: capturedSample,
 		transcription:  transcription,
+		removal:        removal,
+
+		synthesizedAudio: synthesizedAudio,
+		playedAudio:      playedAudio,
+		interruption:     interruption,
+
+		participant:        participant,
+		participantRemoval: participantRemoval,
+		roster:             newRoster(clock.Epoch().UnixMilli()),
+
+		clock: clock,
 
 		emitters: Emitters{
-			CapturedAudio:  capturedAudio,
-			CapturedSample: capturedSample,
-			Transcription:  transcription,
+			CapturedAudio:       capturedAudio,
+			CapturedSample:      capturedSample,
+			Transcription:       transcription,
+			RemoveTranscription: removal,
+			Participant:         participant,
+			RemoveParticipant:   participantRemoval,
+			SynthesizedAudio:    synthesizedAudio,
+			PlayedAudio:         playedAudio,
+			Interruption:        interruption,
+			Clock:               clock,
 		},
+
+		flushes: flushes,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
 	}
 }
 
-func (r *Router) InstallMiddleware(middlewares ...MiddlewareFunc) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// Clock returns the clock timestamps in this router are measured with.
+func (r *Router) Clock() *mediaclock.Clock {
+	return r.clock
+}
+
+// InstallMiddleware starts each middleware and delivers to its listeners with
+// PolicyBlock.
+func (r *Router) InstallMiddleware(middlewares ...MiddlewareFunc) ([]*Handle, error) {
+	return r.InstallMiddlewareWithPolicies(Policies{}, middlewares...)
+}
+
+// InstallMiddlewareWithPolicies starts each middleware and delivers to its listeners
+// according to policies. If any middleware fails to start, the ones started before
+// it are stopped again.
+func (r *Router) InstallMiddlewareWithPolicies(policies Policies, middlewares ...MiddlewareFunc) ([]*Handle, error) {
+	handles := make([]*Handle, 0, len(middlewares))
 
 	for _, start := range middlewares {
-		var err error
-		fmt.Printf("adding middleware: %#v...\n", start)
-		listener, err := start(r.ctx, r.emitters)
-		if err != nil {
-			// TODO cleanup what we've started!!
-			return err
+		h := &Handle{
+			r:        r,
+			name:     middlewareName(start),
+			start:    start,
+			policies: policies,
 		}
 
-		r.listeners = append(r.listeners, listener)
-		r.middlewares = append(r.middlewares, start)
+		if err := h.run(); err != nil {
+			for i := len(handles) - 1; i >= 0; i-- {
+				handles[i].Stop()
+			}
+			return nil, fmt.Errorf("starting middleware %s: %w", h.name, err)
+		}
+
+		handles = append(handles, h)
+	}
+
+	return handles, nil
+}
 
-		fmt.Printf("added middleware: %#v -> %#v.\n", start, listener)
+func (r *Router) add(in *installed) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.shuttingDown {
+		return fmt.Errorf("router is shutting down")
 	}
 
+	r.listeners = append(r.listeners, in)
+	if in.participant != nil {
+		r.roster.update(*in.participant)
+	} else if in.status != nil {
+		// Make sure the new listener hears the current status.
+		r.roster.notify()
+	}
 	return nil
 }
 
-func (r *Router) visitListeners(fn func(Listeners)) {
+func (r *Router) remove(in *installed) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, l := range r.listeners {
+		if l == in {
+			r.listeners = append(r.listeners[:i:i], r.listeners[i+1:]...)
+			if in.participant != nil {
+				r.roster.remove(in.participant.ID)
+			}
+			return
+		}
+	}
+}
+
+// Stats reports delivery counters for every listener, so it's possible to see which
+// middleware is falling behind.
+func (r *Router) Stats() []DeliveryStats {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var stats []DeliveryStats
+	for _, l := range r.listeners {
+		stats = append(stats, l.stats()...)
+	}
+	return stats
+}
+
+func (r *Router) visitListeners(fn func(*installed)) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	for _, l := range r.listeners {
@@ -93,6 +397,112 @@ func (r *Router) visitListeners(fn func(Listeners)) {
 	}
 }
 
+// repeat calls fn for each value received on ch until the router quits.
+func repeat[T any](r *Router, s stream, ch <-chan T, fn func(T)) {
+	flush := r.flushes[s]
+
+	r.repeaters.Add(1)
+	go func() {
+		defer r.repeaters.Done()
+		for {
+			select {
+			case o := <-ch:
+				fn(o)
+			case done := <-flush:
+				for drained := false; !drained; {
+					select {
+					case o := <-ch:
+						fn(o)
+					default:
+						drained = true
+					}
+				}
+				close(done)
+			case <-r.quit:
+				return
+			}
+		}
+	}()
+}
+
+// repeatDocuments is like repeat for the two channels that update the document.
+// They share a goroutine so that updates and removals apply in order.
+func (r *Router) repeatDocuments(update func(*Transcription), remove func(string)) {
+	flush := r.flushes[streamDocument]
+
+	r.repeaters.Add(1)
+	go func() {
+		defer r.repeaters.Done()
+		for {
+			select {
+			case o := <-r.transcription:
+				update(o)
+			case id := <-r.removal:
+				remove(id)
+			case done := <-flush:
+				for drained := false; !drained; {
+					select {
+					case o := <-r.transcription:
+						update(o)
+					case id := <-r.removal:
+						remove(id)
+					default:
+						drained = true
+					}
+				}
+				close(done)
+			case <-r.quit:
+				return
+			}
+		}
+	}()
+}
+
+// repeatStatus applies participant updates to the roster and publishes a Status
+// whenever the roster changes. Statuses are snapshots, so a burst of changes is
+// published once.
+func (r *Router) repeatStatus() {
+	flush := r.flushes[streamStatus]
+
+	publish := func() {
+		status := r.roster.status()
+		r.visitListeners(func(l *installed) {
+			l.status.offer(status)
+		})
+	}
+
+	r.repeaters.Add(1)
+	go func() {
+		defer r.repeaters.Done()
+		for {
+			select {
+			case p := <-r.participant:
+				r.roster.update(*p)
+			case id := <-r.participantRemoval:
+				r.roster.remove(id)
+			case <-r.roster.changed:
+				publish()
+			case done := <-flush:
+				for drained := false; !drained; {
+					select {
+					case p := <-r.participant:
+						r.roster.update(*p)
+					case id := <-r.participantRemoval:
+						r.roster.remove(id)
+					case <-r.roster.changed:
+						publish()
+					default:
+						drained = true
+					}
+				}
+				close(done)
+			case <-r.quit:
+				return
+			}
+		}
+	}()
+}
+
 func (r *Router) Start() error {
 	fmt.Printf("starting router...\n")
 	defer fmt.Printf("started router.\n")
@@ -105,61 +515,186 @@ func (r *Router) Start() error {
 	r.started = true
 	r.mu.Unlock()
 
-	// Run capturedAudio repeater
-	go func() {
-		for o := range r.capturedAudio {
-			r.visitListeners(func(l Listeners) {
-				if l.CapturedAudio != nil {
-					l.CapturedAudio <- o
-				}
-			})
+	repeat(r, streamCapturedAudio, r.capturedAudio, func(o *CapturedAudio) {
+		// Voice activity detection emits drafts while someone speaks and a final
+		// audio once they stop.
+		if o.Source != "" {
+			r.roster.setSpeaking(o.Source, !o.Final)
 		}
-	}()
 
-	// Run capturedSample repeater
-	go func() {
-		for o := range r.capturedSample {
-			r.visitListeners(func(l Listeners) {
-				if l.CapturedSample != nil {
-					l.CapturedSample <- o
-				}
-			})
-		}
-	}()
+		r.visitListeners(func(l *installed) {
+			l.capturedAudio.offer(o)
+		})
+	})
 
-	// Run transcription repeater
-	go func() {
-		// This is kind of a hack and doesn't really make sense as a way to shut down...
-		defer r.ctxCancel()
+	repeat(r, streamCapturedSample, r.capturedSample, func(o *CapturedSample) {
+		r.visitListeners(func(l *installed) {
+			l.capturedSample.offer(o)
+		})
+	})
+
+	repeat(r, streamSynthesizedAudio, r.synthesizedAudio, func(o *SynthesizedAudio) {
+		r.visitListeners(func(l *installed) {
+			l.synthesizedAudio.offer(o)
+		})
+	})
+
+	repeat(r, streamPlayedAudio, r.playedAudio, func(o *PlayedAudio) {
+		r.visitListeners(func(l *installed) {
+			l.playedAudio.offer(o)
+		})
+	})
+
+	repeat(r, streamInterruption, r.interruption, func(o *Interruption) {
+		r.visitListeners(func(l *installed) {
+			l.interruption.offer(o)
+		})
+	})
+
+	document := Document{
+		StartedAt: r.clock.Epoch().UnixMilli(),
+	}
+	// Keep the final document up to date alongside the draft rather than filtering
+	// the whole draft on every final transcription.
+	final := Document{
+		StartedAt: document.StartedAt,
+	}
+
+	// Documents share structure, so the copies handed to listeners are cheap and
+	// unaffected by later updates.
+	publish := func(change *DocumentChange) {
+		change.Document = document
+		r.visitListeners(func(l *installed) {
+			l.documentChange.offer(change)
+			l.draftDocument.offer(change.Document)
+		})
+	}
+
+	publishFinal := func() {
+		snapshot := final
+		r.visitListeners(func(l *installed) {
+			l.finalDocument.offer(snapshot)
+		})
+	}
 
-		document := Document{
-			StartedAt: time.Now().Unix(),
+	r.repeatDocuments(
+		func(o *Transcription) {
+			publish(document.Update(o))
+
+			if !o.Final {
+				final.Remove(o.ID)
+				return
+			}
+
+			final.Update(o)
+			publishFinal()
+		},
+		func(id string) {
+			change := document.Remove(id)
+			if change == nil {
+				return
+			}
+			publish(change)
+
+			if final.Remove(id) != nil {
+				publishFinal()
+			}
+		},
+	)
+
+	r.repeatStatus()
+
+	return nil
+}
+
+// flush waits until everything emitted on s so far has been offered to listeners.
+func (r *Router) flush(ctx context.Context, s stream) error {
+	r.mu.RLock()
+	started := r.started
+	r.mu.RUnlock()
+
+	if !started || int(s) >= len(r.flushes) {
+		return nil
+	}
+
+	done := make(chan struct{})
+	select {
+	case r.flushes[s] <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops the router. It cancels the context given to middlewares so that
+// sources stop producing, then works through the streams in pipeline order:
+// captured samples, captured audio, documents and finally status. For each stream
+// it waits for the router to repeat what has been emitted so far, delivers what is
+// queued for listeners, closes their channels, and waits for every middleware with
+// no open listeners left to close its Done channel. If ctx expires first, the
+// remaining listeners are closed without waiting and ctx's error is returned.
+func (r *Router) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	if r.shuttingDown {
+		r.mu.Unlock()
+		return fmt.Errorf("already shutting down")
+	}
+	r.shuttingDown = true
+	listeners := append([]*installed(nil), r.listeners...)
+	r.mu.Unlock()
+
+	fmt.Printf("shutting down router...\n")
+	defer fmt.Printf("shut down router.\n")
+
+	r.ctxCancel()
+
+	var err error
+	waited := map[*installed]bool{}
+	for _, s := range shutdownOrder {
+		if err == nil {
+			err = r.flush(ctx, s)
 		}
 
-		for o := range r.transcription {
-			document.Update(o)
+		for _, l := range listeners {
+			if err != nil {
+				l.close()
+				continue
+			}
+			err = l.drain(ctx, s)
+		}
 
-			draft := *document.Clone()
-			r.visitListeners(func(l Listeners) {
-				if l.DraftDocument != nil {
-					l.DraftDocument <- draft
-				}
-			})
+		for _, l := range listeners {
+			if err != nil || waited[l] || l.done == nil || !l.closed() {
+				continue
+			}
+			waited[l] = true
 
-			if o.Final {
-				final := *document.CloneFinal()
-				r.visitListeners(func(l Listeners) {
-					if l.FinalDocument != nil {
-						l.FinalDocument <- final
-					}
-				})
+			select {
+			case <-l.done:
+			case <-ctx.Done():
+				err = ctx.Err()
 			}
 		}
-	}()
+	}
 
-	return nil
+	close(r.quit)
+	r.repeaters.Wait()
+
+	r.mu.Lock()
+	r.listeners = nil
+	r.mu.Unlock()
+
+	close(r.done)
+	return err
 }
 
+// WaitForDone blocks until Shutdown has finished.
 func (r *Router) WaitForDone() {
-	<-r.ctx.Done()
+	<-r.done
 }
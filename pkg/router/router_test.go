@@ -0,0 +1,220 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestInstallRollsBackOnFailure(t *testing.T) {
+	r := New(context.Background())
+	r.Start()
+
+	var startedCtx context.Context
+	listener := make(chan *CapturedAudio, 1)
+	ok := func(ctx context.Context, emit Emitters) (Listeners, error) {
+		startedCtx = ctx
+		return Listeners{CapturedAudio: listener}, nil
+	}
+	fail := func(ctx context.Context, emit Emitters) (Listeners, error) {
+		return Listeners{}, errors.New("nope")
+	}
+
+	if _, err := r.InstallMiddleware(ok, fail); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if startedCtx.Err() == nil {
+		t.Error("context of rolled back middleware was not cancelled")
+	}
+	if _, open := <-listener; open {
+		t.Error("listener of rolled back middleware was not closed")
+	}
+	if n := len(r.Stats()); n != 0 {
+		t.Errorf("router still has %d listeners", n)
+	}
+}
+
+func TestHandleStopUnblocksRouter(t *testing.T) {
+	r := New(context.Background())
+	r.Start()
+
+	stuck := make(chan *CapturedSample)
+	flowing := make(chan *CapturedSample, 10)
+	handles, err := r.InstallMiddleware(
+		func(ctx context.Context, emit Emitters) (Listeners, error) {
+			return Listeners{CapturedSample: stuck}, nil
+		},
+		func(ctx context.Context, emit Emitters) (Listeners, error) {
+			return Listeners{CapturedSample: flowing}, nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.emitters.CapturedSample <- &CapturedSample{}
+	time.Sleep(10 * time.Millisecond)
+	handles[0].Stop()
+
+	select {
+	case <-flowing:
+	case <-time.After(time.Second):
+		t.Fatal("router stayed blocked on stopped middleware")
+	}
+}
+
+func TestShutdownDrainsInPipelineOrder(t *testing.T) {
+	r := New(context.Background())
+	r.Start()
+
+	// A middleware that turns each captured sample into captured audio, the way vad does.
+	_, err := r.InstallMiddleware(func(ctx context.Context, emit Emitters) (Listeners, error) {
+		ch := make(chan *CapturedSample, 10)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for range ch {
+				time.Sleep(5 * time.Millisecond)
+				emit.CapturedAudio <- &CapturedAudio{}
+			}
+		}()
+		return Listeners{CapturedSample: ch, Done: done}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	audio := make(chan *CapturedAudio, 10)
+	_, err = r.InstallMiddleware(func(ctx context.Context, emit Emitters) (Listeners, error) {
+		return Listeners{CapturedAudio: audio}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		r.emitters.CapturedSample <- &CapturedSample{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	r.WaitForDone()
+
+	n := 0
+	for range audio {
+		n++
+	}
+	if n != 3 {
+		t.Errorf("got %d captured audio after shutdown, want 3", n)
+	}
+}
+
+func TestShutdownDeliversLatestDraft(t *testing.T) {
+	r := New(context.Background())
+	r.Start()
+
+	drafts := make(chan Document)
+	last := make(chan Document, 1)
+	_, err := r.InstallMiddlewareWithPolicies(Policies{
+		DraftDocument: PolicyCoalesceLatest,
+	}, func(ctx context.Context, emit Emitters) (Listeners, error) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			var doc Document
+			for doc = range drafts {
+				time.Sleep(time.Millisecond)
+			}
+			last <- doc
+		}()
+		return Listeners{DraftDocument: drafts, Done: done}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 200
+	for i := 0; i < n; i++ {
+		r.emitters.Transcription <- &Transcription{
+			ID:             fmt.Sprintf("t%d", i),
+			StartTimestamp: uint64(i),
+			EndTimestamp:   uint64(i + 1),
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	r.WaitForDone()
+
+	if doc := <-last; doc.Len() != n {
+		t.Errorf("last draft has %d transcriptions, want %d", doc.Len(), n)
+	}
+}
+
+func TestStatusTracksParticipants(t *testing.T) {
+	r := New(context.Background())
+	r.Start()
+
+	statuses := make(chan *Status, 100)
+	_, err := r.InstallMiddleware(func(ctx context.Context, emit Emitters) (Listeners, error) {
+		return Listeners{Status: statuses}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handles, err := r.InstallMiddleware(func(ctx context.Context, emit Emitters) (Listeners, error) {
+		return Listeners{Participant: &Participant{ID: "bot", Label: "Bot", IsAssistant: true}}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Statuses are coalesced, so wait for the one that reflects everything so far.
+	r.emitters.Participant <- &Participant{ID: "alice", Label: "Alice"}
+	awaitStatus(t, statuses, []Participant{
+		{ID: "bot", Label: "Bot", IsAssistant: true},
+		{ID: "alice", Label: "Alice"},
+	})
+
+	r.emitters.CapturedAudio <- &CapturedAudio{Source: "alice"}
+	awaitStatus(t, statuses, []Participant{
+		{ID: "bot", Label: "Bot", IsAssistant: true},
+		{ID: "alice", Label: "Alice", Speaking: true},
+	})
+
+	handles[0].Stop()
+	r.emitters.CapturedAudio <- &CapturedAudio{Source: "alice", Final: true}
+	r.emitters.Participant <- &Participant{ID: "alice", Label: "Alice", Muted: true}
+	awaitStatus(t, statuses, []Participant{{ID: "alice", Label: "Alice", Muted: true}})
+
+	r.emitters.RemoveParticipant <- "alice"
+	awaitStatus(t, statuses, []Participant{})
+}
+
+func awaitStatus(t *testing.T, statuses <-chan *Status, want []Participant) {
+	t.Helper()
+
+	timeout := time.After(time.Second)
+	var last []Participant
+	for {
+		select {
+		case s := <-statuses:
+			last = *s.Participants
+			if fmt.Sprint(last) == fmt.Sprint(want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("last status %+v, want %+v", last, want)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package router
+
+import "sync"
+
+// Participant is someone, or something, taking part in the session.
+type Participant struct {
+	ID          string `json:"id"`
+	Label       string `json:"label"`
+	IsAssistant bool   `json:"isAssistent"`
+	Muted       bool   `json:"muted"`
+	Speaking    bool   `json:"speaking"`
+}
+
+type Status struct {
+	Participants *[]Participant `json:"participants"`
+	// StartedAt is when the session started, in unix milliseconds. Timestamps are
+	// measured from it.
+	StartedAt int64 `json:"startedAt,omitempty"`
+}
+
+// roster tracks the participants of a session in the order they joined. Changes
+// mark it dirty and wake whoever is publishing Status.
+type roster struct {
+	mu           sync.Mutex
+	participants []Participant
+	changed      chan struct{}
+	startedAt    int64
+}
+
+func newRoster(startedAt int64) *roster {
+	return &roster{changed: make(chan struct{}, 1), startedAt: startedAt}
+}
+
+func (r *roster) notify() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (r *roster) index(id string) int {
+	for i, p := range r.participants {
+		if p.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// update adds p, or replaces the participant with the same ID. Speaking is kept as
+// it was, since it is derived from captured audio rather than reported.
+func (r *roster) update(p Participant) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.index(p.ID)
+	if i < 0 {
+		r.participants = append(r.participants, p)
+		r.notify()
+		return
+	}
+
+	p.Speaking = r.participants[i].Speaking
+	if r.participants[i] != p {
+		r.participants[i] = p
+		r.notify()
+	}
+}
+
+func (r *roster) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if i := r.index(id); i >= 0 {
+		r.participants = append(r.participants[:i:i], r.participants[i+1:]...)
+		r.notify()
+	}
+}
+
+func (r *roster) setSpeaking(id string, speaking bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if i := r.index(id); i >= 0 && r.participants[i].Speaking != speaking {
+		r.participants[i].Speaking = speaking
+		r.notify()
+	}
+}
+
+func (r *roster) status() *Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	participants := append([]Participant{}, r.participants...)
+	return &Status{Participants: &participants, StartedAt: r.startedAt}
+}
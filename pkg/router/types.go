@@ -5,6 +5,9 @@ type Word struct {
 	End         float32 `json:"end"`
 	Word        string  `json:"word"`
 	Probability float32 `json:"prob"`
+
+	// Stable is set on the words of a draft that won't change before it's final.
+	Stable bool `json:"stable,omitempty"`
 }
 
 type TranscriptionSegment struct {
@@ -37,6 +40,9 @@ type TranscriptionRequest struct {
 	TargetLanguage *string `json:"target_language,omitempty"`
 
 	Segments *[]TranscriptionSegment `json:"segments,omitempty"`
+
+	// Prompt is text that came before the audio, which the model continues.
+	Prompt *string `json:"prompt,omitempty"`
 }
 
 type TranscriptionResponse struct {
@@ -49,19 +55,78 @@ type TranscriptionResponse struct {
 	Segments []TranscriptionSegment `json:"segments"`
 }
 
+type DiarizationRequest struct {
+	Audio *Audio `json:"audio,omitempty"`
+	Task  string `json:"task"`
+
+	MinSpeakers *int `json:"min_speakers,omitempty"`
+	MaxSpeakers *int `json:"max_speakers,omitempty"`
+}
+
+// DiarizationSegment is a turn of one speaker. Start and End are in seconds from the
+// start of the audio.
+type DiarizationSegment struct {
+	Start float32 `json:"start"`
+	End   float32 `json:"end"`
+	Track string  `json:"track"`
+	// Label tells the speakers of a single response apart. The same speaker may
+	// get another label in the next response.
+	Label string `json:"label"`
+}
+
+type DiarizationResponse struct {
+	Segments []DiarizationSegment `json:"segments"`
+
+	// Embeddings holds a voice embedding for each label, if the service computes
+	// them, which recognize a speaker across responses.
+	Embeddings map[string][]float32 `json:"embeddings,omitempty"`
+}
+
+type SynthesisRequest struct {
+	Text string `json:"text"`
+
+	Voice    *string `json:"voice,omitempty"`
+	Language *string `json:"language,omitempty"`
+}
+
+type SynthesisResponse struct {
+	Audio Audio `json:"audio"`
+}
+
 type CapturedSample struct {
-	PCM          []float32
-	EndTimestamp uint32
+	// Source is the ID of the participant the sample was captured from, if known.
+	Source string `json:"source,omitempty"`
+
+	PCM []float32 `json:"-"`
+
+	// StartTimestamp and EndTimestamp are the media time, in milliseconds since the
+	// document started, of the first sample and of the end of the last one.
+	StartTimestamp uint64 `json:"start"`
+	EndTimestamp   uint64 `json:"end"`
 }
 
 type CapturedAudio struct {
 	ID string `json:"id"`
+	// Source is the ID of the participant speaking, if known.
+	Source string `json:"source,omitempty"`
 
 	PCM   []float32 `json:"-"`
 	Final bool      `json:"final"`
 
+	// StartTimestamp and EndTimestamp are in media time, like those of
+	// CapturedSample.
 	StartTimestamp uint64 `json:"start"`
 	EndTimestamp   uint64 `json:"end"`
+
+	// NoiseFloor is the background noise level of the source in dBFS, and SNR how
+	// many dB the audio stands out from it, as estimated by the VAD.
+	NoiseFloor float32 `json:"noise_floor,omitempty"`
+	SNR        float32 `json:"snr,omitempty"`
+
+	// EchoOf is the ID of the audio played into the session that this is an echo
+	// of, if it is. It's somebody's microphone picking up the session rather than
+	// them speaking.
+	EchoOf string `json:"echo_of,omitempty"`
 }
 
 type Transcription struct {
@@ -71,9 +136,14 @@ type Transcription struct {
 
 	Final bool `json:"final"`
 
+	// StartTimestamp and EndTimestamp are in media time, like those of
+	// CapturedSample. Segment and word times are in seconds from StartTimestamp.
 	StartTimestamp uint64 `json:"start"`
 	EndTimestamp   uint64 `json:"end"`
 
+	// Truncated is set on speech that was cut off because somebody talked over it.
+	Truncated bool `json:"truncated,omitempty"`
+
 	TranscriptSources []*Transcription `json:"-"`
 
 	Language            string              `json:"language"`
@@ -83,3 +153,55 @@ type Transcription struct {
 
 	Segments []TranscriptionSegment `json:"segments"`
 }
+
+// SynthesizedAudio is speech generated to be played into the session.
+type SynthesizedAudio struct {
+	ID string `json:"id"`
+	// Source is the ID of the participant speaking.
+	Source string `json:"source,omitempty"`
+	// TranscriptionID is the transcription the speech says. For an assistant's reply
+	// it identifies the chat completion that produced it.
+	TranscriptionID string `json:"transcription_id,omitempty"`
+
+	PCM        []float32 `json:"-"`
+	SampleRate int       `json:"sample_rate"`
+
+	// StartTimestamp and EndTimestamp are in media time, like those of
+	// CapturedSample, and say when the speech is due to play.
+	StartTimestamp uint64 `json:"start"`
+	EndTimestamp   uint64 `json:"end"`
+}
+
+// PlayedAudio is audio as it was played into the session.
+type PlayedAudio struct {
+	// AudioID is the ID of the SynthesizedAudio played, and Source the ID of the
+	// participant speaking.
+	AudioID string `json:"audio_id"`
+	Source  string `json:"source,omitempty"`
+
+	PCM        []float32 `json:"-"`
+	SampleRate int       `json:"sample_rate"`
+
+	// StartTimestamp and EndTimestamp are in media time, like those of
+	// CapturedSample, and say when the audio actually played.
+	StartTimestamp uint64 `json:"start"`
+	EndTimestamp   uint64 `json:"end"`
+}
+
+// Interruption is somebody talking over speech being played into the session.
+type Interruption struct {
+	// Source is the ID of the participant who was talked over, and By that of the
+	// participant who talked, if known.
+	Source string `json:"source"`
+	By     string `json:"by,omitempty"`
+
+	// AudioID is the SynthesizedAudio that was cut off, and TranscriptionID the
+	// transcription it was saying, which identifies the chat completion of an
+	// assistant's reply.
+	AudioID         string `json:"audio_id"`
+	TranscriptionID string `json:"transcription_id,omitempty"`
+
+	// Timestamp is the media time the interruption started at. Speech due to play
+	// before it should be stopped.
+	Timestamp uint64 `json:"timestamp"`
+}
@@ -0,0 +1,132 @@
+// Package session records everything a router sees to disk and plays it back.
+//
+// A session is a directory holding an append-only events.jsonl, one JSON Event per
+// line, plus side-car files of raw little-endian float32 PCM that audio events point
+// into.
+package session
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	logr "github.com/ajbouh/bridge/pkg/log"
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+var Logger = logr.New()
+
+const (
+	eventsFile  = "events.jsonl"
+	samplesFile = "samples.pcm"
+	audioFile   = "audio.pcm"
+	speechFile  = "speech.pcm"
+)
+
+type EventType string
+
+const (
+	// EventSession is always the first event of a session.
+	EventSession              EventType = "session"
+	EventCapturedSample       EventType = "captured_sample"
+	EventCapturedAudio        EventType = "captured_audio"
+	EventTranscription        EventType = "transcription"
+	EventTranscriptionRemoved EventType = "transcription_removed"
+	EventSynthesizedAudio     EventType = "synthesized_audio"
+)
+
+// Event is one line of events.jsonl.
+type Event struct {
+	// At is the time since the session started.
+	At   time.Duration `json:"at"`
+	Type EventType     `json:"type"`
+
+	// StartedAt is the wall clock time the session started, in unix seconds. Only
+	// set for EventSession.
+	StartedAt int64 `json:"started_at,omitempty"`
+
+	// PCM locates the audio of an EventCapturedSample, EventCapturedAudio or
+	// EventSynthesizedAudio.
+	PCM *PCMRef `json:"pcm,omitempty"`
+
+	CapturedSample *router.CapturedSample `json:"captured_sample,omitempty"`
+	CapturedAudio  *router.CapturedAudio  `json:"captured_audio,omitempty"`
+	Transcription  *router.Transcription  `json:"transcription,omitempty"`
+
+	SynthesizedAudio *router.SynthesizedAudio `json:"synthesized_audio,omitempty"`
+
+	// ID is the transcription an EventTranscriptionRemoved removed.
+	ID string `json:"id,omitempty"`
+}
+
+// PCMRef points at a run of samples in one of the session's side-car files.
+type PCMRef struct {
+	File string `json:"file"`
+	// Offset and Length count samples, not bytes.
+	Offset int64 `json:"offset"`
+	Length int   `json:"length"`
+}
+
+// pcmWriter appends samples to a side-car file.
+type pcmWriter struct {
+	name   string
+	f      *os.File
+	offset int64
+	buf    []byte
+}
+
+func createPCM(dir, name string) (*pcmWriter, error) {
+	f, err := os.Create(dir + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	return &pcmWriter{name: name, f: f}, nil
+}
+
+func (w *pcmWriter) write(pcm []float32) (*PCMRef, error) {
+	w.buf = w.buf[:0]
+	for _, s := range pcm {
+		w.buf = binary.LittleEndian.AppendUint32(w.buf, math.Float32bits(s))
+	}
+	if _, err := w.f.Write(w.buf); err != nil {
+		return nil, err
+	}
+
+	ref := &PCMRef{File: w.name, Offset: w.offset, Length: len(pcm)}
+	w.offset += int64(len(pcm))
+	return ref, nil
+}
+
+func (w *pcmWriter) Close() error {
+	return w.f.Close()
+}
+
+// readPCM loads the samples ref points at from the session in dir.
+func readPCM(files map[string]*os.File, dir string, ref *PCMRef) ([]float32, error) {
+	f, ok := files[ref.File]
+	if !ok {
+		var err error
+		f, err = os.Open(dir + "/" + ref.File)
+		if err != nil {
+			return nil, err
+		}
+		files[ref.File] = f
+	}
+
+	buf := make([]byte, 4*ref.Length)
+	if _, err := f.ReadAt(buf, 4*ref.Offset); err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s is truncated: %w", ref.File, io.ErrUnexpectedEOF)
+		}
+		return nil, err
+	}
+
+	pcm := make([]float32, ref.Length)
+	for i := range pcm {
+		pcm[i] = math.Float32frombits(binary.LittleEndian.Uint32(buf[4*i:]))
+	}
+	return pcm, nil
+}
@@ -0,0 +1,207 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+// Recorder appends everything it's given to a session directory.
+type Recorder struct {
+	Dir string
+
+	start   time.Time
+	events  *os.File
+	w       *bufio.Writer
+	enc     *json.Encoder
+	samples *pcmWriter
+	audio   *pcmWriter
+	speech  *pcmWriter
+}
+
+// NewRecorder returns a middleware that records captured samples, captured audio,
+// every change to the document and synthesized speech into a new session directory
+// inside dir.
+func NewRecorder(dir string) router.MiddlewareFunc {
+	return func(ctx context.Context, emit router.Emitters) (router.Listeners, error) {
+		rec, err := Create(filepath.Join(dir, time.Now().UTC().Format("20060102T150405Z")))
+		if err != nil {
+			return router.Listeners{}, err
+		}
+
+		Logger.Infof("recording session to %s", rec.Dir)
+
+		samples := make(chan *router.CapturedSample, 100)
+		audio := make(chan *router.CapturedAudio, 100)
+		changes := make(chan *router.DocumentChange, 100)
+		speech := make(chan *router.SynthesizedAudio, 100)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			rec.Run(samples, audio, changes, speech)
+		}()
+
+		return router.Listeners{
+			CapturedSample:   samples,
+			CapturedAudio:    audio,
+			DocumentChange:   changes,
+			SynthesizedAudio: speech,
+			Done:             done,
+		}, nil
+	}
+}
+
+// Create starts a new session in dir, which must not already contain one.
+func Create(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	events, err := os.OpenFile(filepath.Join(dir, eventsFile), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	samples, err := createPCM(dir, samplesFile)
+	if err != nil {
+		events.Close()
+		return nil, err
+	}
+
+	audio, err := createPCM(dir, audioFile)
+	if err != nil {
+		events.Close()
+		samples.Close()
+		return nil, err
+	}
+
+	speech, err := createPCM(dir, speechFile)
+	if err != nil {
+		events.Close()
+		samples.Close()
+		audio.Close()
+		return nil, err
+	}
+
+	w := bufio.NewWriter(events)
+	rec := &Recorder{
+		Dir:     dir,
+		start:   time.Now(),
+		events:  events,
+		w:       w,
+		enc:     json.NewEncoder(w),
+		samples: samples,
+		audio:   audio,
+		speech:  speech,
+	}
+
+	if err := rec.write(&Event{Type: EventSession, StartedAt: rec.start.Unix()}); err != nil {
+		rec.Close()
+		return nil, err
+	}
+
+	return rec, nil
+}
+
+// Run records from the given streams until they are all closed, then closes the
+// recorder.
+func (r *Recorder) Run(samples <-chan *router.CapturedSample, audio <-chan *router.CapturedAudio, changes <-chan *router.DocumentChange, speech <-chan *router.SynthesizedAudio) {
+	defer func() {
+		if err := r.Close(); err != nil {
+			Logger.Error(err, "error closing session recording")
+		}
+	}()
+
+	// Flush regularly so that a crash loses at most a second of events.
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for samples != nil || audio != nil || changes != nil || speech != nil {
+		var err error
+		select {
+		case s, ok := <-samples:
+			if !ok {
+				samples = nil
+				continue
+			}
+			err = r.RecordCapturedSample(s)
+		case a, ok := <-audio:
+			if !ok {
+				audio = nil
+				continue
+			}
+			err = r.RecordCapturedAudio(a)
+		case c, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			err = r.RecordChange(c)
+		case a, ok := <-speech:
+			if !ok {
+				speech = nil
+				continue
+			}
+			err = r.RecordSynthesizedAudio(a)
+		case <-ticker.C:
+			err = r.w.Flush()
+		}
+
+		if err != nil {
+			Logger.Error(err, "error recording session")
+		}
+	}
+}
+
+func (r *Recorder) RecordCapturedSample(s *router.CapturedSample) error {
+	ref, err := r.samples.write(s.PCM)
+	if err != nil {
+		return err
+	}
+	return r.write(&Event{Type: EventCapturedSample, PCM: ref, CapturedSample: s})
+}
+
+func (r *Recorder) RecordCapturedAudio(a *router.CapturedAudio) error {
+	ref, err := r.audio.write(a.PCM)
+	if err != nil {
+		return err
+	}
+	return r.write(&Event{Type: EventCapturedAudio, PCM: ref, CapturedAudio: a})
+}
+
+func (r *Recorder) RecordSynthesizedAudio(a *router.SynthesizedAudio) error {
+	ref, err := r.speech.write(a.PCM)
+	if err != nil {
+		return err
+	}
+	return r.write(&Event{Type: EventSynthesizedAudio, PCM: ref, SynthesizedAudio: a})
+}
+
+func (r *Recorder) RecordChange(c *router.DocumentChange) error {
+	if c.Kind == router.TranscriptionRemoved {
+		return r.write(&Event{Type: EventTranscriptionRemoved, ID: c.ID()})
+	}
+	return r.write(&Event{Type: EventTranscription, Transcription: c.Transcription})
+}
+
+func (r *Recorder) write(e *Event) error {
+	e.At = time.Since(r.start)
+	return r.enc.Encode(e)
+}
+
+// Close flushes and closes every file of the session.
+func (r *Recorder) Close() error {
+	return errors.Join(
+		r.w.Flush(),
+		r.events.Close(),
+		r.samples.Close(),
+		r.audio.Close(),
+		r.speech.Close(),
+	)
+}
@@ -0,0 +1,151 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+type ReplayConfig struct {
+	// Speed scales playback: 1 replays in real time, 2 twice as fast. 0 replays as
+	// fast as possible.
+	Speed float64
+
+	// Which recorded streams to emit. Replaying captured samples runs VAD and
+	// everything after it again, replaying captured audio skips VAD, and replaying
+	// transcriptions reproduces the recorded document.
+	CapturedSamples bool
+	CapturedAudio   bool
+	Transcriptions  bool
+}
+
+// NewReplayer returns a middleware that feeds the session recorded in dir back into
+// the router.
+func NewReplayer(dir string, config ReplayConfig) router.MiddlewareFunc {
+	return func(ctx context.Context, emit router.Emitters) (router.Listeners, error) {
+		if _, err := os.Stat(filepath.Join(dir, eventsFile)); err != nil {
+			return router.Listeners{}, fmt.Errorf("no session to replay: %w", err)
+		}
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+
+			Logger.Infof("replaying session from %s at speed %v", dir, config.Speed)
+			if err := Replay(ctx, dir, config, emit); err != nil && !errors.Is(err, context.Canceled) {
+				Logger.Error(err, "error replaying session", "dir", dir)
+				return
+			}
+			Logger.Infof("finished replaying session from %s", dir)
+		}()
+
+		return router.Listeners{
+			Done: done,
+		}, nil
+	}
+}
+
+// Replay emits the events of the session in dir, paced according to config.Speed,
+// until the session ends or ctx is done.
+func Replay(ctx context.Context, dir string, config ReplayConfig, emit router.Emitters) error {
+	f, err := os.Open(filepath.Join(dir, eventsFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	files := map[string]*os.File{}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	begin := time.Now()
+	dec := json.NewDecoder(f)
+	for {
+		var e Event
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		var send func() error
+		switch {
+		case e.Type == EventCapturedSample && config.CapturedSamples:
+			send = func() error {
+				pcm, err := readPCM(files, dir, e.PCM)
+				if err != nil {
+					return err
+				}
+				e.CapturedSample.PCM = pcm
+				return sendContext(ctx, emit.CapturedSample, e.CapturedSample)
+			}
+		case e.Type == EventCapturedAudio && config.CapturedAudio:
+			send = func() error {
+				pcm, err := readPCM(files, dir, e.PCM)
+				if err != nil {
+					return err
+				}
+				e.CapturedAudio.PCM = pcm
+				return sendContext(ctx, emit.CapturedAudio, e.CapturedAudio)
+			}
+		case e.Type == EventTranscription && config.Transcriptions:
+			send = func() error {
+				return sendContext(ctx, emit.Transcription, e.Transcription)
+			}
+		case e.Type == EventTranscriptionRemoved && config.Transcriptions:
+			send = func() error {
+				return sendContext(ctx, emit.RemoveTranscription, e.ID)
+			}
+		default:
+			continue
+		}
+
+		if config.Speed > 0 {
+			at := begin.Add(time.Duration(float64(e.At) / config.Speed))
+			if err := sleepUntil(ctx, at); err != nil {
+				return err
+			}
+		}
+
+		if err := send(); err != nil {
+			return err
+		}
+	}
+}
+
+func sendContext[T any](ctx context.Context, ch chan<- T, v T) error {
+	select {
+	case ch <- v:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	rec, err := Create(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sample := &router.CapturedSample{PCM: []float32{0.1, -0.2, 0.3}, EndTimestamp: 60}
+	audio := &router.CapturedAudio{ID: "w", PCM: []float32{0.5, 0.25}, Final: true, StartTimestamp: 10, EndTimestamp: 60}
+	transcription := &router.Transcription{ID: "w/transcription", Final: true, StartTimestamp: 10, EndTimestamp: 60}
+
+	for _, err := range []error{
+		rec.RecordCapturedSample(sample),
+		rec.RecordCapturedAudio(audio),
+		rec.RecordChange(&router.DocumentChange{Kind: router.TranscriptionAdded, Transcription: transcription}),
+		rec.RecordChange(&router.DocumentChange{Kind: router.TranscriptionRemoved, Previous: transcription}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	samples := make(chan *router.CapturedSample, 10)
+	audios := make(chan *router.CapturedAudio, 10)
+	transcriptions := make(chan *router.Transcription, 10)
+	removals := make(chan string, 10)
+	emit := router.Emitters{
+		CapturedSample:      samples,
+		CapturedAudio:       audios,
+		Transcription:       transcriptions,
+		RemoveTranscription: removals,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = Replay(ctx, dir, ReplayConfig{
+		Speed:           100,
+		CapturedSamples: true,
+		CapturedAudio:   true,
+		Transcriptions:  true,
+	}, emit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := <-samples; !reflect.DeepEqual(got, sample) {
+		t.Errorf("replayed sample %+v, want %+v", got, sample)
+	}
+	if got := <-audios; !reflect.DeepEqual(got, audio) {
+		t.Errorf("replayed audio %+v, want %+v", got, audio)
+	}
+	if got := <-transcriptions; got.ID != transcription.ID || !got.Final {
+		t.Errorf("replayed transcription %+v, want %+v", got, transcription)
+	}
+	if got := <-removals; got != transcription.ID {
+		t.Errorf("replayed removal of %q, want %q", got, transcription.ID)
+	}
+}
+
+func TestReplaySelectsStreams(t *testing.T) {
+	dir := t.TempDir()
+
+	rec, err := Create(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.RecordCapturedSample(&router.CapturedSample{PCM: []float32{1}})
+	rec.RecordChange(&router.DocumentChange{Kind: router.TranscriptionAdded, Transcription: &router.Transcription{ID: "t"}})
+	rec.Close()
+
+	samples := make(chan *router.CapturedSample, 10)
+	err = Replay(context.Background(), dir, ReplayConfig{CapturedSamples: true}, router.Emitters{
+		CapturedSample: samples,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(samples) != 1 {
+		t.Errorf("replayed %d samples, want 1", len(samples))
+	}
+}
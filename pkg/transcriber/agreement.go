@@ -0,0 +1,229 @@
+package transcriber
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+const (
+	sampleRate = 16000
+
+	// minTail is how much new audio, in seconds, a draft needs past the committed
+	// words to be worth transcribing.
+	minTail = 0.5
+	// maxOverlap is how many words at the start of a hypothesis are checked for
+	// repeating the end of the committed ones, which happens when the audio is cut
+	// in the middle of a word.
+	maxOverlap = 5
+)
+
+// utterance is the transcription of the growing window of audio the VAD passes
+// along until whoever is speaking stops. Words that two hypotheses in a row agree on
+// are committed, and from then on only the audio after them is transcribed again,
+// with their text as the prompt.
+type utterance struct {
+	// committed holds the words hypotheses agreed on, and tentative the rest of the
+	// latest hypothesis. Times are in seconds from the start of the audio.
+	committed []word
+	tentative []word
+	// offset is where the audio after the committed words starts, in seconds.
+	offset float32
+
+	language            string
+	languageProbability float32
+
+	// end is the media time the latest audio ended at.
+	end uint64
+}
+
+// word is a word of a hypothesis along with the segment it came in. Segments
+// without word timings make up a single word.
+type word struct {
+	router.Word
+	segment *router.TranscriptionSegment
+	whole   bool
+}
+
+// request returns the request to transcribe audio with, or nil if there's nothing
+// new to transcribe.
+func (u *utterance) request(audio *router.CapturedAudio) *router.TranscriptionRequest {
+	start := int(u.offset * sampleRate)
+	if start > len(audio.PCM) {
+		start = len(audio.PCM)
+	}
+	tail := audio.PCM[start:]
+	if !audio.Final && float32(len(tail)) < minTail*sampleRate {
+		return nil
+	}
+	if len(tail) == 0 {
+		return nil
+	}
+
+	request := &router.TranscriptionRequest{
+		Audio: &router.Audio{
+			Waveform:   tail,
+			SampleRate: sampleRate,
+		},
+		Task: "transcribe",
+	}
+	if len(u.committed) > 0 {
+		prompt := strings.TrimSpace(text(u.committed))
+		request.Prompt = &prompt
+		// A short tail is easily mistaken for another language.
+		if u.language != "" {
+			request.SourceLanguage = &u.language
+		}
+	}
+	return request
+}
+
+// update takes in the response to the latest request, if there was one, and returns
+// the transcription of the whole audio so far. Final audio commits everything.
+func (u *utterance) update(audio *router.CapturedAudio, response *router.TranscriptionResponse) *router.TranscriptionResponse {
+	u.end = audio.EndTimestamp
+
+	if response != nil {
+		if u.language == "" {
+			u.language = response.SourceLanguage
+			u.languageProbability = response.SourceLanguageProbability
+		}
+
+		hypothesis := u.dropOverlap(words(response.Segments, u.offset))
+		n := len(hypothesis)
+		if !audio.Final {
+			n = agree(u.tentative, hypothesis)
+		}
+		u.commit(hypothesis[:n])
+		u.tentative = hypothesis[n:]
+	}
+	if audio.Final {
+		// Whatever is left is as good as it gets.
+		u.commit(u.tentative)
+		u.tentative = nil
+	}
+
+	return &router.TranscriptionResponse{
+		SourceLanguage:            u.language,
+		SourceLanguageProbability: u.languageProbability,
+		TargetLanguage:            u.language,
+		Duration:                  float32(len(audio.PCM)) / sampleRate,
+		Segments:                  u.segments(!audio.Final),
+	}
+}
+
+func (u *utterance) commit(words []word) {
+	if len(words) == 0 {
+		return
+	}
+	u.committed = append(u.committed, words...)
+	if end := words[len(words)-1].End; end > u.offset {
+		u.offset = end
+	}
+}
+
+// dropOverlap drops words at the start of hypothesis that repeat the last committed
+// ones.
+func (u *utterance) dropOverlap(hypothesis []word) []word {
+	if len(hypothesis) == 0 || len(u.committed) == 0 || hypothesis[0].Start > u.offset+1 {
+		return hypothesis
+	}
+	for n := maxOverlap; n > 0; n-- {
+		if n > len(hypothesis) || n > len(u.committed) {
+			continue
+		}
+		if agree(u.committed[len(u.committed)-n:], hypothesis[:n]) == n {
+			return hypothesis[n:]
+		}
+	}
+	return hypothesis
+}
+
+// segments returns the committed and tentative words as segments. Committed words
+// are marked stable in drafts.
+func (u *utterance) segments(draft bool) []router.TranscriptionSegment {
+	var segments []router.TranscriptionSegment
+	// last is the segment the latest word came in, which the next may continue.
+	var last *router.TranscriptionSegment
+	add := func(words []word, stable bool) {
+		for _, w := range words {
+			if w.whole {
+				segments = append(segments, *w.segment)
+				last = nil
+				continue
+			}
+			if w.segment != last {
+				s := *w.segment
+				s.Start = w.Start
+				s.Text = ""
+				segments = append(segments, s)
+				last = w.segment
+			}
+			s := &segments[len(segments)-1]
+			ww := w.Word
+			ww.Stable = stable
+			s.Words = append(s.Words, ww)
+			s.Text += ww.Word
+			s.End = ww.End
+		}
+	}
+	add(u.committed, draft)
+	add(u.tentative, false)
+	return segments
+}
+
+// words flattens segments into words, moving them offset seconds later.
+func words(segments []router.TranscriptionSegment, offset float32) []word {
+	var out []word
+	for i := range segments {
+		s := segments[i]
+		s.Start += offset
+		s.End += offset
+		if len(s.Words) == 0 {
+			if strings.TrimSpace(s.Text) == "" {
+				continue
+			}
+			out = append(out, word{
+				Word:    router.Word{Start: s.Start, End: s.End, Word: s.Text},
+				segment: &s,
+				whole:   true,
+			})
+			continue
+		}
+
+		ws := s.Words
+		s.Words = nil
+		for _, w := range ws {
+			w.Start += offset
+			w.End += offset
+			out = append(out, word{Word: w, segment: &s})
+		}
+	}
+	return out
+}
+
+// agree returns how many words a and b start with in common.
+func agree(a, b []word) int {
+	n := 0
+	for n < len(a) && n < len(b) && normalize(a[n].Word.Word) == normalize(b[n].Word.Word) {
+		n++
+	}
+	return n
+}
+
+// normalize ignores the case and punctuation of a word, which Whisper easily
+// changes its mind about as more audio comes in.
+func normalize(w string) string {
+	return strings.ToLower(strings.TrimFunc(w, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	}))
+}
+
+func text(words []word) string {
+	var b strings.Builder
+	for _, w := range words {
+		b.WriteString(w.Word.Word)
+	}
+	return b.String()
+}
@@ -0,0 +1,77 @@
+package transcriber
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Stats counts what transcribers did with the audio they were given.
+type Stats struct {
+	// Received counts windows of audio, drafts and finals alike.
+	Received uint64 `json:"received"`
+	// Transcribed counts requests sent to the backend, and Failed those that
+	// failed.
+	Transcribed uint64 `json:"transcribed"`
+	Failed      uint64 `json:"failed"`
+	// Superseded counts drafts that newer audio for the same window replaced before
+	// they were transcribed, and Unchanged those with too little new audio to be
+	// worth transcribing.
+	Superseded uint64 `json:"superseded"`
+	Unchanged  uint64 `json:"unchanged"`
+	// Echoes counts windows dropped for being an echo of the session.
+	Echoes uint64 `json:"echoes"`
+
+	// Pending is how many windows are waiting for a turn, and InFlight how many are
+	// being transcribed.
+	Pending  int64 `json:"pending"`
+	InFlight int64 `json:"in_flight"`
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("received=%d transcribed=%d failed=%d superseded=%d unchanged=%d echoes=%d pending=%d in_flight=%d",
+		s.Received, s.Transcribed, s.Failed, s.Superseded, s.Unchanged, s.Echoes, s.Pending, s.InFlight)
+}
+
+// Metrics keeps Stats. It can be shared by the transcribers of several rooms.
+type Metrics struct {
+	received    atomic.Uint64
+	transcribed atomic.Uint64
+	failed      atomic.Uint64
+	superseded  atomic.Uint64
+	unchanged   atomic.Uint64
+	echoes      atomic.Uint64
+	pending     atomic.Int64
+	inFlight    atomic.Int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// Stats returns a snapshot of the counters.
+func (m *Metrics) Stats() Stats {
+	return Stats{
+		Received:    m.received.Load(),
+		Transcribed: m.transcribed.Load(),
+		Failed:      m.failed.Load(),
+		Superseded:  m.superseded.Load(),
+		Unchanged:   m.unchanged.Load(),
+		Echoes:      m.echoes.Load(),
+		Pending:     m.pending.Load(),
+		InFlight:    m.inFlight.Load(),
+	}
+}
+
+// ServeHTTP serves the stats as JSON.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m.Stats()); err != nil {
+		fmt.Printf("error writing response: %s\n", err)
+	}
+}
@@ -0,0 +1,45 @@
+package transcriber
+
+import (
+	"sync"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+// Speakers remembers the label of every participant seen in a Status, so audio can
+// be attributed to whoever it was captured from.
+type Speakers struct {
+	mu     sync.Mutex
+	labels map[string]string
+}
+
+func NewSpeakers() *Speakers {
+	return &Speakers{labels: map[string]string{}}
+}
+
+// Watch records participant labels from statuses until the channel is closed.
+// Participants who leave are remembered, since their audio may still be in flight.
+func (s *Speakers) Watch(statuses <-chan *router.Status) {
+	for status := range statuses {
+		if status.Participants == nil {
+			continue
+		}
+
+		s.mu.Lock()
+		for _, p := range *status.Participants {
+			s.labels[p.ID] = p.Label
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Label returns the label of source, or "Unknown" if it was never seen.
+func (s *Speakers) Label(source string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if label, ok := s.labels[source]; ok && label != "" {
+		return label
+	}
+	return "Unknown"
+}
@@ -8,65 +8,307 @@ import (
 	"github.com/ajbouh/bridge/pkg/router"
 )
 
+type Config struct {
+	// Concurrency is how many windows of audio are transcribed at once. Versions of
+	// the same window are always transcribed one after the other.
+	Concurrency int
+	// Metrics, if set, counts what was done with the audio.
+	Metrics *Metrics
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Concurrency: 4,
+	}
+}
+
 func New(url string) (router.MiddlewareFunc, error) {
-	transcriber, err := asr.NewClient(url)
+	transcriber, err := asr.NewBackend(url)
 	if err != nil {
 		return nil, err
 	}
+	return NewWithBackend(transcriber), nil
+}
+
+// NewWithBackend returns a transcriber that uses transcriber, which can be shared
+// with others.
+func NewWithBackend(transcriber asr.Backend) router.MiddlewareFunc {
+	return NewWithConfig(transcriber, DefaultConfig())
+}
 
+func NewWithConfig(transcriber asr.Backend, config Config) router.MiddlewareFunc {
 	return func(ctx context.Context, emit router.Emitters) (router.Listeners, error) {
 		listener := make(chan *router.CapturedAudio, 100)
-		go Run(transcriber, emit.Transcription, listener)
+		status := make(chan *router.Status, 100)
+		speakers := NewSpeakers()
+		go speakers.Watch(status)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			RunWithConfig(config, transcriber, speakers, emit.Transcription, emit.RemoveTranscription, listener)
+		}()
 
 		return router.Listeners{
 			CapturedAudio: listener,
+			Status:        status,
+			Done:          done,
 		}, nil
-	}, nil
+	}
+}
+
+// staleUtterance is how long, in milliseconds of media time, the transcription of
+// audio that was never finalized is kept around.
+const staleUtterance = 60 * 1000
 
+func Run(s asr.Backend, speakers *Speakers, transcriptionStream chan<- *router.Transcription, removals chan<- string, audioStream <-chan *router.CapturedAudio) {
+	RunWithConfig(DefaultConfig(), s, speakers, transcriptionStream, removals, audioStream)
 }
 
-func Run(s *asr.Client, transcriptionStream chan<- *router.Transcription, audioStream <-chan *router.CapturedAudio) {
-	for audio := range audioStream {
-		// we have not been speaking for at least 500ms now so lets run inference
-		fmt.Printf("transcribing with %d window length\n", len(audio.PCM))
-
-		response, err := s.Transcribe(&router.TranscriptionRequest{
-			Audio: &router.Audio{
-				Waveform:   audio.PCM,
-				SampleRate: 16000,
-			},
-			Task: "transcribe",
-		})
-
-		if err != nil {
-			fmt.Printf("error transcribing: %s\n", err)
-			continue
+// RunWithConfig transcribes audio until audioStream is closed and everything
+// received has been transcribed. When audio comes in faster than it can be
+// transcribed, only the latest version of each window is, and a final version is
+// never replaced by a draft.
+func RunWithConfig(config Config, s asr.Backend, speakers *Speakers, transcriptionStream chan<- *router.Transcription, removals chan<- string, audioStream <-chan *router.CapturedAudio) {
+	r := &run{
+		config:              config,
+		backend:             s,
+		speakers:            speakers,
+		transcriptionStream: transcriptionStream,
+		removals:            removals,
+		windows:             map[string]*window{},
+		results:             make(chan result),
+	}
+	if r.config.Concurrency < 1 {
+		r.config.Concurrency = 1
+	}
+	if r.config.Metrics == nil {
+		r.config.Metrics = NewMetrics()
+	}
+
+	for {
+		r.dispatch()
+		if audioStream == nil && r.inFlight == 0 {
+			return
 		}
 
-		final := audio.Final
+		select {
+		case audio, ok := <-audioStream:
+			if !ok {
+				audioStream = nil
+				continue
+			}
+			r.receive(audio)
+		case res := <-r.results:
+			r.finish(res)
+		}
+	}
+}
 
-		transcript := &router.Transcription{
-			ID:    audio.ID + "/transcription",
-			Final: final,
+// window is the audio of one ID.
+type window struct {
+	utterance
+
+	// pending is the latest version of the audio that hasn't been transcribed yet,
+	// if any, and busy is set while an earlier one is being transcribed.
+	pending *router.CapturedAudio
+	busy    bool
+	// final is set once the final version came in. Drafts after it are dropped.
+	final bool
+}
 
-			AudioSources:   []*router.CapturedAudio{audio},
-			StartTimestamp: audio.StartTimestamp,
-			EndTimestamp:   audio.EndTimestamp,
+type result struct {
+	window   *window
+	audio    *router.CapturedAudio
+	response *router.TranscriptionResponse
+	err      error
+}
+
+type run struct {
+	config              Config
+	backend             asr.Backend
+	speakers            *Speakers
+	transcriptionStream chan<- *router.Transcription
+	removals            chan<- string
+
+	windows map[string]*window
+	// queue holds the IDs of windows with pending audio, in the order they got it.
+	queue    []string
+	results  chan result
+	inFlight int
+}
 
-			Language:            response.SourceLanguage,
-			LanguageProbability: response.SourceLanguageProbability,
-			Duration:            response.Duration,
-			AllLanguageProbs:    nil,
+func (r *run) receive(audio *router.CapturedAudio) {
+	metrics := r.config.Metrics
+	metrics.received.Add(1)
 
-			// Reusing!
-			Segments: response.Segments,
+	if audio.EchoOf != "" {
+		// Nobody said this, it's the session coming back through a microphone.
+		// Drop whatever we made of it before it was recognized, including what's
+		// still being transcribed.
+		fmt.Printf("not transcribing %s, it's an echo of %s\n", audio.ID, audio.EchoOf)
+		metrics.echoes.Add(1)
+		if w, ok := r.windows[audio.ID]; ok && w.pending != nil {
+			r.dequeue(audio.ID)
 		}
+		delete(r.windows, audio.ID)
+		r.removals <- audio.ID + "/transcription"
+		return
+	}
 
-		for i := range transcript.Segments {
-			transcript.Segments[i].Speaker = "Unknown"
-			transcript.Segments[i].IsAssistant = false
+	for id, w := range r.windows {
+		if !w.busy && w.pending == nil && w.end+staleUtterance < audio.StartTimestamp {
+			delete(r.windows, id)
 		}
+	}
 
-		transcriptionStream <- transcript
+	w, ok := r.windows[audio.ID]
+	if !ok {
+		w = &window{}
+		r.windows[audio.ID] = w
 	}
+
+	switch {
+	case w.final && !audio.Final:
+		fmt.Printf("not transcribing draft of %s, its final audio came in already\n", audio.ID)
+		metrics.superseded.Add(1)
+		return
+	case w.pending != nil:
+		fmt.Printf("skipping draft of %s, newer audio came in before it was transcribed\n", audio.ID)
+		metrics.superseded.Add(1)
+	default:
+		r.queue = append(r.queue, audio.ID)
+		metrics.pending.Add(1)
+	}
+	w.pending = audio
+	w.final = audio.Final
+}
+
+// dispatch starts transcribing pending windows, finals first, until there are as
+// many requests in flight as allowed.
+func (r *run) dispatch() {
+	metrics := r.config.Metrics
+	for r.inFlight < r.config.Concurrency {
+		id, ok := r.next()
+		if !ok {
+			return
+		}
+		r.dequeue(id)
+		w := r.windows[id]
+		audio := w.pending
+		w.pending = nil
+
+		request := w.request(audio)
+		if request == nil {
+			if audio.Final {
+				r.emit(w, audio, nil)
+			} else {
+				metrics.unchanged.Add(1)
+			}
+			continue
+		}
+
+		// we have not been speaking for at least 500ms now so lets run inference
+		fmt.Printf("transcribing %d of %d samples in window\n", len(request.Audio.Waveform), len(audio.PCM))
+		w.busy = true
+		r.inFlight++
+		metrics.inFlight.Add(1)
+		metrics.transcribed.Add(1)
+		go func() {
+			// The middleware's context is cancelled as soon as shutdown starts, but
+			// audio that was already captured should still be transcribed, so requests
+			// only give up on the client's own timeouts.
+			response, err := r.backend.Transcribe(context.Background(), request)
+			r.results <- result{window: w, audio: audio, response: response, err: err}
+		}()
+	}
+}
+
+// next returns the first window in the queue that isn't being transcribed, giving
+// precedence to final audio.
+func (r *run) next() (string, bool) {
+	first := ""
+	for _, id := range r.queue {
+		w := r.windows[id]
+		if w.busy {
+			continue
+		}
+		if w.pending.Final {
+			return id, true
+		}
+		if first == "" {
+			first = id
+		}
+	}
+	return first, first != ""
+}
+
+func (r *run) dequeue(id string) {
+	for i, queued := range r.queue {
+		if queued == id {
+			r.queue = append(r.queue[:i], r.queue[i+1:]...)
+			r.config.Metrics.pending.Add(-1)
+			return
+		}
+	}
+}
+
+func (r *run) finish(res result) {
+	metrics := r.config.Metrics
+	res.window.busy = false
+	r.inFlight--
+	metrics.inFlight.Add(-1)
+
+	if r.windows[res.audio.ID] != res.window {
+		// It turned out to be an echo while it was being transcribed.
+		return
+	}
+
+	response := res.response
+	if res.err != nil {
+		fmt.Printf("error transcribing: %s\n", res.err)
+		metrics.failed.Add(1)
+		// The final transcription makes do with what we have so far.
+		if !res.audio.Final {
+			return
+		}
+		response = nil
+	}
+	r.emit(res.window, res.audio, response)
+}
+
+func (r *run) emit(w *window, audio *router.CapturedAudio, response *router.TranscriptionResponse) {
+	if audio.Final {
+		delete(r.windows, audio.ID)
+	}
+
+	response = w.update(audio, response)
+	if len(response.Segments) == 0 && !audio.Final {
+		return
+	}
+
+	transcript := &router.Transcription{
+		ID:    audio.ID + "/transcription",
+		Final: audio.Final,
+
+		AudioSources:   []*router.CapturedAudio{audio},
+		StartTimestamp: audio.StartTimestamp,
+		EndTimestamp:   audio.EndTimestamp,
+
+		Language:            response.SourceLanguage,
+		LanguageProbability: response.SourceLanguageProbability,
+		Duration:            response.Duration,
+		AllLanguageProbs:    nil,
+
+		// Reusing!
+		Segments: response.Segments,
+	}
+
+	speaker := r.speakers.Label(audio.Source)
+	for i := range transcript.Segments {
+		transcript.Segments[i].Speaker = speaker
+		transcript.Segments[i].IsAssistant = false
+	}
+
+	r.transcriptionStream <- transcript
 }
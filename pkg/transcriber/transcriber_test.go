@@ -0,0 +1,234 @@
+package transcriber
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+// script is a backend hearing "one two three four five six", a word every half
+// second. Samples hold their own index, so it knows which part of the utterance it
+// was sent. The last word it hears is garbled unless the audio runs on well past it.
+type script struct {
+	prompts []string
+	samples []int
+}
+
+var scriptWords = strings.Fields("one two three four five six")
+
+func (s *script) Transcribe(ctx context.Context, request *router.TranscriptionRequest) (*router.TranscriptionResponse, error) {
+	pcm := request.Audio.Waveform
+	start := float32(pcm[0]) / sampleRate
+	end := start + float32(len(pcm))/sampleRate
+
+	prompt := ""
+	if request.Prompt != nil {
+		prompt = *request.Prompt
+	}
+	s.prompts = append(s.prompts, prompt)
+	s.samples = append(s.samples, len(pcm))
+
+	segment := router.TranscriptionSegment{}
+	for i, w := range scriptWords {
+		wordStart, wordEnd := float32(i)*0.5, float32(i)*0.5+0.4
+		if wordStart < start || wordEnd > end {
+			continue
+		}
+		if end-wordEnd < 0.2 {
+			w = "maybe"
+		}
+		segment.Words = append(segment.Words, router.Word{Start: wordStart - start, End: wordEnd - start, Word: " " + w})
+		segment.Text += " " + w
+	}
+	return &router.TranscriptionResponse{SourceLanguage: "en", Segments: []router.TranscriptionSegment{segment}}, nil
+}
+
+func TestTranscriberCommitsAgreedWords(t *testing.T) {
+	backend := &script{}
+	audio := make(chan *router.CapturedAudio)
+	transcriptions := make(chan *router.Transcription, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Run(backend, NewSpeakers(), transcriptions, make(chan string), audio)
+	}()
+
+	capture := func(seconds float32, final bool) (stable, tentative []string) {
+		pcm := make([]float32, int(seconds*sampleRate))
+		for i := range pcm {
+			pcm[i] = float32(i)
+		}
+		audio <- &router.CapturedAudio{ID: "utterance", PCM: pcm, Final: final}
+		tr := <-transcriptions
+		if tr.Final != final {
+			t.Fatalf("transcription final %v, want %v", tr.Final, final)
+		}
+		for _, s := range tr.Segments {
+			for _, w := range s.Words {
+				if w.Stable {
+					if len(tentative) > 0 {
+						t.Errorf("stable %q after tentative %q", w.Word, tentative)
+					}
+					stable = append(stable, strings.TrimSpace(w.Word))
+				} else {
+					tentative = append(tentative, strings.TrimSpace(w.Word))
+				}
+			}
+		}
+		return stable, tentative
+	}
+
+	testCases := []struct {
+		seconds   float32
+		stable    []string
+		tentative []string
+	}{
+		{1.0, nil, []string{"one", "maybe"}},
+		{1.5, []string{"one"}, []string{"two", "maybe"}},
+		{2.0, []string{"one", "two"}, []string{"three", "maybe"}},
+		{2.5, []string{"one", "two", "three"}, []string{"four", "maybe"}},
+	}
+	for _, tc := range testCases {
+		stable, tentative := capture(tc.seconds, false)
+		if !reflect.DeepEqual(stable, tc.stable) || !reflect.DeepEqual(tentative, tc.tentative) {
+			t.Errorf("%gs: stable %q and tentative %q, want %q and %q", tc.seconds, stable, tentative, tc.stable, tc.tentative)
+		}
+	}
+
+	stable, words := capture(3.2, true)
+	if want := scriptWords; len(stable) != 0 || !reflect.DeepEqual(words, want) {
+		t.Errorf("final transcription %q (stable %q), want %q", words, stable, want)
+	}
+
+	// Only the audio after the committed words was sent again, with them as the
+	// prompt.
+	wantPrompts := []string{"", "", "one", "one two", "one two three"}
+	if !reflect.DeepEqual(backend.prompts, wantPrompts) {
+		t.Errorf("prompts %q, want %q", backend.prompts, wantPrompts)
+	}
+	wantSamples := []int{16000, 24000, 25600, 25600, 28800}
+	if !reflect.DeepEqual(backend.samples, wantSamples) {
+		t.Errorf("requests sent %v samples, want %v", backend.samples, wantSamples)
+	}
+
+	close(audio)
+	<-done
+}
+
+// gate is a backend that holds on to each request until it's released, after
+// telling which one it got by the value of its first sample.
+type gate struct {
+	started chan float32
+	release chan struct{}
+}
+
+func newGate() *gate {
+	return &gate{started: make(chan float32), release: make(chan struct{})}
+}
+
+func (g *gate) Transcribe(ctx context.Context, request *router.TranscriptionRequest) (*router.TranscriptionResponse, error) {
+	g.started <- request.Audio.Waveform[0]
+	<-g.release
+	return &router.TranscriptionResponse{
+		SourceLanguage: "en",
+		Segments: []router.TranscriptionSegment{{
+			Text:  " hello",
+			Words: []router.Word{{Start: 0, End: 0.4, Word: " hello"}},
+		}},
+	}, nil
+}
+
+func captured(id string, marker float32, seconds float32, final bool) *router.CapturedAudio {
+	pcm := make([]float32, int(seconds*sampleRate))
+	for i := range pcm {
+		pcm[i] = marker
+	}
+	return &router.CapturedAudio{ID: id, PCM: pcm, Final: final}
+}
+
+func TestTranscriberSkipsSupersededDrafts(t *testing.T) {
+	backend := newGate()
+	metrics := NewMetrics()
+	audio := make(chan *router.CapturedAudio)
+	transcriptions := make(chan *router.Transcription, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		config := Config{Concurrency: 1, Metrics: metrics}
+		RunWithConfig(config, backend, NewSpeakers(), transcriptions, make(chan string), audio)
+	}()
+
+	audio <- captured("a", 1, 1, false)
+	if got := <-backend.started; got != 1 {
+		t.Fatalf("started transcribing %v, want the first draft", got)
+	}
+	// These pile up while the first draft is being transcribed. Only the final is
+	// worth transcribing, and drafts after it never are.
+	audio <- captured("a", 2, 1.5, false)
+	audio <- captured("a", 3, 2, false)
+	audio <- captured("a", 4, 2.5, true)
+	audio <- captured("a", 5, 3, false)
+
+	backend.release <- struct{}{}
+	if tr := <-transcriptions; tr.Final {
+		t.Errorf("first transcription is final, want the draft")
+	}
+	if got := <-backend.started; got != 4 {
+		t.Fatalf("started transcribing %v, want the final audio", got)
+	}
+	backend.release <- struct{}{}
+	if tr := <-transcriptions; !tr.Final || len(tr.AudioSources[0].PCM) != 2.5*sampleRate {
+		t.Errorf("second transcription is of %d samples, final %v, want the final audio", len(tr.AudioSources[0].PCM), tr.Final)
+	}
+
+	close(audio)
+	<-done
+
+	want := Stats{Received: 5, Transcribed: 2, Superseded: 3}
+	if got := metrics.Stats(); got != want {
+		t.Errorf("stats %s, want %s", got, want)
+	}
+}
+
+func TestTranscriberLimitsConcurrency(t *testing.T) {
+	backend := newGate()
+	audio := make(chan *router.CapturedAudio)
+	transcriptions := make(chan *router.Transcription, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		config := Config{Concurrency: 2}
+		RunWithConfig(config, backend, NewSpeakers(), transcriptions, make(chan string), audio)
+	}()
+
+	audio <- captured("a", 1, 1, false)
+	audio <- captured("b", 2, 1, false)
+	audio <- captured("c", 3, 1, true)
+	// Different windows are transcribed side by side, up to the limit.
+	started := map[float32]bool{<-backend.started: true, <-backend.started: true}
+	if !started[1] || !started[2] {
+		t.Fatalf("started transcribing %v, want the first two windows", started)
+	}
+	select {
+	case got := <-backend.started:
+		t.Fatalf("started transcribing %v with two requests in flight", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	backend.release <- struct{}{}
+	if got := <-backend.started; got != 3 {
+		t.Fatalf("started transcribing %v, want the third window", got)
+	}
+	backend.release <- struct{}{}
+	backend.release <- struct{}{}
+
+	close(audio)
+	<-done
+	if len(transcriptions) != 3 {
+		t.Errorf("got %d transcriptions, want 3", len(transcriptions))
+	}
+}
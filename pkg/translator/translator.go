@@ -9,10 +9,16 @@ import (
 )
 
 func New(url string, useAudio bool, targetLanguage string, languageAliases ...string) (router.MiddlewareFunc, error) {
-	client, err := asr.NewClient(url)
+	client, err := asr.NewBackend(url)
 	if err != nil {
 		return nil, err
 	}
+	return NewWithBackend(client, useAudio, targetLanguage, languageAliases...), nil
+}
+
+// NewWithBackend returns a translator that uses client, which can be shared with
+// others.
+func NewWithBackend(client asr.Backend, useAudio bool, targetLanguage string, languageAliases ...string) router.MiddlewareFunc {
 
 	languageAliasesSet := map[string]bool{}
 	languageAliasesSet[targetLanguage] = true
@@ -25,7 +31,7 @@ func New(url string, useAudio bool, targetLanguage string, languageAliases ...st
 	if useAudio {
 		fn = func(t *router.Transcription) (*router.TranscriptionResponse, error) {
 			audioSources := t.AudioSources
-			return client.Transcribe(&router.TranscriptionRequest{
+			return client.Transcribe(context.Background(), &router.TranscriptionRequest{
 				Audio: &router.Audio{
 					Waveform:   audioSources[0].PCM,
 					SampleRate: 16000,
@@ -46,7 +52,7 @@ func New(url string, useAudio bool, targetLanguage string, languageAliases ...st
 					}
 				}
 			}
-			return client.Transcribe(&router.TranscriptionRequest{
+			return client.Transcribe(context.Background(), &router.TranscriptionRequest{
 				Text:           &text,
 				Task:           "translate",
 				TargetLanguage: &targetLanguage,
@@ -63,12 +69,22 @@ func New(url string, useAudio bool, targetLanguage string, languageAliases ...st
 			languageAliases: languageAliasesSet,
 			fn:              fn,
 		}
-		go s.Run(emit.Transcription, listener)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.Run(emit.Transcription, listener)
+		}()
 
 		return router.Listeners{
 			FinalDocument: listener,
+			Participant: &router.Participant{
+				ID:          "translator/" + targetLanguage,
+				Label:       "Translator (" + targetLanguage + ")",
+				IsAssistant: true,
+			},
+			Done: done,
 		}, nil
-	}, nil
+	}
 }
 
 type Translator struct {
@@ -77,6 +93,9 @@ type Translator struct {
 	languageAliases map[string]bool
 }
 
+// Run translates every final transcription in the documents from listener once.
+// People's speech overlaps, so transcriptions finalize out of order and any entry of
+// a document may be new, not just the last.
 func (s *Translator) Run(
 	transcriptionStream chan<- *router.Transcription,
 	listener <-chan router.Document,
@@ -84,75 +103,74 @@ func (s *Translator) Run(
 	observed := map[string]bool{}
 
 	for doc := range listener {
-		var t *router.Transcription
-		for i := len(doc.Transcriptions) - 1; i >= 0; i-- {
-			t = doc.Transcriptions[i]
+		for i := 0; i < doc.Len(); i++ {
+			t := doc.At(i)
 
-			if !t.Final {
+			// Only respond to things that aren't based on other parts of the transcript. This avoids loops.
+			if !t.Final || len(t.TranscriptSources) > 0 {
 				continue
 			}
 
-			break
-		}
+			if s.languageAliases[t.Language] || t.Language == "" || len(t.AudioSources) == 0 {
+				continue
+			}
 
-		// Only respond to things that aren't based on other parts of the transcript. This avoids loops.
-		if t == nil || len(t.TranscriptSources) > 0 {
-			continue
-		}
+			// we'll fall behind as we wait for an answer. don't try to respond to one of these messages after we've seen it.
+			if observed[t.ID] {
+				continue
+			}
 
-		if s.languageAliases[t.Language] || t.Language == "" || len(t.AudioSources) == 0 || t.TranscriptSources != nil {
-			continue
-		}
+			observed[t.ID] = true
 
-		// we'll fall behind as we wait for an answer. don't try to respond to one of these messages after we've seen it.
-		if observed[t.ID] {
-			continue
+			if transcript := s.translate(t); transcript != nil {
+				transcriptionStream <- transcript
+			}
 		}
+	}
+}
 
-		observed[t.ID] = true
-
-		audioSources := t.AudioSources
-		response, err := s.fn(t)
+func (s *Translator) translate(t *router.Transcription) *router.Transcription {
+	audioSources := t.AudioSources
+	response, err := s.fn(t)
 
-		if err != nil {
-			fmt.Printf("error transcribing: %s\n", err)
-			continue
-		}
+	if err != nil {
+		fmt.Printf("error transcribing: %s\n", err)
+		return nil
+	}
 
-		final := t.Final
-		for _, a := range audioSources {
-			if !a.Final {
-				final = false
-			}
+	final := t.Final
+	for _, a := range audioSources {
+		if !a.Final {
+			final = false
 		}
+	}
 
-		transcript := &router.Transcription{
-			ID:    t.ID + s.idSuffix,
-			Final: final,
-
-			AudioSources:   audioSources,
-			StartTimestamp: audioSources[0].StartTimestamp,
-			EndTimestamp:   audioSources[0].EndTimestamp,
+	transcript := &router.Transcription{
+		ID:    t.ID + s.idSuffix,
+		Final: final,
 
-			Language:            response.TargetLanguage,
-			LanguageProbability: 1,
-			Duration:            response.Duration,
-			AllLanguageProbs:    nil,
+		AudioSources:   audioSources,
+		StartTimestamp: audioSources[0].StartTimestamp,
+		EndTimestamp:   audioSources[0].EndTimestamp,
 
-			// Reusing!
-			Segments: response.Segments,
-		}
+		Language:            response.TargetLanguage,
+		LanguageProbability: 1,
+		Duration:            response.Duration,
+		AllLanguageProbs:    nil,
 
-		fmt.Printf("Foreign language detected language=%s translating to English...\n", t.Language)
+		// Reusing!
+		Segments: response.Segments,
+	}
 
-		transcript.TranscriptSources = []*router.Transcription{t}
-		transcript.AllLanguageProbs = nil
+	fmt.Printf("Foreign language detected language=%s translating to English...\n", t.Language)
 
-		for i := range transcript.Segments {
-			transcript.Segments[i].Speaker = "Translator (" + transcript.Language + ")"
-			transcript.Segments[i].IsAssistant = true
-		}
+	transcript.TranscriptSources = []*router.Transcription{t}
+	transcript.AllLanguageProbs = nil
 
-		transcriptionStream <- transcript
+	for i := range transcript.Segments {
+		transcript.Segments[i].Speaker = "Translator (" + transcript.Language + ")"
+		transcript.Segments[i].IsAssistant = true
 	}
+
+	return transcript
 }
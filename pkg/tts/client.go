@@ -0,0 +1,56 @@
+package tts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ajbouh/bridge/pkg/asr"
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+// ClientConfig is a configuration of a client. Timeouts and retries work like those
+// of ASR clients.
+type ClientConfig = asr.ClientConfig
+
+func DefaultConfig(url string) ClientConfig {
+	return asr.DefaultConfig(url)
+}
+
+// Client speaks the /v1/synthesize protocol of the TTS services in this repository.
+type Client struct {
+	config ClientConfig
+}
+
+func NewClient(url string) (*Client, error) {
+	return NewClientWithConfig(DefaultConfig(url))
+}
+
+func NewClientWithConfig(config ClientConfig) (*Client, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("invalid url for Client %s", config.URL)
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{}
+	}
+	return &Client{
+		config: config,
+	}, nil
+}
+
+// Synthesize returns speech saying request's text. A response with a status other
+// than 200 or 201 is an *asr.StatusError.
+func (s *Client) Synthesize(ctx context.Context, request *router.SynthesisRequest) (*router.SynthesisResponse, error) {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &router.SynthesisResponse{}
+	header := http.Header{"Content-Type": {"application/json"}}
+	if err := asr.Post(ctx, s.config, s.config.URL, header, payload, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
@@ -0,0 +1,307 @@
+// Package tts speaks what assistants say into the session.
+package tts
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	logr "github.com/ajbouh/bridge/pkg/log"
+	"github.com/ajbouh/bridge/pkg/mediaclock"
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+var Logger = logr.New()
+
+// New returns a middleware that synthesizes speech for the final transcriptions of
+// assistants and emits it as SynthesizedAudio. sources maps the speaker label of each
+// assistant to be spoken to its participant ID.
+//
+// Whenever somebody else talks over that speech while it plays, the middleware emits
+// an Interruption for it and marks its transcription as truncated. When it plays is
+// told by the PlayedAudio of the peer playing it, or estimated if there's none.
+func New(url, voice string, sources map[string]string) (router.MiddlewareFunc, error) {
+	client, err := NewClient(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, emit router.Emitters) (router.Listeners, error) {
+		changes := make(chan *router.DocumentChange, 100)
+		captured := make(chan *router.CapturedAudio, 100)
+		played := make(chan *router.PlayedAudio, 100)
+		s := NewSpeaker(client, voice, sources, emit.Clock)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.Run(ctx, emit, changes, captured, played)
+		}()
+
+		return router.Listeners{
+			DocumentChange: changes,
+			CapturedAudio:  captured,
+			PlayedAudio:    played,
+			Done:           done,
+		}, nil
+	}, nil
+}
+
+type Speaker struct {
+	client  *Client
+	voice   string
+	sources map[string]string
+	clock   *mediaclock.Clock
+
+	// voices holds the participant IDs we speak for, whose own audio is never an
+	// interruption.
+	voices map[string]bool
+
+	// playing is the speech we emitted that hasn't finished playing yet, in the
+	// order it was emitted.
+	playing []*speech
+	// reported is set once a peer told us what it played. From then on, speech is
+	// only talked over while the peer says it plays.
+	reported bool
+}
+
+// unplayedTimeout is how long, in milliseconds of media time, speech may be overdue
+// before we take it that the peer won't play it.
+const unplayedTimeout = 10 * 1000
+
+// speech is speech we emitted along with the transcription it says.
+type speech struct {
+	audio         *router.SynthesizedAudio
+	transcription *router.Transcription
+
+	// start and end are when the speech plays: as scheduled until a peer reports
+	// playing it, and played is set once one did.
+	start, end uint64
+	played     bool
+}
+
+func NewSpeaker(client *Client, voice string, sources map[string]string, clock *mediaclock.Clock) *Speaker {
+	voices := map[string]bool{}
+	for _, id := range sources {
+		voices[id] = true
+	}
+
+	return &Speaker{
+		client:  client,
+		voice:   voice,
+		sources: sources,
+		clock:   clock,
+		voices:  voices,
+	}
+}
+
+// Run speaks the transcriptions in changes and watches captured for anybody talking
+// over it while played says it plays, until changes is closed. Cancelling ctx
+// abandons synthesis in flight.
+func (s *Speaker) Run(ctx context.Context, emit router.Emitters, changes <-chan *router.DocumentChange, captured <-chan *router.CapturedAudio, played <-chan *router.PlayedAudio) {
+	// Synthesis takes a while, so it happens on the side and we keep listening for
+	// interruptions meanwhile.
+	requests := make(chan *router.Transcription, 100)
+	results := make(chan *speech)
+	go func() {
+		defer close(results)
+		for t := range requests {
+			speaker, text := s.script(t)
+			audio, err := s.synthesize(ctx, t.ID, speaker, text)
+			if err != nil {
+				Logger.Error(err, "error synthesizing speech", "transcription", t.ID)
+				continue
+			}
+			results <- &speech{audio: audio, transcription: t}
+		}
+	}()
+
+	spoken := map[string]bool{}
+
+	for changes != nil || results != nil {
+		select {
+		case change, ok := <-changes:
+			if !ok {
+				changes = nil
+				close(requests)
+				continue
+			}
+
+			t := change.Transcription
+			if t == nil || !t.Final || spoken[t.ID] {
+				continue
+			}
+			if _, text := s.script(t); text == "" {
+				continue
+			}
+			spoken[t.ID] = true
+			requests <- t
+		case sp, ok := <-results:
+			if !ok {
+				results = nil
+				continue
+			}
+			s.schedule(sp)
+			s.playing = append(s.playing, sp)
+			emit.SynthesizedAudio <- sp.audio
+		case audio, ok := <-played:
+			if !ok {
+				played = nil
+				continue
+			}
+			s.played(audio)
+		case audio, ok := <-captured:
+			if !ok {
+				captured = nil
+				continue
+			}
+			s.bargeIn(emit, audio)
+		}
+	}
+}
+
+// script returns who says what in t, if it's an assistant we speak for.
+func (s *Speaker) script(t *router.Transcription) (string, string) {
+	var speaker string
+	var text strings.Builder
+	for _, segment := range t.Segments {
+		if !segment.IsAssistant {
+			continue
+		}
+		if _, ok := s.sources[segment.Speaker]; !ok {
+			continue
+		}
+
+		speaker = segment.Speaker
+		if segment.Text != "" {
+			text.WriteString(segment.Text)
+			continue
+		}
+		for _, word := range segment.Words {
+			text.WriteString(word.Word)
+		}
+	}
+	return speaker, strings.TrimSpace(text.String())
+}
+
+func (s *Speaker) synthesize(ctx context.Context, id, speaker, text string) (*router.SynthesizedAudio, error) {
+	req := &router.SynthesisRequest{Text: text}
+	if s.voice != "" {
+		req.Voice = &s.voice
+	}
+
+	resp, err := s.client.Synthesize(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Audio.SampleRate <= 0 {
+		return nil, fmt.Errorf("speech has sample rate %d", resp.Audio.SampleRate)
+	}
+
+	return &router.SynthesizedAudio{
+		ID:              id + "/speech",
+		Source:          s.sources[speaker],
+		TranscriptionID: id,
+		PCM:             resp.Audio.Waveform,
+		SampleRate:      resp.Audio.SampleRate,
+	}, nil
+}
+
+// schedule sets when sp is due to play. Speech is played in turn, so it's due once
+// whatever we said before is done.
+func (s *Speaker) schedule(sp *speech) {
+	now := s.clock.Now()
+	s.finished(now)
+
+	start := now
+	for _, before := range s.playing {
+		if start < before.end {
+			start = before.end
+		}
+	}
+	duration := uint64(len(sp.audio.PCM)) * 1000 / uint64(sp.audio.SampleRate)
+
+	sp.audio.StartTimestamp = start
+	sp.audio.EndTimestamp = start + duration
+	sp.start = sp.audio.StartTimestamp
+	sp.end = sp.audio.EndTimestamp
+}
+
+// played takes note of when the peer played audio, if it's speech of ours.
+func (s *Speaker) played(audio *router.PlayedAudio) {
+	for _, sp := range s.playing {
+		if sp.audio.ID == audio.AudioID {
+			s.reported = true
+			sp.start = audio.StartTimestamp
+			sp.end = audio.EndTimestamp
+			sp.played = true
+			return
+		}
+	}
+}
+
+// audible reports whether sp plays, or is taken to as long as no peer reports
+// playback.
+func (s *Speaker) audible(sp *speech) bool {
+	return sp.played || !s.reported
+}
+
+// finished forgets the speech done playing by ts, and the speech the peer still
+// hasn't played long after it was due.
+func (s *Speaker) finished(ts uint64) {
+	playing := s.playing[:0]
+	for _, sp := range s.playing {
+		end := sp.end
+		if !s.audible(sp) {
+			end += unplayedTimeout
+		}
+		if end > ts {
+			playing = append(playing, sp)
+		}
+	}
+	for i := len(playing); i < len(s.playing); i++ {
+		s.playing[i] = nil
+	}
+	s.playing = playing
+}
+
+// bargeIn stops our speech if audio talks over it while it plays: everything
+// playing or still due to play is interrupted, and its transcription marked as
+// truncated.
+func (s *Speaker) bargeIn(emit router.Emitters, audio *router.CapturedAudio) {
+	if s.voices[audio.Source] || audio.EchoOf != "" {
+		return
+	}
+
+	s.finished(audio.StartTimestamp)
+
+	at := audio.EndTimestamp
+	for _, sp := range s.playing {
+		if s.audible(sp) && sp.start < at {
+			at = sp.start
+		}
+	}
+	if at == audio.EndTimestamp {
+		return
+	}
+	if at < audio.StartTimestamp {
+		at = audio.StartTimestamp
+	}
+
+	for _, sp := range s.playing {
+		Logger.Infof("%s talked over %s", audio.Source, sp.audio.ID)
+
+		emit.Interruption <- &router.Interruption{
+			Source:          sp.audio.Source,
+			By:              audio.Source,
+			AudioID:         sp.audio.ID,
+			TranscriptionID: sp.audio.TranscriptionID,
+			Timestamp:       at,
+		}
+
+		truncated := *sp.transcription
+		truncated.Truncated = true
+		emit.Transcription <- &truncated
+	}
+	s.playing = nil
+}
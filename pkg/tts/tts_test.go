@@ -0,0 +1,192 @@
+package tts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/asr"
+	"github.com/ajbouh/bridge/pkg/mediaclock"
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+func TestSpeakerStopsWhenTalkedOver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Ten seconds of silence
+		json.NewEncoder(w).Encode(router.SynthesisResponse{
+			Audio: router.Audio{Waveform: make([]float32, 160000), SampleRate: 16000},
+		})
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSpeaker(client, "", map[string]string{"Bridge": "assistant/Bridge"}, mediaclock.New(time.Now()))
+
+	changes := make(chan *router.DocumentChange)
+	captured := make(chan *router.CapturedAudio)
+	synthesized := make(chan *router.SynthesizedAudio, 10)
+	interruptions := make(chan *router.Interruption, 10)
+	transcriptions := make(chan *router.Transcription, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(context.Background(), router.Emitters{
+			SynthesizedAudio: synthesized,
+			Interruption:     interruptions,
+			Transcription:    transcriptions,
+		}, changes, captured, nil)
+	}()
+
+	reply := &router.Transcription{
+		ID:    "reply",
+		Final: true,
+		Segments: []router.TranscriptionSegment{
+			{Speaker: "Bridge", IsAssistant: true, Text: "Let me tell you a long story."},
+		},
+	}
+	changes <- &router.DocumentChange{Kind: router.TranscriptionAdded, Transcription: reply}
+
+	audio := <-synthesized
+	if audio.Source != "assistant/Bridge" || audio.TranscriptionID != "reply" {
+		t.Fatalf("synthesized %+v", audio)
+	}
+	if audio.EndTimestamp-audio.StartTimestamp != 10000 {
+		t.Errorf("10s of speech spans %dms", audio.EndTimestamp-audio.StartTimestamp)
+	}
+
+	// The assistant hearing itself isn't an interruption.
+	captured <- &router.CapturedAudio{Source: "assistant/Bridge", StartTimestamp: audio.StartTimestamp, EndTimestamp: audio.StartTimestamp + 1000}
+	// Somebody who stopped talking before the speech started isn't either.
+	captured <- &router.CapturedAudio{Source: "alice", StartTimestamp: 0, EndTimestamp: audio.StartTimestamp}
+	// Somebody talking over it is.
+	captured <- &router.CapturedAudio{Source: "bob", StartTimestamp: audio.StartTimestamp + 2000, EndTimestamp: audio.StartTimestamp + 3000}
+
+	i := <-interruptions
+	want := router.Interruption{
+		Source:          "assistant/Bridge",
+		By:              "bob",
+		AudioID:         audio.ID,
+		TranscriptionID: "reply",
+		Timestamp:       audio.StartTimestamp + 2000,
+	}
+	if *i != want {
+		t.Errorf("interruption %+v, want %+v", *i, want)
+	}
+
+	truncated := <-transcriptions
+	if truncated.ID != "reply" || !truncated.Truncated {
+		t.Errorf("transcription %+v isn't truncated", truncated)
+	}
+	if reply.Truncated {
+		t.Error("the transcription in the document was modified")
+	}
+
+	// Once stopped, the speech can't be interrupted again.
+	captured <- &router.CapturedAudio{Source: "bob", StartTimestamp: audio.StartTimestamp + 2000, EndTimestamp: audio.StartTimestamp + 4000}
+
+	close(changes)
+	<-done
+	if len(interruptions) != 0 {
+		t.Errorf("%d more interruptions", len(interruptions))
+	}
+}
+
+func TestSpeakerFollowsPlayback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(router.SynthesisResponse{
+			Audio: router.Audio{Waveform: make([]float32, 160000), SampleRate: 16000},
+		})
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSpeaker(client, "", map[string]string{"Bridge": "assistant/Bridge"}, mediaclock.New(time.Now()))
+
+	changes := make(chan *router.DocumentChange)
+	captured := make(chan *router.CapturedAudio)
+	played := make(chan *router.PlayedAudio)
+	synthesized := make(chan *router.SynthesizedAudio, 10)
+	interruptions := make(chan *router.Interruption, 10)
+	transcriptions := make(chan *router.Transcription, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(context.Background(), router.Emitters{
+			SynthesizedAudio: synthesized,
+			Interruption:     interruptions,
+			Transcription:    transcriptions,
+		}, changes, captured, played)
+	}()
+
+	for _, id := range []string{"first", "second"} {
+		changes <- &router.DocumentChange{Kind: router.TranscriptionAdded, Transcription: &router.Transcription{
+			ID:    id,
+			Final: true,
+			Segments: []router.TranscriptionSegment{
+				{Speaker: "Bridge", IsAssistant: true, Text: "Let me tell you a long story."},
+			},
+		}}
+	}
+	first := <-synthesized
+	second := <-synthesized
+
+	// The peer buffered the first speech and started playing it five seconds late.
+	start := first.StartTimestamp + 5000
+	played <- &router.PlayedAudio{AudioID: first.ID, Source: first.Source, StartTimestamp: start, EndTimestamp: start + 10000}
+
+	// Talking while it was due, but before it played, isn't an interruption.
+	captured <- &router.CapturedAudio{Source: "bob", StartTimestamp: first.StartTimestamp + 1000, EndTimestamp: first.StartTimestamp + 2000}
+	// Talking while it plays is, and stops what's due after it too.
+	captured <- &router.CapturedAudio{Source: "bob", StartTimestamp: start + 1000, EndTimestamp: start + 2000}
+
+	for _, audio := range []*router.SynthesizedAudio{first, second} {
+		i := <-interruptions
+		want := router.Interruption{
+			Source:          "assistant/Bridge",
+			By:              "bob",
+			AudioID:         audio.ID,
+			TranscriptionID: audio.TranscriptionID,
+			Timestamp:       start + 1000,
+		}
+		if *i != want {
+			t.Errorf("interruption %+v, want %+v", *i, want)
+		}
+		if truncated := <-transcriptions; truncated.ID != audio.TranscriptionID || !truncated.Truncated {
+			t.Errorf("transcription %+v isn't truncated", truncated)
+		}
+	}
+
+	close(changes)
+	<-done
+	if len(interruptions) != 0 {
+		t.Errorf("%d more interruptions", len(interruptions))
+	}
+}
+
+func TestClientReportsStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"detail": "no such voice"})
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Synthesize(context.Background(), &router.SynthesisRequest{Text: "hello"})
+	var statusErr *asr.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest || statusErr.Message != "no such voice" {
+		t.Errorf("got error %v, want a status error saying there's no such voice", err)
+	}
+}
@@ -0,0 +1,163 @@
+package vad
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/echo"
+)
+
+type Config struct {
+	// This is determined by the hyperparameter configuration that whisper was trained on.
+	// See more here: https://github.com/ggerganov/whisper.cpp/issues/909
+	SampleRate int // = 16000 // 16kHz
+
+	// SampleWindow is the longest utterance we pass to whisper inference. Somebody
+	// who talks for longer gets split into several utterances. Defaults to
+	// DefaultSampleWindow.
+	SampleWindow time.Duration
+
+	// AnalysisWindow is how much audio we buffer before deciding whether it is
+	// speech. Every timing below is rounded up to a whole number of analysis
+	// windows. Defaults to DefaultAnalysisWindow.
+	AnalysisWindow time.Duration
+	// DraftInterval is how often we pass the utterance so far along for a draft
+	// transcription while somebody is still speaking. Defaults to
+	// DefaultDraftInterval.
+	DraftInterval time.Duration
+	// PreRoll is how much audio from before speech was detected starts each
+	// utterance, so the first syllable isn't clipped. Defaults to DefaultPreRoll;
+	// a negative PreRoll means none.
+	PreRoll time.Duration
+	// Hangover is how long speech may pause before the utterance ends. Defaults to
+	// DefaultHangover; a negative Hangover means none, so the utterance ends with
+	// the last analysis window of speech.
+	Hangover time.Duration
+	// MinSpeech is how much speech an utterance needs to be passed along at all, so
+	// that coughs and door slams aren't transcribed. Defaults to no minimum.
+	MinSpeech time.Duration
+
+	// Detector picks the voice activity detector. Defaults to DetectorEnergy.
+	Detector DetectorKind
+
+	// NoiseFloorWindow is how far back each stream looks for its quietest moment
+	// that wasn't speech when estimating the background noise. Defaults to
+	// DefaultNoiseFloorWindow.
+	NoiseFloorWindow time.Duration
+	// OnsetSNR is how many dB above the noise floor audio has to be for speech to
+	// start, and OffsetSNR how many dB it has to stay above it for speech to go on.
+	// Zero picks DefaultOnsetSNR and DefaultOffsetSNR.
+	OnsetSNR  float64
+	OffsetSNR float64
+
+	// Echo, if set, has audio played into the session recognized when participants'
+	// microphones pick it up again, and its captured audio labelled with EchoOf.
+	Echo *echo.Config
+}
+
+const (
+	DefaultSampleWindow   = 24 * time.Second
+	DefaultAnalysisWindow = 500 * time.Millisecond
+	DefaultDraftInterval  = 1500 * time.Millisecond
+	DefaultPreRoll        = 500 * time.Millisecond
+	DefaultHangover       = 500 * time.Millisecond
+
+	DefaultNoiseFloorWindow = 5 * time.Second
+	DefaultOnsetSNR         = 9
+	DefaultOffsetSNR        = 3
+)
+
+// noiseFloorFreeze is how long speech may go on without a pause before the noise
+// floor follows it anyway. A fan that starts up shouldn't count as speech forever.
+const noiseFloorFreeze = 30 * time.Second
+
+// withDefaults fills in the zero fields of c, and turns the negative PreRoll and
+// Hangover that stand for none into zero.
+func (c Config) withDefaults() Config {
+	if c.SampleWindow == 0 {
+		c.SampleWindow = DefaultSampleWindow
+	}
+	if c.AnalysisWindow == 0 {
+		c.AnalysisWindow = DefaultAnalysisWindow
+	}
+	if c.DraftInterval == 0 {
+		c.DraftInterval = DefaultDraftInterval
+	}
+	switch {
+	case c.PreRoll == 0:
+		c.PreRoll = DefaultPreRoll
+	case c.PreRoll < 0:
+		c.PreRoll = 0
+	}
+	switch {
+	case c.Hangover == 0:
+		c.Hangover = DefaultHangover
+	case c.Hangover < 0:
+		c.Hangover = 0
+	}
+	if c.NoiseFloorWindow == 0 {
+		c.NoiseFloorWindow = DefaultNoiseFloorWindow
+	}
+	if c.OnsetSNR == 0 {
+		c.OnsetSNR = DefaultOnsetSNR
+	}
+	if c.OffsetSNR == 0 {
+		c.OffsetSNR = DefaultOffsetSNR
+	}
+	return c
+}
+
+// Validate reports what's wrong with c, once the defaults are filled in.
+func (c Config) Validate() error {
+	c = c.withDefaults()
+
+	var errs []error
+	if c.SampleRate <= 0 || c.SampleRate%1000 != 0 {
+		errs = append(errs, fmt.Errorf("sample rate %d is not a positive multiple of 1kHz", c.SampleRate))
+	}
+
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"sample window", c.SampleWindow},
+		{"analysis window", c.AnalysisWindow},
+		{"draft interval", c.DraftInterval},
+		{"pre-roll", c.PreRoll},
+		{"hangover", c.Hangover},
+		{"minimum speech", c.MinSpeech},
+		{"noise floor window", c.NoiseFloorWindow},
+	}
+	for _, d := range durations {
+		if d.d < 0 {
+			errs = append(errs, fmt.Errorf("%s %s is negative", d.name, d.d))
+		}
+	}
+
+	if c.AnalysisWindow > 0 && c.AnalysisWindow < time.Millisecond {
+		errs = append(errs, fmt.Errorf("analysis window %s is shorter than 1ms", c.AnalysisWindow))
+	}
+	if c.SampleWindow < c.AnalysisWindow+c.PreRoll {
+		errs = append(errs, fmt.Errorf("sample window %s doesn't fit the pre-roll %s and an analysis window %s", c.SampleWindow, c.PreRoll, c.AnalysisWindow))
+	}
+	if c.MinSpeech > c.SampleWindow {
+		errs = append(errs, fmt.Errorf("minimum speech %s is longer than the sample window %s", c.MinSpeech, c.SampleWindow))
+	}
+	if c.OffsetSNR > c.OnsetSNR {
+		errs = append(errs, fmt.Errorf("offset snr %gdB is above the onset snr %gdB", c.OffsetSNR, c.OnsetSNR))
+	}
+
+	if c.SampleRate > 0 {
+		if _, err := NewDetector(c.Detector, c.SampleRate); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// windows returns how many analysis windows it takes to cover d.
+func (c Config) windows(d time.Duration) int {
+	return int((d + c.AnalysisWindow - 1) / c.AnalysisWindow)
+}
@@ -0,0 +1,218 @@
+package vad_test
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/router"
+	"github.com/ajbouh/bridge/pkg/vad"
+)
+
+// runEngine passes pcm through the vad middleware, 20ms at a time, and returns the
+// audio it emits.
+func runEngine(t *testing.T, config vad.Config, pcm []float32) []*router.CapturedAudio {
+	t.Helper()
+
+	ch := make(chan *router.CapturedAudio)
+	listeners, err := vad.New(config)(context.Background(), router.Emitters{CapturedAudio: ch})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collected := make(chan []*router.CapturedAudio)
+	go func() {
+		var audio []*router.CapturedAudio
+		for a := range ch {
+			audio = append(audio, a)
+		}
+		collected <- audio
+	}()
+
+	frame := config.SampleRate / 50
+	for i := 0; i+frame <= len(pcm); i += frame {
+		listeners.CapturedSample <- &router.CapturedSample{
+			PCM:            pcm[i : i+frame],
+			StartTimestamp: uint64(i * 1000 / config.SampleRate),
+			EndTimestamp:   uint64((i + frame) * 1000 / config.SampleRate),
+		}
+	}
+	close(listeners.CapturedSample)
+	close(listeners.Status)
+	<-listeners.Done
+	close(ch)
+
+	return <-collected
+}
+
+func finals(audio []*router.CapturedAudio) []*router.CapturedAudio {
+	var f []*router.CapturedAudio
+	for _, a := range audio {
+		if a.Final {
+			f = append(f, a)
+		}
+	}
+	return f
+}
+
+func TestConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config vad.Config
+		err    string
+	}{
+		{
+			name:   "defaults",
+			config: vad.Config{SampleRate: 16000},
+		},
+		{
+			name:   "odd sample rate",
+			config: vad.Config{SampleRate: 22050},
+			err:    "multiple of 1kHz",
+		},
+		{
+			name:   "no pre-roll or hangover",
+			config: vad.Config{SampleRate: 16000, PreRoll: -1, Hangover: -1},
+		},
+		{
+			name:   "negative minimum speech",
+			config: vad.Config{SampleRate: 16000, MinSpeech: -time.Second},
+			err:    "minimum speech -1s is negative",
+		},
+		{
+			name:   "pre-roll longer than an utterance",
+			config: vad.Config{SampleRate: 16000, SampleWindow: time.Second, PreRoll: time.Second},
+			err:    "doesn't fit the pre-roll",
+		},
+		{
+			name:   "offset above onset",
+			config: vad.Config{SampleRate: 16000, OnsetSNR: 3, OffsetSNR: 6},
+			err:    "above the onset snr",
+		},
+		{
+			name:   "unknown detector",
+			config: vad.Config{SampleRate: 16000, Detector: "magic"},
+			err:    "unknown voice activity detector",
+		},
+	}
+
+	for _, tc := range testCases {
+		err := tc.config.Validate()
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("%s: unexpected error %v", tc.name, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("%s: got error %v, want one about %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestEngineTiming(t *testing.T) {
+	const sampleRate = 16000
+	rng := rand.New(rand.NewSource(1))
+	quiet := func(d time.Duration) []float32 {
+		return noise(rng, int(d.Seconds()*sampleRate), 0.001)
+	}
+	loud := func(d time.Duration) []float32 {
+		return noise(rng, int(d.Seconds()*sampleRate), 0.2)
+	}
+
+	t.Run("pre-roll", func(t *testing.T) {
+		pcm := append(quiet(3*time.Second), loud(time.Second)...)
+		pcm = append(pcm, quiet(3*time.Second)...)
+
+		audio := finals(runEngine(t, vad.Config{
+			SampleRate: sampleRate,
+			PreRoll:    time.Second,
+		}, pcm))
+		if len(audio) != 1 {
+			t.Fatalf("got %d utterances, want 1", len(audio))
+		}
+		if start := audio[0].StartTimestamp; start != 2000 {
+			t.Errorf("utterance starts at %dms, want 2000ms", start)
+		}
+	})
+
+	t.Run("hangover", func(t *testing.T) {
+		// two words with a 1s pause between them
+		pcm := append(quiet(3*time.Second), loud(time.Second)...)
+		pcm = append(pcm, quiet(time.Second)...)
+		pcm = append(pcm, loud(time.Second)...)
+		pcm = append(pcm, quiet(3*time.Second)...)
+
+		short := finals(runEngine(t, vad.Config{SampleRate: sampleRate, Hangover: 500 * time.Millisecond}, pcm))
+		if len(short) != 2 {
+			t.Errorf("with a short hangover, got %d utterances, want 2", len(short))
+		}
+		long := finals(runEngine(t, vad.Config{SampleRate: sampleRate, Hangover: 1500 * time.Millisecond}, pcm))
+		if len(long) != 1 {
+			t.Errorf("with a long hangover, got %d utterances, want 1", len(long))
+		}
+	})
+
+	t.Run("bounds", func(t *testing.T) {
+		pcm := append(quiet(3*time.Second), loud(time.Second)...)
+		pcm = append(pcm, quiet(3*time.Second)...)
+
+		testCases := []struct {
+			name       string
+			config     vad.Config
+			start, end uint64
+		}{
+			{"defaults", vad.Config{SampleRate: sampleRate}, 2500, 4500},
+			{"long", vad.Config{SampleRate: sampleRate, PreRoll: time.Second, Hangover: time.Second}, 2000, 5000},
+			{"none", vad.Config{SampleRate: sampleRate, PreRoll: -1, Hangover: -1}, 3000, 4000},
+		}
+		for _, tc := range testCases {
+			audio := finals(runEngine(t, tc.config, pcm))
+			if len(audio) != 1 {
+				t.Errorf("%s: got %d utterances, want 1", tc.name, len(audio))
+				continue
+			}
+			if a := audio[0]; a.StartTimestamp != tc.start || a.EndTimestamp != tc.end {
+				t.Errorf("%s: utterance spans %d-%dms, want %d-%dms", tc.name, a.StartTimestamp, a.EndTimestamp, tc.start, tc.end)
+			}
+		}
+	})
+
+	t.Run("minimum speech", func(t *testing.T) {
+		// a cough
+		pcm := append(quiet(3*time.Second), loud(500*time.Millisecond)...)
+		pcm = append(pcm, quiet(3*time.Second)...)
+
+		audio := runEngine(t, vad.Config{SampleRate: sampleRate, MinSpeech: time.Second}, pcm)
+		if len(audio) != 0 {
+			t.Errorf("got %d audio for a cough, want none", len(audio))
+		}
+	})
+
+	t.Run("monologue", func(t *testing.T) {
+		pcm := append(quiet(3*time.Second), loud(10*time.Second)...)
+		pcm = append(pcm, quiet(3*time.Second)...)
+
+		audio := runEngine(t, vad.Config{
+			SampleRate:   sampleRate,
+			SampleWindow: 4 * time.Second,
+		}, pcm)
+		for _, a := range audio {
+			if len(a.PCM) > 4*sampleRate {
+				t.Errorf("got %s of audio, want at most 4s", time.Duration(len(a.PCM))*time.Second/sampleRate)
+			}
+		}
+		if f := finals(audio); len(f) < 3 {
+			t.Errorf("got %d utterances for a 10s monologue, want it split in at least 3", len(f))
+		}
+	})
+
+	t.Run("drafts", func(t *testing.T) {
+		pcm := append(quiet(3*time.Second), loud(3*time.Second)...)
+		pcm = append(pcm, quiet(3*time.Second)...)
+
+		audio := runEngine(t, vad.Config{SampleRate: sampleRate, DraftInterval: 500 * time.Millisecond}, pcm)
+		if drafts := len(audio) - len(finals(audio)); drafts < 6 {
+			t.Errorf("got %d drafts of 3s of speech, want one every 500ms", drafts)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+package vad
+
+import (
+	"fmt"
+	"math"
+)
+
+// Detector decides whether frames of audio contain speech. Detectors may keep state
+// between frames, so each stream of audio needs its own.
+type Detector interface {
+	// Detect reports whether frame, which follows the previous frame given to the
+	// detector, contains speech.
+	Detect(frame []float32) bool
+}
+
+type DetectorKind string
+
+const (
+	// DetectorEnergy thresholds the energy and mean amplitude of each frame. It is
+	// cheap, but anything loud enough counts as speech.
+	DetectorEnergy DetectorKind = "energy"
+	// DetectorSpectral looks at the shape of the spectrum, so that steady noise like
+	// fans and broadband clicks like keyboards don't count as speech.
+	DetectorSpectral DetectorKind = "spectral"
+)
+
+// NewDetector returns a new detector of the given kind for audio at sampleRate. The
+// empty kind is DetectorEnergy.
+func NewDetector(kind DetectorKind, sampleRate int) (Detector, error) {
+	switch kind {
+	case "", DetectorEnergy:
+		return NewEnergyDetector(), nil
+	case DetectorSpectral:
+		return NewSpectralDetector(sampleRate), nil
+	default:
+		return nil, fmt.Errorf("unknown voice activity detector %q", kind)
+	}
+}
+
+const (
+	// these are arbitrary numbers I picked after testing a bit
+	// feel free to play around
+	DefaultEnergyThreshold  = 0.0005
+	DefaultSilenceThreshold = 0.015
+)
+
+// EnergyDetector is the original detector: a frame is speech when both its energy
+// and its mean absolute amplitude exceed a threshold.
+type EnergyDetector struct {
+	EnergyThreshold  float32
+	SilenceThreshold float32
+}
+
+func NewEnergyDetector() *EnergyDetector {
+	return &EnergyDetector{
+		EnergyThreshold:  DefaultEnergyThreshold,
+		SilenceThreshold: DefaultSilenceThreshold,
+	}
+}
+
+func (d *EnergyDetector) Detect(frame []float32) bool {
+	isSpeaking, energy, silence := VAD(frame, d.EnergyThreshold, d.SilenceThreshold)
+	Logger.Debugf("energy=%#v (energyThreshold=%#v) silence=%#v (silenceThreshold=%#v)", energy, d.EnergyThreshold, silence, d.SilenceThreshold)
+	return isSpeaking
+}
+
+// NOTE This is a very rough implemntation. We should improve it :D
+// VAD performs voice activity detection on a frame of audio data.
+func VAD(frame []float32, energyThresh, silenceThresh float32) (bool, float32, float32) {
+	// Compute frame energy
+	energy := float32(0)
+	for i := 0; i < len(frame); i++ {
+		energy += frame[i] * frame[i]
+	}
+	energy /= float32(len(frame))
+
+	// Compute frame silence
+	silence := float32(0)
+	for i := 0; i < len(frame); i++ {
+		silence += float32(math.Abs(float64(frame[i])))
+	}
+	silence /= float32(len(frame))
+
+	// Apply energy threshold
+	if energy < energyThresh {
+		return false, energy, silence
+	}
+
+	// Apply silence threshold
+	if silence < silenceThresh {
+		return false, energy, silence
+	}
+
+	return true, energy, silence
+}
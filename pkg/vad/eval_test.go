@@ -0,0 +1,214 @@
+package vad_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ajbouh/bridge/pkg/vad"
+)
+
+// evalFrameMs is how much audio detectors are given at a time during evaluation.
+const evalFrameMs = 100
+
+type labelledFixture struct {
+	File   string `json:"file"`
+	Speech []struct {
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+	} `json:"speech"`
+}
+
+// isSpeech reports whether most of the audio between start and end, in seconds, is
+// labelled as speech.
+func (f labelledFixture) isSpeech(start, end float64) bool {
+	var covered float64
+	for _, s := range f.Speech {
+		lo, hi := start, end
+		if s.Start > lo {
+			lo = s.Start
+		}
+		if s.End < hi {
+			hi = s.End
+		}
+		if hi > lo {
+			covered += hi - lo
+		}
+	}
+	return covered > (end-start)/2
+}
+
+// confusion counts how the frames a detector classified compare to the labels.
+type confusion struct {
+	truePositives, falsePositives, falseNegatives, trueNegatives int
+}
+
+func (c confusion) accuracy() float64 {
+	return float64(c.truePositives+c.trueNegatives) / float64(c.truePositives+c.falsePositives+c.falseNegatives+c.trueNegatives)
+}
+
+// precision is the share of frames classified as speech that are speech.
+func (c confusion) precision() float64 {
+	return float64(c.truePositives) / float64(c.truePositives+c.falsePositives)
+}
+
+// recall is the share of speech frames classified as speech.
+func (c confusion) recall() float64 {
+	return float64(c.truePositives) / float64(c.truePositives+c.falseNegatives)
+}
+
+// classify runs d over pcm a frame at a time and compares it to the labels.
+func classify(d vad.Detector, f labelledFixture, pcm []float32, sampleRate int) confusion {
+	frameSize := sampleRate * evalFrameMs / 1000
+
+	var c confusion
+	for i := 0; i+frameSize <= len(pcm); i += frameSize {
+		start := float64(i) / float64(sampleRate)
+		end := float64(i+frameSize) / float64(sampleRate)
+		switch detected, labelled := d.Detect(pcm[i:i+frameSize]), f.isSpeech(start, end); {
+		case detected && labelled:
+			c.truePositives++
+		case detected:
+			c.falsePositives++
+		case labelled:
+			c.falseNegatives++
+		default:
+			c.trueNegatives++
+		}
+	}
+	return c
+}
+
+// readFixtures reads the labels in file under testdata.
+func readFixtures(t *testing.T, file string) []labelledFixture {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fixtures []labelledFixture
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		t.Fatal(err)
+	}
+	return fixtures
+}
+
+func TestDetectorsOnSyntheticFixtures(t *testing.T) {
+	fixtures := readFixtures(t, "labels.json")
+
+	// The speech in these fixtures is synthetic, so they only check that nothing
+	// regressed: each detector has to stay well above a floor on each fixture, and
+	// the spectral detector has to stay clearly ahead of the energy detector, which
+	// can't tell noise from speech, on the noisy ones. How the detectors do on real
+	// speech is evaluated by TestDetectorsOnRealSpeech, with -tags eval.
+	minAccuracy := map[vad.DetectorKind]map[string]float64{
+		vad.DetectorEnergy: {
+			"quiet.wav": 0.8,
+		},
+		vad.DetectorSpectral: {
+			"quiet.wav":    0.75,
+			"fan.wav":      0.7,
+			"keyboard.wav": 0.75,
+		},
+	}
+	const minLead = 0.15
+	noisy := map[string]bool{"fan.wav": true, "keyboard.wav": true}
+
+	for _, f := range fixtures {
+		pcm, sampleRate, err := readWAV(filepath.Join("testdata", f.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		accuracy := map[vad.DetectorKind]float64{}
+		for _, kind := range []vad.DetectorKind{vad.DetectorEnergy, vad.DetectorSpectral} {
+			d, err := vad.NewDetector(kind, sampleRate)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			accuracy[kind] = classify(d, f, pcm, sampleRate).accuracy()
+			t.Logf("%-8s %-12s accuracy=%.2f", kind, f.File, accuracy[kind])
+
+			if want, ok := minAccuracy[kind][f.File]; ok && accuracy[kind] < want {
+				t.Errorf("%s detector scored %.2f on %s, want at least %.2f", kind, accuracy[kind], f.File, want)
+			}
+		}
+
+		if lead := accuracy[vad.DetectorSpectral] - accuracy[vad.DetectorEnergy]; noisy[f.File] && lead < minLead {
+			t.Errorf("spectral detector is %.2f ahead of the energy detector on %s, want at least %.2f", lead, f.File, minLead)
+		}
+	}
+}
+
+// readWAV reads a mono 16 bit PCM WAV file.
+func readWAV(path string) ([]float32, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var riff struct {
+		ID     [4]byte
+		Size   uint32
+		Format [4]byte
+	}
+	if err := binary.Read(f, binary.LittleEndian, &riff); err != nil {
+		return nil, 0, err
+	}
+	if string(riff.ID[:]) != "RIFF" || string(riff.Format[:]) != "WAVE" {
+		return nil, 0, fmt.Errorf("%s is not a WAV file", path)
+	}
+
+	var sampleRate int
+	for {
+		var chunk struct {
+			ID   [4]byte
+			Size uint32
+		}
+		if err := binary.Read(f, binary.LittleEndian, &chunk); err != nil {
+			return nil, 0, err
+		}
+
+		switch string(chunk.ID[:]) {
+		case "fmt ":
+			var format struct {
+				AudioFormat   uint16
+				Channels      uint16
+				SampleRate    uint32
+				ByteRate      uint32
+				BlockAlign    uint16
+				BitsPerSample uint16
+			}
+			if err := binary.Read(f, binary.LittleEndian, &format); err != nil {
+				return nil, 0, err
+			}
+			if format.AudioFormat != 1 || format.Channels != 1 || format.BitsPerSample != 16 {
+				return nil, 0, fmt.Errorf("%s is not mono 16 bit PCM", path)
+			}
+			sampleRate = int(format.SampleRate)
+			if _, err := io.CopyN(io.Discard, f, int64(chunk.Size)-16); err != nil {
+				return nil, 0, err
+			}
+		case "data":
+			samples := make([]int16, chunk.Size/2)
+			if err := binary.Read(f, binary.LittleEndian, samples); err != nil {
+				return nil, 0, err
+			}
+			pcm := make([]float32, len(samples))
+			for i, s := range samples {
+				pcm[i] = float32(s) / 32768
+			}
+			return pcm, sampleRate, nil
+		default:
+			if _, err := io.CopyN(io.Discard, f, int64(chunk.Size)); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package vad
+
+import (
+	"math"
+	"time"
+)
+
+// NoiseFloor estimates the background noise power of a stream with minimum
+// statistics: speech comes and goes, but the quietest moments over a few seconds are
+// almost always just the room. The window is split into subwindows so the minimum
+// can slide forward without keeping every frame around.
+type NoiseFloor struct {
+	frameSize int
+	// smoothing applied to frame power before taking the minimum, so that a single
+	// unusually quiet frame doesn't drag the floor down
+	alpha    float64
+	smoothed float64
+
+	// minimums of the completed subwindows, oldest first
+	subMins   []float64
+	subFrames int
+
+	current      float64
+	currentCount int
+
+	// pending holds samples that didn't fill a frame yet.
+	pending []float32
+}
+
+const (
+	noiseFloorFrame      = 20 * time.Millisecond
+	noiseFloorSubwindows = 8
+	// minPower keeps the floor, and so the SNR, finite in digital silence.
+	minPower = 1e-10
+)
+
+func NewNoiseFloor(sampleRate int, window time.Duration) *NoiseFloor {
+	subFrames := int(window / noiseFloorFrame / noiseFloorSubwindows)
+	if subFrames < 1 {
+		subFrames = 1
+	}
+	return &NoiseFloor{
+		frameSize: int(int64(sampleRate) * int64(noiseFloorFrame) / int64(time.Second)),
+		alpha:     0.8,
+		subFrames: subFrames,
+		current:   math.Inf(1),
+	}
+}
+
+// Update feeds the samples that follow the previous ones into the estimate.
+func (n *NoiseFloor) Update(pcm []float32) {
+	samples := append(n.pending, pcm...)
+	for ; len(samples) >= n.frameSize; samples = samples[n.frameSize:] {
+		n.add(power(samples[:n.frameSize]))
+	}
+	n.pending = append(n.pending[:0], samples...)
+}
+
+func (n *NoiseFloor) add(p float64) {
+	if n.currentCount == 0 && len(n.subMins) == 0 {
+		n.smoothed = p
+	} else {
+		n.smoothed = n.alpha*n.smoothed + (1-n.alpha)*p
+	}
+
+	if n.smoothed < n.current {
+		n.current = n.smoothed
+	}
+	n.currentCount++
+
+	if n.currentCount == n.subFrames {
+		if len(n.subMins) == noiseFloorSubwindows {
+			n.subMins = n.subMins[1:]
+		}
+		n.subMins = append(n.subMins, n.current)
+		n.current = math.Inf(1)
+		n.currentCount = 0
+	}
+}
+
+// Power returns the estimated noise power, as a mean square amplitude. It is zero
+// until the first frame has been seen.
+func (n *NoiseFloor) Power() float64 {
+	floor := n.current
+	for _, m := range n.subMins {
+		if m < floor {
+			floor = m
+		}
+	}
+	if math.IsInf(floor, 1) {
+		return 0
+	}
+	return math.Max(floor, minPower)
+}
+
+// SNR returns the ratio of the power of pcm to the noise floor in dB.
+func (n *NoiseFloor) SNR(pcm []float32) float64 {
+	floor := n.Power()
+	if floor == 0 {
+		return 0
+	}
+	return decibels(math.Max(power(pcm), minPower) / floor)
+}
+
+func power(pcm []float32) float64 {
+	if len(pcm) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, s := range pcm {
+		sum += float64(s) * float64(s)
+	}
+	return sum / float64(len(pcm))
+}
+
+func decibels(ratio float64) float64 {
+	return 10 * math.Log10(ratio)
+}
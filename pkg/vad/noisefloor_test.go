@@ -0,0 +1,120 @@
+package vad_test
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/vad"
+)
+
+func noise(rng *rand.Rand, n int, rms float64) []float32 {
+	pcm := make([]float32, n)
+	for i := range pcm {
+		pcm[i] = float32(rng.NormFloat64() * rms)
+	}
+	return pcm
+}
+
+func TestNoiseFloorFollowsTheRoom(t *testing.T) {
+	const sampleRate = 16000
+	rng := rand.New(rand.NewSource(1))
+	floor := vad.NewNoiseFloor(sampleRate, 2*time.Second)
+
+	dBFS := func() float64 { return 10 * math.Log10(floor.Power()) }
+
+	// Quiet room, -60dBFS, with a loud burst of speech that shouldn't count.
+	floor.Update(noise(rng, 3*sampleRate, 0.001))
+	floor.Update(noise(rng, sampleRate/2, 0.1))
+	if got := dBFS(); got < -63 || got > -57 {
+		t.Errorf("floor in a quiet room is %.1fdBFS, want about -60dBFS", got)
+	}
+
+	// Somebody turns on a fan, -40dBFS. Once the old quiet has left the window the
+	// floor should rise to meet it.
+	floor.Update(noise(rng, 3*sampleRate, 0.01))
+	if got := dBFS(); got < -43 || got > -37 {
+		t.Errorf("floor next to a fan is %.1fdBFS, want about -40dBFS", got)
+	}
+}
+
+func TestEngineIgnoresSteadyNoise(t *testing.T) {
+	const sampleRate = 16000
+	rng := rand.New(rand.NewSource(1))
+
+	// A loud hum at -30dBFS, with somebody talking over it from 3s to 4.5s.
+	var pcm []float32
+	pcm = append(pcm, noise(rng, 3*sampleRate, 0.03)...)
+	pcm = append(pcm, noise(rng, 3*sampleRate/2, 0.2)...)
+	pcm = append(pcm, noise(rng, 3*sampleRate, 0.03)...)
+
+	audio := runEngine(t, vad.Config{SampleRate: sampleRate}, pcm)
+
+	// The hum is louder than the energy detector's fixed thresholds, so without the
+	// noise floor all of it would be one long utterance.
+	var utterances int
+	for _, a := range audio {
+		if !a.Final {
+			continue
+		}
+		utterances++
+		start, end := float64(a.StartTimestamp)/1000, float64(a.EndTimestamp)/1000
+		t.Logf("utterance from %.1fs to %.1fs, noise floor %.1fdBFS, snr %.1fdB", start, end, a.NoiseFloor, a.SNR)
+		if start < 2.5 || end > 5.5 {
+			t.Errorf("utterance from %.1fs to %.1fs runs through the noise", start, end)
+		}
+		if a.SNR <= 0 {
+			t.Errorf("utterance has snr %.1fdB, want it above the noise floor", a.SNR)
+		}
+	}
+	if utterances != 1 {
+		t.Errorf("got %d utterances, want 1", utterances)
+	}
+}
+
+// words is d of speech as loud as rms, in a room at -60dBFS: 400ms words with
+// 300ms pauses between them.
+func words(rng *rand.Rand, sampleRate int, d time.Duration, rms float64) []float32 {
+	var pcm []float32
+	for len(pcm) < int(d.Seconds()*float64(sampleRate)) {
+		pcm = append(pcm, noise(rng, sampleRate*4/10, rms)...)
+		pcm = append(pcm, noise(rng, sampleRate*3/10, 0.001)...)
+	}
+	return pcm
+}
+
+func TestEngineHearsSpeechAtTheStart(t *testing.T) {
+	const sampleRate = 16000
+	rng := rand.New(rand.NewSource(1))
+
+	// Somebody is already talking when the stream starts, for 4s.
+	pcm := words(rng, sampleRate, 4*time.Second, 0.1)
+	pcm = append(pcm, noise(rng, 3*sampleRate, 0.001)...)
+
+	audio := finals(runEngine(t, vad.Config{SampleRate: sampleRate}, pcm))
+	if len(audio) != 1 {
+		t.Fatalf("got %d utterances, want 1", len(audio))
+	}
+	if a := audio[0]; a.StartTimestamp > 500 || a.EndTimestamp < 3500 {
+		t.Errorf("utterance spans %d-%dms, want all of 500-3500ms", a.StartTimestamp, a.EndTimestamp)
+	}
+}
+
+func TestEngineHearsLongMonologues(t *testing.T) {
+	const sampleRate = 16000
+	rng := rand.New(rand.NewSource(1))
+
+	// 20s of speech without a pause, far longer than the noise floor looks back.
+	pcm := noise(rng, 3*sampleRate, 0.001)
+	pcm = append(pcm, noise(rng, 20*sampleRate, 0.2)...)
+	pcm = append(pcm, noise(rng, 3*sampleRate, 0.001)...)
+
+	audio := finals(runEngine(t, vad.Config{SampleRate: sampleRate}, pcm))
+	if len(audio) != 1 {
+		t.Fatalf("got %d utterances, want 1", len(audio))
+	}
+	if a := audio[0]; a.StartTimestamp > 3000 || a.EndTimestamp < 23000 {
+		t.Errorf("utterance spans %d-%dms, want all of 3000-23000ms", a.StartTimestamp, a.EndTimestamp)
+	}
+}
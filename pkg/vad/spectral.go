@@ -0,0 +1,173 @@
+package vad
+
+import (
+	"math"
+	"time"
+)
+
+// SpectralDetector splits audio into short frames and classifies each one by the
+// shape of its spectrum:
+//
+//   - band energy ratio: speech puts most of its energy between 300Hz and 3.4kHz,
+//     fans and hum mostly below it.
+//   - spectral flatness: voiced speech is a set of harmonics, while noise, including
+//     keyboard clicks, is spread evenly across frequencies.
+//   - zero-crossing rate: high for hiss and clicks, low for voiced speech.
+//
+// A run of MinSpeechFrames speech frames starts speech, and speech continues for
+// Hangover after the last speech frame, so that short pauses between words don't
+// split an utterance and single clicks don't start one.
+type SpectralDetector struct {
+	FrameSize int
+
+	// MinEnergy is the mean square amplitude below which a frame is silence.
+	MinEnergy float64
+	// MinBandRatio is the minimum share of energy in the speech band.
+	MinBandRatio float64
+	// MaxFlatness is the maximum spectral flatness, from 0 for a pure tone to 1 for
+	// white noise.
+	MaxFlatness float64
+	// MaxZeroCrossingRate is the maximum share of samples where the sign flips.
+	MaxZeroCrossingRate float64
+
+	MinSpeechFrames int
+	HangoverFrames  int
+
+	// bins of the speech band and of everything above hum
+	bandLo, bandHi int
+	lo, hi         int
+
+	window []float64
+	buf    []complex128
+
+	// pending holds samples that didn't fill a frame yet.
+	pending []float32
+	run     int
+	hang    int
+}
+
+// SpectralFrame is how long the frames classified by a SpectralDetector are.
+const SpectralFrame = 20 * time.Millisecond
+
+func NewSpectralDetector(sampleRate int) *SpectralDetector {
+	frameSize := int(int64(sampleRate) * int64(SpectralFrame) / int64(time.Second))
+	fftSize := nextPowerOfTwo(frameSize)
+
+	bin := func(hz float64) int {
+		return int(math.Round(hz * float64(fftSize) / float64(sampleRate)))
+	}
+
+	// Hann window
+	window := make([]float64, frameSize)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frameSize-1))
+	}
+
+	hangover := 200 * time.Millisecond
+
+	return &SpectralDetector{
+		FrameSize: frameSize,
+
+		MinEnergy:           1e-5,
+		MinBandRatio:        0.6,
+		MaxFlatness:         0.35,
+		MaxZeroCrossingRate: 0.25,
+
+		MinSpeechFrames: 3,
+		HangoverFrames:  int(hangover / SpectralFrame),
+
+		bandLo: bin(300),
+		bandHi: bin(3400),
+		lo:     bin(80),
+		hi:     bin(float64(sampleRate) / 2),
+
+		window: window,
+		buf:    make([]complex128, fftSize),
+	}
+}
+
+// Detect classifies every whole frame in frame, carrying leftover samples over to
+// the next call. It reports speech if at least a third of the frames were speech,
+// counting the hangover.
+func (d *SpectralDetector) Detect(frame []float32) bool {
+	samples := append(d.pending, frame...)
+
+	var frames, speech int
+	for ; len(samples) >= d.FrameSize; samples = samples[d.FrameSize:] {
+		frames++
+		if d.update(d.isSpeech(samples[:d.FrameSize])) {
+			speech++
+		}
+	}
+	d.pending = append(d.pending[:0], samples...)
+
+	if frames == 0 {
+		return d.hang > 0
+	}
+	return 3*speech >= frames
+}
+
+// update applies onset and hangover smoothing to the classification of one frame.
+func (d *SpectralDetector) update(speech bool) bool {
+	if !speech {
+		d.run = 0
+		if d.hang > 0 {
+			d.hang--
+			return true
+		}
+		return false
+	}
+
+	d.run++
+	if d.run >= d.MinSpeechFrames || d.hang > 0 {
+		d.hang = d.HangoverFrames
+		return true
+	}
+	return false
+}
+
+func (d *SpectralDetector) isSpeech(frame []float32) bool {
+	energy, zeroCrossings := 0.0, 0
+	for i, s := range frame {
+		energy += float64(s) * float64(s)
+		if i > 0 && (s >= 0) != (frame[i-1] >= 0) {
+			zeroCrossings++
+		}
+	}
+	energy /= float64(len(frame))
+	if energy < d.MinEnergy {
+		return false
+	}
+
+	zcr := float64(zeroCrossings) / float64(len(frame))
+	if zcr > d.MaxZeroCrossingRate {
+		return false
+	}
+
+	for i := range d.buf {
+		if i < len(frame) {
+			d.buf[i] = complex(float64(frame[i])*d.window[i], 0)
+		} else {
+			d.buf[i] = 0
+		}
+	}
+	fft(d.buf)
+
+	var total, band, logSum float64
+	for k := d.lo; k < d.hi; k++ {
+		re, im := real(d.buf[k]), imag(d.buf[k])
+		p := re*re + im*im + 1e-12
+		total += p
+		logSum += math.Log(p)
+		if k >= d.bandLo && k < d.bandHi {
+			band += p
+		}
+	}
+	n := float64(d.hi - d.lo)
+	flatness := math.Exp(logSum/n) / (total / n)
+	bandRatio := band / total
+
+	Logger.Debugf("energy=%.6f zcr=%.3f flatness=%.3f bandRatio=%.3f", energy, zcr, flatness, bandRatio)
+
+	return bandRatio >= d.MinBandRatio && flatness <= d.MaxFlatness
+}
@@ -0,0 +1,165 @@
+//go:build ignore
+
+// generate writes the WAV fixtures used to evaluate detectors, along with labels.json
+// marking where the speech is. The speech is synthetic: a glottal pulse train with
+// wandering pitch, shaped by vowel formants and syllable envelopes. Run it from this
+// directory with
+//
+//	go run generate.go
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"os"
+)
+
+const sampleRate = 16000
+
+type segment struct {
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+}
+
+type fixture struct {
+	File   string    `json:"file"`
+	Speech []segment `json:"speech"`
+}
+
+var speech = []segment{{2, 4.5}, {6, 7.5}}
+
+const duration = 8.0
+
+func main() {
+	rng := rand.New(rand.NewSource(1))
+
+	fixtures := []struct {
+		name  string
+		noise func(n int) []float64
+	}{
+		{"quiet.wav", func(n int) []float64 { return white(rng, n, 0.002) }},
+		{"fan.wav", func(n int) []float64 { return fan(rng, n) }},
+		{"keyboard.wav", func(n int) []float64 { return keyboard(rng, n) }},
+	}
+
+	var labels []fixture
+	for _, f := range fixtures {
+		n := int(duration * sampleRate)
+		pcm := f.noise(n)
+		for _, s := range speech {
+			voice(rng, pcm[int(s.Start*sampleRate):int(s.End*sampleRate)])
+		}
+		write(f.name, pcm)
+		labels = append(labels, fixture{File: f.name, Speech: speech})
+	}
+
+	data, err := json.MarshalIndent(labels, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile("labels.json", append(data, '\n'), 0o644); err != nil {
+		panic(err)
+	}
+}
+
+func white(rng *rand.Rand, n int, rms float64) []float64 {
+	pcm := make([]float64, n)
+	for i := range pcm {
+		pcm[i] = rng.NormFloat64() * rms
+	}
+	return pcm
+}
+
+// fan is loud low-passed noise with mains hum.
+func fan(rng *rand.Rand, n int) []float64 {
+	pcm := make([]float64, n)
+	var lp float64
+	alpha := 1 - math.Exp(-2*math.Pi*150/sampleRate)
+	for i := range pcm {
+		lp += alpha * (rng.NormFloat64() - lp)
+		hum := math.Sin(2 * math.Pi * 120 * float64(i) / sampleRate)
+		pcm[i] = 0.25*lp + 0.03*hum
+	}
+	return pcm
+}
+
+// keyboard is quiet noise with a burst of clicks for every key pressed.
+func keyboard(rng *rand.Rand, n int) []float64 {
+	pcm := white(rng, n, 0.001)
+	for at := 0; at < n; at += int((0.08 + 0.15*rng.Float64()) * sampleRate) {
+		length := int(0.008 * sampleRate)
+		for i := 0; i < length && at+i < n; i++ {
+			pcm[at+i] += 0.8 * rng.NormFloat64() * math.Exp(-float64(i)/(0.003*sampleRate))
+		}
+	}
+	return pcm
+}
+
+var vowels = [][3]float64{
+	{730, 1090, 2440}, // a
+	{270, 2290, 3010}, // i
+	{300, 870, 2240},  // u
+	{530, 1840, 2480}, // e
+	{570, 840, 2410},  // o
+}
+
+// voice adds synthetic speech to pcm.
+func voice(rng *rand.Rand, pcm []float64) {
+	phase := 0.0
+	vowel := vowels[rng.Intn(len(vowels))]
+	for i := range pcm {
+		t := float64(i) / sampleRate
+		if i%int(0.2*sampleRate) == 0 {
+			vowel = vowels[rng.Intn(len(vowels))]
+		}
+
+		f0 := 130 + 25*math.Sin(2*math.Pi*0.7*t) + 5*math.Sin(2*math.Pi*5*t)
+		phase += 2 * math.Pi * f0 / sampleRate
+
+		var s float64
+		for h := 1; float64(h)*f0 < 4000; h++ {
+			f := float64(h) * f0
+			gain := 0.0
+			for j, formant := range vowel {
+				bw := 80.0 + 40*float64(j)
+				gain += math.Exp(-(f-formant)*(f-formant)/(2*bw*bw)) / float64(j+1)
+			}
+			s += (gain + 0.02) * math.Sin(float64(h)*phase)
+		}
+
+		// syllables at about 4 per second
+		envelope := 0.3 + 0.7*math.Pow(math.Sin(math.Pi*4*t), 2)
+		pcm[i] += 0.08 * envelope * s
+	}
+}
+
+func write(name string, pcm []float64) {
+	f, err := os.Create(name)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	dataSize := uint32(2 * len(pcm))
+	header := []any{
+		[4]byte{'R', 'I', 'F', 'F'}, 36 + dataSize, [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16), uint16(1), uint16(1),
+		uint32(sampleRate), uint32(2 * sampleRate), uint16(2), uint16(16),
+		[4]byte{'d', 'a', 't', 'a'}, dataSize,
+	}
+	for _, v := range header {
+		if err := binary.Write(f, binary.LittleEndian, v); err != nil {
+			panic(err)
+		}
+	}
+
+	samples := make([]int16, len(pcm))
+	for i, s := range pcm {
+		samples[i] = int16(math.Max(-1, math.Min(1, s)) * math.MaxInt16)
+	}
+	if err := binary.Write(f, binary.LittleEndian, samples); err != nil {
+		panic(err)
+	}
+}
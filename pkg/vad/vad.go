@@ -2,9 +2,10 @@ package vad
 
 import (
 	"context"
-	"math"
+	"fmt"
 	"time"
 
+	"github.com/ajbouh/bridge/pkg/echo"
 	logr "github.com/ajbouh/bridge/pkg/log"
 	"github.com/ajbouh/bridge/pkg/router"
 	"github.com/lucsky/cuid"
@@ -13,11 +14,33 @@ import (
 var Logger = logr.New()
 
 type Engine struct {
-	sampleRateMs  int
-	pcmWindowSize int
+	sampleRate   int
+	sampleRateMs int
 
-	energyThresh  float32
-	silenceThresh float32
+	// sizes, in samples
+	pcmWindowSize int
+	maxWindowSize int
+	preRollSize   int
+	minSpeechSize int
+
+	// sizes, in analysis windows
+	draftWindows    int
+	hangoverWindows int
+
+	detector Detector
+	floor    *NoiseFloor
+	// floorFreezeWindows is how many analysis windows of speech in a row keep the
+	// noise floor from following the room, and speechWindows how many there were.
+	floorFreezeWindows int
+	speechWindows      int
+	// echo, if set, recognizes audio played into the session. Every engine of a
+	// session shares it.
+	echo *echo.Detector
+
+	// onsetSNR and offsetSNR are how far above the noise floor, in dB, audio has to
+	// be to start speech and to keep it going.
+	onsetSNR  float64
+	offsetSNR float64
 
 	// Buffer to store new audio. When this fills up we will try to run inference
 	pcmWindow []float32
@@ -28,60 +51,162 @@ type Engine struct {
 	window  []float32
 	counter int
 
+	// preRoll holds the most recent audio from before speech started.
+	preRoll []float32
+	// speech counts the samples in window that were detected as speech, and
+	// silentWindows how many analysis windows in a row weren't.
+	speech        int
+	silentWindows int
+
 	audioCh chan<- *router.CapturedAudio
 
+	// source is the participant whose samples the engine detects speech in.
+	source string
+
 	isSpeaking bool
-}
 
-type Config struct {
-	// // This is determined by the hyperparameter configuration that whisper was trained on.
-	// // See more here: https://github.com/ggerganov/whisper.cpp/issues/909
-	SampleRate int //   = 16000 // 16kHz
-	// sampleRateMs = SampleRate / 1000
-	// // This determines how much audio we will be passing to whisper inference.
-	// // We will buffer up to (whisperSampleWindowMs - pcmSampleRateMs) of old audio and then add
-	// // audioSampleRateMs of new audio onto the end of the buffer for inference
-	SampleWindow time.Duration // = 24000 // 24 second sample window
-	// windowSize     = sampleWindowMs * sampleRateMs
-	// // This determines how often we will try to run inference.
-	// // We will buffer (pcmSampleRateMs * whisperSampleRate / 1000) samples and then run inference
-	// pcmSampleRateMs = 500 // FIXME PLEASE MAKE ME AN CONFIG PARAM
-	// pcmWindowSize   = pcmSampleRateMs * sampleRateMs
+	// next is the media time, in samples, right after the most recent sample, and
+	// windowStart that of the first sample in window. Counting samples rather than
+	// milliseconds keeps timestamps exact however the audio is chunked.
+	next        int64
+	synced      bool
+	windowStart int64
 }
 
-func NewEngine(config Config, audioCh chan<- *router.CapturedAudio) *Engine {
+// maxClockSkew is how far, in milliseconds, the timestamp of captured samples may be
+// from where the samples before them ended before we assume audio was lost and jump
+// to it.
+const maxClockSkew = 2
+
+func NewEngine(config Config, audioCh chan<- *router.CapturedAudio) (*Engine, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	config = config.withDefaults()
+
+	detector, err := NewDetector(config.Detector, config.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+
 	sampleRateMs := config.SampleRate / 1000
-	windowSize := int(config.SampleWindow.Milliseconds()) * sampleRateMs
-	pcmSampleRateMs := 500
-	pcmWindowSize := pcmSampleRateMs * sampleRateMs
-	return &Engine{
-		sampleRateMs:  sampleRateMs,
-		pcmWindowSize: pcmWindowSize,
-		window:        make([]float32, 0, windowSize),
-		pcmWindow:     make([]float32, 0, pcmWindowSize),
-		audioCh:       audioCh,
-		isSpeaking:    false,
-
-		// this is an arbitrary number I picked after testing a bit
-		// feel free to play around
-		energyThresh:  0.0005,
-		silenceThresh: 0.015,
+	samples := func(d time.Duration) int {
+		return int(d.Milliseconds()) * sampleRateMs
 	}
+	pcmWindowSize := samples(config.AnalysisWindow)
+
+	return &Engine{
+		sampleRate:      config.SampleRate,
+		sampleRateMs:    sampleRateMs,
+		pcmWindowSize:   pcmWindowSize,
+		maxWindowSize:   samples(config.SampleWindow),
+		preRollSize:     samples(config.PreRoll),
+		minSpeechSize:   samples(config.MinSpeech),
+		draftWindows:    config.windows(config.DraftInterval),
+		hangoverWindows: config.windows(config.Hangover),
+		window:          make([]float32, 0, samples(config.SampleWindow)),
+		pcmWindow:       make([]float32, 0, pcmWindowSize),
+		preRoll:         make([]float32, 0, samples(config.PreRoll)+pcmWindowSize),
+		audioCh:         audioCh,
+		isSpeaking:      false,
+		detector:        detector,
+		floor:           NewNoiseFloor(config.SampleRate, config.NoiseFloorWindow),
+		// Speech that goes on for this long is more likely the room changing.
+		floorFreezeWindows: config.windows(noiseFloorFreeze),
+		onsetSNR:           config.OnsetSNR,
+		offsetSNR:          config.OffsetSNR,
+	}, nil
 }
 
+// New returns a middleware that runs a separate Engine for each source, so that
+// people talking over each other don't end up in the same window.
 func New(config Config) router.MiddlewareFunc {
 	return func(ctx context.Context, emit router.Emitters) (router.Listeners, error) {
-		e := NewEngine(config, emit.CapturedAudio)
+		if err := config.Validate(); err != nil {
+			return router.Listeners{}, fmt.Errorf("invalid vad config: %w", err)
+		}
 
 		ch := make(chan *router.CapturedSample, 100)
+		status := make(chan *router.Status, 100)
+
+		var echoes *echo.Detector
+		var played chan *router.PlayedAudio
+		if config.Echo != nil {
+			echoes = echo.NewDetector(*config.Echo)
+			played = make(chan *router.PlayedAudio, 100)
+		}
+
+		done := make(chan struct{})
 		go func() {
-			for s := range ch {
-				e.write(s.PCM, s.EndTimestamp)
+			defer close(done)
+			engines := map[string]*Engine{}
+			defer func() {
+				for _, e := range engines {
+					e.flush()
+				}
+				// Keep the status and played audio streams moving until the router
+				// closes them.
+				go func() {
+					for range status {
+					}
+				}()
+				if played != nil {
+					go func() {
+						for range played {
+						}
+					}()
+				}
+			}()
+
+			for {
+				select {
+				case s, ok := <-ch:
+					if !ok {
+						return
+					}
+					e := engines[s.Source]
+					if e == nil {
+						// The config was validated above, so this can't fail.
+						e, _ = NewEngine(config, emit.CapturedAudio)
+						e.source = s.Source
+						e.echo = echoes
+						engines[s.Source] = e
+					}
+					e.write(s.PCM, s.StartTimestamp)
+				case p, ok := <-played:
+					if !ok {
+						played = nil
+						continue
+					}
+					echoes.Played(p)
+				case st, ok := <-status:
+					if !ok {
+						status = nil
+						continue
+					}
+					// Let go of the engines of participants who left, along with
+					// whatever they said last.
+					present := map[string]bool{}
+					if st.Participants != nil {
+						for _, p := range *st.Participants {
+							present[p.ID] = true
+						}
+					}
+					for source, e := range engines {
+						if source != "" && !present[source] {
+							e.flush()
+							delete(engines, source)
+						}
+					}
+				}
 			}
 		}()
 
 		return router.Listeners{
 			CapturedSample: ch,
+			Status:         status,
+			PlayedAudio:    played,
+			Done:           done,
 		}, nil
 	}
 }
@@ -91,116 +216,178 @@ func New(config Config) router.MiddlewareFunc {
 // and am hacking towards what I want to demo. Use at your own risk :D
 // XXX DANGER XXX
 //
-// writeVAD only buffers audio if somone is speaking. It will run inference after the audio transitions from
+// write only buffers audio if somone is speaking. It will run inference after the audio transitions from
 // speaking to not speaking
-func (e *Engine) write(pcm []float32, endTimestamp uint32) {
+func (e *Engine) write(pcm []float32, startTimestamp uint64) {
 	// TODO normalize PCM and see if we can make it better
-	// endTimestamp is the latest packet timestamp + len of the audio in the packet
-	// FIXME make these timestamps make sense
 
-	if e.windowID == "" {
-		e.windowID = cuid.New()
+	start := int64(startTimestamp) * int64(e.sampleRateMs)
+	tolerance := maxClockSkew * int64(e.sampleRateMs)
+	if skew := start - e.next; !e.synced || skew > tolerance || skew < -tolerance {
+		if e.synced {
+			Logger.Debugf("media clock jumped by %dms source=%s", skew/int64(e.sampleRateMs), e.source)
+		}
+		e.next = start
+		e.synced = true
 	}
+	e.next += int64(len(pcm))
 
-	if len(e.pcmWindow)+len(pcm) > e.pcmWindowSize {
-		// This shouldn't happen hopefully...
-		Logger.Infof("GOING TO OVERFLOW PCM WINDOW BY %d", len(e.pcmWindow)+len(pcm)-e.pcmWindowSize)
-	}
 	e.pcmWindow = append(e.pcmWindow, pcm...)
+	for len(e.pcmWindow) >= e.pcmWindowSize {
+		// Samples beyond this analysis window wait for the next one.
+		e.analyze(e.pcmWindow[:e.pcmWindowSize], e.next-int64(len(e.pcmWindow)))
+		e.pcmWindow = append(e.pcmWindow[:0], e.pcmWindow[e.pcmWindowSize:]...)
+	}
+}
 
-	if len(e.pcmWindow) >= e.pcmWindowSize {
-		// reset window
-		defer func() {
-			e.pcmWindow = e.pcmWindow[:0]
-		}()
-
-		isSpeaking, energy, silence := VAD(e.pcmWindow, e.energyThresh, e.silenceThresh)
-
-		defer func() {
-			e.isSpeaking = isSpeaking
-		}()
-
-		if !isSpeaking && !e.isSpeaking {
-			// by having this here it gives us a bit of an opportunity to pause in our speech
-			if len(e.window) != 0 {
-				e.audioCh <- &router.CapturedAudio{
-					ID:           e.windowID,
-					Final:        true,
-					PCM:          append([]float32(nil), e.window...),
-					EndTimestamp: uint64(endTimestamp),
-					// HACK surely there's a better way to calculate this?
-					StartTimestamp: uint64(endTimestamp) - uint64(len(e.window)/e.sampleRateMs),
-				}
-				e.windowID = ""
-				e.counter = 0
-
-				e.window = e.window[:0]
+// analyze decides whether a full analysis window, starting at media time start in
+// samples, is speech and moves the utterance along accordingly.
+func (e *Engine) analyze(pcm []float32, start int64) {
+	isSpeaking := e.detect(pcm)
+
+	if !e.isSpeaking {
+		if !isSpeaking {
+			// not speaking, just remember the audio in case speech starts next
+			Logger.Debugf("NOT SPEAKING endTimestamp=%d ", e.millis(start+int64(len(pcm))))
+			e.preRoll = append(e.preRoll, pcm...)
+			if over := len(e.preRoll) - e.preRollSize; over > 0 {
+				e.preRoll = append(e.preRoll[:0], e.preRoll[over:]...)
 			}
-			// not speaking do nothing
-			Logger.Debugf("NOT SPEAKING energy=%#v (energyThreshold=%#v) silence=%#v (silenceThreshold=%#v) endTimestamp=%d ", energy, e.energyThresh, silence, e.silenceThresh, endTimestamp)
 			return
 		}
 
-		if isSpeaking && e.isSpeaking {
-			Logger.Debug("STILL SPEAKING")
-			// add to buffer and wait
-			// FIXME make sure we have space
-		}
+		Logger.Debug("JUST STARTED SPEAKING")
+		e.isSpeaking = true
+		e.windowID = cuid.New()
+		e.window = append(e.window[:0], e.preRoll...)
+		e.windowStart = start - int64(len(e.preRoll))
+		e.preRoll = e.preRoll[:0]
+	}
 
-		if isSpeaking && !e.isSpeaking {
-			Logger.Debug("JUST STARTED SPEAKING")
-			e.isSpeaking = isSpeaking
-			// we just started speaking, add to buffer and wait
-			// FIXME make sure we have space
-		}
+	if isSpeaking {
+		Logger.Debug("STILL SPEAKING")
+		e.speech += len(pcm)
+		e.silentWindows = 0
+	} else {
+		e.silentWindows++
+	}
 
-		if !isSpeaking && e.isSpeaking {
-			Logger.Debug("JUST STOPPED SPEAKING")
-			// TODO consider waiting for a few more samples?
-		}
+	// The utterance goes on through the hangover and ends with its last window, or
+	// right after the speech without one.
+	if e.silentWindows <= e.hangoverWindows {
+		e.window = append(e.window, pcm...)
+	}
+	if !isSpeaking && e.silentWindows >= e.hangoverWindows {
+		Logger.Debug("JUST STOPPED SPEAKING")
+		e.flush()
+		e.isSpeaking = false
+		return
+	}
 
-		e.window = append(e.window, e.pcmWindow...)
+	if len(e.window)+e.pcmWindowSize > e.maxWindowSize {
+		// Whoever is talking has gone on for as long as we can transcribe at once,
+		// so cut the utterance here and carry on with a new one.
+		Logger.Debug("SPLITTING LONG UTTERANCE")
+		e.flush()
+		e.windowID = cuid.New()
+		e.windowStart = start + int64(len(pcm))
+		return
+	}
 
-		if e.counter%3 == 0 {
-			e.audioCh <- &router.CapturedAudio{
-				ID:           e.windowID,
-				Final:        false,
-				PCM:          append([]float32(nil), e.window...),
-				EndTimestamp: uint64(endTimestamp),
-				// HACK surely there's a better way to calculate this?
-				StartTimestamp: uint64(endTimestamp) - uint64(len(e.window)/e.sampleRateMs),
-			}
-		}
-		e.counter++
+	if e.counter%e.draftWindows == 0 && e.speech >= e.minSpeechSize {
+		e.audioCh <- e.label(&router.CapturedAudio{
+			ID:             e.windowID,
+			Source:         e.source,
+			Final:          false,
+			PCM:            append([]float32(nil), e.window...),
+			StartTimestamp: e.millis(e.windowStart),
+			EndTimestamp:   e.millis(e.windowStart + int64(len(e.window))),
+		})
 	}
+	e.counter++
 }
 
-// NOTE This is a very rough implemntation. We should improve it :D
-// VAD performs voice activity detection on a frame of audio data.
-func VAD(frame []float32, energyThresh, silenceThresh float32) (bool, float32, float32) {
-	// Compute frame energy
-	energy := float32(0)
-	for i := 0; i < len(frame); i++ {
-		energy += frame[i] * frame[i]
+// detect decides whether pcm is speech. The detector has to hear speech, and pcm has
+// to stand out from the noise floor of the stream by onsetSNR to start speech, or by
+// offsetSNR to keep it going.
+//
+// Only audio that isn't speech updates the noise floor afterwards, so speech never
+// raises its own floor. Until the floor is known, pcm stands in for it: steady noise
+// is its own floor, while speech pauses between words.
+func (e *Engine) detect(pcm []float32) bool {
+	known := e.floor.Power() != 0
+	if !known {
+		e.floor.Update(pcm)
+	}
+	floor := e.floor.Power()
+	snr := e.floor.SNR(pcm)
+
+	threshold := e.onsetSNR
+	if e.isSpeaking {
+		threshold = e.offsetSNR
+	}
+
+	detected := e.detector.Detect(pcm)
+	Logger.Debugf("source=%s noiseFloor=%.1fdBFS snr=%.1fdB threshold=%.1fdB detected=%v", e.source, decibels(floor), snr, threshold, detected)
+
+	speech := detected && snr >= threshold
+	if speech {
+		e.speechWindows++
+	} else {
+		e.speechWindows = 0
 	}
-	energy /= float32(len(frame))
+	if known && (!speech || e.speechWindows > e.floorFreezeWindows) {
+		e.floor.Update(pcm)
+	}
+	return speech
+}
 
-	// Compute frame silence
-	silence := float32(0)
-	for i := 0; i < len(frame); i++ {
-		silence += float32(math.Abs(float64(frame[i])))
+// flush emits whatever is in the window as final audio, unless it holds too little
+// speech to bother with.
+func (e *Engine) flush() {
+	if len(e.window) != 0 && e.speech >= e.minSpeechSize {
+		e.audioCh <- e.label(&router.CapturedAudio{
+			ID:             e.windowID,
+			Source:         e.source,
+			Final:          true,
+			PCM:            append([]float32(nil), e.window...),
+			StartTimestamp: e.millis(e.windowStart),
+			EndTimestamp:   e.millis(e.windowStart + int64(len(e.window))),
+		})
 	}
-	silence /= float32(len(frame))
+	e.windowID = ""
+	e.counter = 0
+	e.speech = 0
+	e.silentWindows = 0
+	e.window = e.window[:0]
+}
 
-	// Apply energy threshold
-	if energy < energyThresh {
-		return false, energy, silence
+// millis converts media time in samples to milliseconds.
+func (e *Engine) millis(samples int64) uint64 {
+	if samples < 0 {
+		return 0
 	}
+	return uint64(samples / int64(e.sampleRateMs))
+}
 
-	// Apply silence threshold
-	if silence < silenceThresh {
-		return false, energy, silence
+// label describes audio before it's passed along.
+func (e *Engine) label(audio *router.CapturedAudio) *router.CapturedAudio {
+	e.levels(audio)
+
+	if e.echo != nil {
+		id, correlation := e.echo.Check(audio, e.sampleRate)
+		Logger.Debugf("source=%s audio=%s echoOf=%q correlation=%.2f", e.source, audio.ID, id, correlation)
+		audio.EchoOf = id
 	}
+	return audio
+}
 
-	return true, energy, silence
+// levels records the noise floor of the stream and how far audio stands out from it.
+func (e *Engine) levels(audio *router.CapturedAudio) *router.CapturedAudio {
+	if e.floor.Power() == 0 {
+		return audio
+	}
+	audio.NoiseFloor = float32(decibels(e.floor.Power()))
+	audio.SNR = float32(e.floor.SNR(audio.PCM))
+	return audio
 }
@@ -1,6 +1,10 @@
 package vad_test
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/ajbouh/bridge/pkg/vad"
+)
 
 func TestVAD(t *testing.T) {
 	// Define test cases with input frames and expected output
@@ -27,7 +31,7 @@ func TestVAD(t *testing.T) {
 
 	// Run the test cases
 	for _, tc := range testCases {
-		result, _, _ := VAD(tc.frame)
+		result, _, _ := vad.VAD(tc.frame, vad.DefaultEnergyThreshold, vad.DefaultSilenceThreshold)
 
 		// Check if the output matches the expected result
 		if result != tc.expectedOutput {
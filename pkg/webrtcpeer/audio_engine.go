@@ -1,12 +1,15 @@
 package webrtcpeer
 
 import (
+	"context"
+	"fmt"
 	"math"
-	"sync/atomic"
 	"time"
 
+	"github.com/ajbouh/bridge/pkg/mediaclock"
 	"github.com/ajbouh/bridge/pkg/router"
 	"github.com/ajbouh/bridge/pkg/webrtcpeer/internal"
+	"github.com/ajbouh/bridge/pkg/webrtcpeer/jitter"
 
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3/pkg/media"
@@ -18,6 +21,11 @@ const (
 	outgoingChannels    = 2     // we use 2 outgoingChannels for the output
 	outgoingFrameSizeMs = 20
 	incomingFrameSizeMs = 60
+
+	// jitterTick is how often we check whether packets missing from a track are lost.
+	jitterTick = 10 * time.Millisecond
+	// trackStatsInterval is how often the packet stats of each track are logged.
+	trackStatsInterval = 30 * time.Second
 )
 
 var outgoingFrameSize = outgoingChannels * outgoingFrameSizeMs * sampleRate / 1000
@@ -26,64 +34,97 @@ var incomingFrameSize = incomingChannels * incomingFrameSizeMs * sampleRate / 10
 // AudioEngine is used to convert RTP Opus packets to raw PCM audio to be sent to Whisper
 // and to convert raw PCM audio from Coqui back to RTP Opus packets to be sent back over WebRTC
 type AudioEngine struct {
-	// RTP Opus packets to be converted to PCM
-	rtpIn chan *rtp.Packet
 	// RTP Opus packets converted from PCM to be sent over WebRTC
 	mediaOut chan media.Sample
 
-	dec *internal.OpusDecoder
 	enc *internal.OpusEncoder
 
-	// slice to hold raw pcm data during decoding
-	incomingPCM []float32
-
-	firstTimeStamp  uint32
-	latestTimeStamp uint32
-	capture         chan<- *router.CapturedSample
-
-	// shouldInfer determines if we should run TTS inference or not
-	shouldInfer atomic.Bool
+	// clock is what every track's timestamps are measured with.
+	clock   *mediaclock.Clock
+	capture chan<- *router.CapturedSample
 }
 
-func NewAudioEngine(capture chan<- *router.CapturedSample) (*AudioEngine, error) {
-	dec, err := internal.NewOpusDecoder(sampleRate, incomingChannels)
-	if err != nil {
-		return nil, err
-	}
-
+func NewAudioEngine(clock *mediaclock.Clock, capture chan<- *router.CapturedSample) (*AudioEngine, error) {
 	enc, err := internal.NewOpusEncoder(outgoingChannels, outgoingFrameSizeMs)
 	if err != nil {
 		return nil, err
 	}
 
-	var shouldInfer atomic.Bool
-	shouldInfer.Store(true)
-
 	ae := &AudioEngine{
-		rtpIn:          make(chan *rtp.Packet),
-		mediaOut:       make(chan media.Sample),
-		incomingPCM:    make([]float32, incomingFrameSize),
-		dec:            dec,
-		enc:            enc,
-		capture:        capture,
-		firstTimeStamp: 0,
-		shouldInfer:    shouldInfer,
+		mediaOut: make(chan media.Sample),
+		enc:      enc,
+		clock:    clock,
+		capture:  capture,
 	}
-
 	return ae, nil
 }
 
-func (a *AudioEngine) RtpIn() chan<- *rtp.Packet {
-	return a.rtpIn
-}
-
 func (a *AudioEngine) MediaOut() <-chan media.Sample {
 	return a.mediaOut
 }
 
 func (a *AudioEngine) Start() {
 	Logger.Info("Starting audio engine")
-	go a.decode()
+}
+
+// AddTrack starts decoding the RTP Opus packets of one remote track, with its own
+// decoder, and captures them as samples from source. clockRate is that of the track's
+// RTP timestamps. Close the returned channel when the track ends.
+func (a *AudioEngine) AddTrack(source string, clockRate uint32) (chan<- *rtp.Packet, error) {
+	dec, err := internal.NewOpusDecoder(sampleRate, incomingChannels)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &trackDecoder{
+		source: source,
+		dec:    dec,
+		pcm:    make([]float32, incomingFrameSize),
+		// Tracks join at different times, so line their timestamps up with the
+		// engine's clock.
+		clock:     a.clock.RTP(int(clockRate)),
+		clockRate: int(clockRate),
+		jitter:    jitter.New(jitter.DefaultDelay, jitter.DefaultMaxPackets),
+		capture:   a.capture,
+	}
+
+	rtpIn := make(chan *rtp.Packet)
+	go func() {
+		Logger.Infof("decoding track from %s", source)
+
+		ticker := time.NewTicker(jitterTick)
+		defer ticker.Stop()
+		stats := time.NewTicker(trackStatsInterval)
+		defer stats.Stop()
+
+		for {
+			select {
+			case pkt, ok := <-rtpIn:
+				if !ok {
+					for _, f := range t.jitter.Flush() {
+						t.decodeFrame(f)
+					}
+					Logger.Infof("track from %s ended: %s", source, t.stats())
+					return
+				}
+				t.jitter.Push(pkt, time.Now())
+			case <-ticker.C:
+			case <-stats.C:
+				Logger.Infof("track from %s: %s", source, t.stats())
+				continue
+			}
+
+			for {
+				f, ok := t.jitter.Pop(time.Now())
+				if !ok {
+					break
+				}
+				t.decodeFrame(f)
+			}
+		}
+	}()
+
+	return rtpIn, nil
 }
 
 // Encode takes in raw f32le pcm, encodes it into opus RTP packets and sends those over the rtpOut chan
@@ -93,22 +134,45 @@ func (a *AudioEngine) Encode(pcm []float32, inputChannelCount, inputSampleRate i
 		Logger.Error(err, "error encoding pcm")
 	}
 
-	go a.sendMedia(opusFrames)
+	go a.sendMedia(context.Background(), opusFrames)
 
 	return nil
 }
 
-// sendMedia turns opus frames into media samples and sends them on the channel
-func (a *AudioEngine) sendMedia(frames []internal.OpusFrame) {
+// Play encodes pcm and sends it on the outgoing track, paced in real time, returning
+// once it has all been sent or ctx is done, whichever comes first. Calls must not
+// overlap, so what's played isn't mixed up.
+func (a *AudioEngine) Play(ctx context.Context, pcm []float32, inputChannelCount, inputSampleRate int) error {
+	opusFrames, err := a.enc.Encode(pcm, inputChannelCount, inputSampleRate)
+	if err != nil {
+		return err
+	}
+
+	a.sendMedia(ctx, opusFrames)
+	return ctx.Err()
+}
+
+// sendMedia turns opus frames into media samples and sends them on the channel,
+// stopping early if ctx is done.
+func (a *AudioEngine) sendMedia(ctx context.Context, frames []internal.OpusFrame) {
+	pace := time.NewTicker(time.Millisecond * outgoingFrameSizeMs)
+	defer pace.Stop()
+
 	for _, f := range frames {
 		sample := convertOpusToSample(f)
-		a.mediaOut <- sample
+		select {
+		case a.mediaOut <- sample:
+		case <-ctx.Done():
+			return
+		}
+
 		// this is important to properly pace the samples
-		time.Sleep(time.Millisecond * outgoingFrameSizeMs)
+		select {
+		case <-pace.C:
+		case <-ctx.Done():
+			return
+		}
 	}
-
-	// start inferring audio again
-	// a.Unpause()
 }
 
 func convertOpusToSample(frame internal.OpusFrame) media.Sample {
@@ -119,52 +183,107 @@ func convertOpusToSample(frame internal.OpusFrame) media.Sample {
 	}
 }
 
-// decode reads over the in channel in a loop, decodes the RTP packets to raw PCM and sends the data on another channel
-func (a *AudioEngine) decode() {
-	for {
-		pkt, ok := <-a.rtpIn
-		if !ok {
-			Logger.Info("rtpIn channel closed...")
-			return
-		}
-		if !a.shouldInfer.Load() {
-			continue
-		}
-		if a.firstTimeStamp == 0 {
-			Logger.Debug("Resetting timestamp bc firstTimeStamp is 0...  ", pkt.Timestamp)
-			a.firstTimeStamp = pkt.Timestamp
-		}
+// trackDecoder decodes the packets of a single remote track.
+type trackDecoder struct {
+	source string
+	dec    *internal.OpusDecoder
 
-		if pkt.Timestamp < a.latestTimeStamp {
-			Logger.Debug("Out of order packet!", pkt.Timestamp, "<", a.latestTimeStamp)
-			a.latestTimeStamp = pkt.Timestamp
-		} else {
-			a.latestTimeStamp = pkt.Timestamp
+	// slice to hold raw pcm data during decoding
+	pcm []float32
+
+	clock     *mediaclock.RTPClock
+	clockRate int
+
+	// jitter puts packets back in order and tells us which ones were lost.
+	jitter *jitter.Buffer
+	// lastTimestamp and lastSamples are the RTP timestamp and length of the last
+	// packet we decoded or made up, which is where a lost packet goes and how long
+	// it was, near enough.
+	lastTimestamp uint32
+	lastSamples   int
+	// recovered counts lost packets we got back with forward error correction and
+	// concealed those we had to make up.
+	recovered int
+	concealed int
+
+	capture chan<- *router.CapturedSample
+}
+
+func (t *trackDecoder) stats() string {
+	return fmt.Sprintf("%s recovered=%d concealed=%d", t.jitter.Stats(), t.recovered, t.concealed)
+}
+
+// decodeFrame decodes the next frame of the track. Lost packets are recovered from
+// the forward error correction data in the packet after them if it has arrived,
+// and concealed otherwise, so the audio we capture has no holes.
+func (t *trackDecoder) decodeFrame(f jitter.Frame) {
+	if !f.Lost() {
+		if err := t.decode(f.Packet.Timestamp, f.Packet.Payload); err != nil {
+			Logger.Error(err, "error decoding opus packet", "source", t.source)
 		}
+		return
+	}
+
+	if t.lastSamples == 0 {
+		// Nothing to go on yet
+		return
+	}
 
-		if _, err := a.decodePacket(pkt); err != nil {
-			Logger.Error(err, "error decoding opus packet ")
+	timestamp := t.lastTimestamp + uint32(t.lastSamples*t.clockRate/sampleRate)
+	if f.Next != nil {
+		err := t.recover(timestamp, func(pcm []float32) error {
+			return t.dec.DecodeFEC(f.Next.Payload, pcm)
+		})
+		if err == nil {
+			t.recovered++
+			return
 		}
+		Logger.Debugf("error recovering lost packet from %s with fec: %s", t.source, err)
+	}
+
+	if err := t.recover(timestamp, t.dec.DecodePLC); err != nil {
+		Logger.Error(err, "error concealing lost packet", "source", t.source)
+		return
+	}
+	t.concealed++
+}
+
+// recover fills in a lost packet at timestamp with decode.
+func (t *trackDecoder) recover(timestamp uint32, decode func(pcm []float32) error) error {
+	pcm := t.pcm[:t.lastSamples*incomingChannels]
+	if err := decode(pcm); err != nil {
+		return err
 	}
+	t.emit(timestamp, pcm, t.lastSamples)
+	return nil
 }
 
-func (a *AudioEngine) decodePacket(pkt *rtp.Packet) (int, error) {
-	incomingSamplesPerChannel, err := a.dec.Decode(pkt.Payload, a.incomingPCM)
+func (t *trackDecoder) decode(timestamp uint32, payload []byte) error {
 	// we decode to float32 here since that is what whisper.cpp takes
+	incomingSamplesPerChannel, err := t.dec.Decode(payload, t.pcm)
 	if err != nil {
-		Logger.Error(err, "error decoding fb packet")
-		return 0, err
-	} else {
-		timestampMS := (pkt.Timestamp - a.firstTimeStamp) / ((sampleRate / 1000) * 3)
-		lengthOfRecordingMs := uint32(incomingSamplesPerChannel / (sampleRate / 1000))
-		timestampRecordingEnds := timestampMS + lengthOfRecordingMs
-		incomingPCM := a.incomingPCM[:incomingSamplesPerChannel*incomingChannels]
-
-		a.capture <- &router.CapturedSample{
-			PCM:          incomingPCM,
-			EndTimestamp: timestampRecordingEnds,
-		}
-		return incomingSamplesPerChannel, nil
+		return err
+	}
+
+	t.emit(timestamp, t.pcm[:incomingSamplesPerChannel*incomingChannels], incomingSamplesPerChannel)
+	return nil
+}
+
+// emit captures decoded samples that start at the RTP timestamp.
+func (t *trackDecoder) emit(timestamp uint32, decoded []float32, samplesPerChannel int) {
+	t.lastTimestamp = timestamp
+	t.lastSamples = samplesPerChannel
+
+	start, end := t.clock.Span(timestamp, samplesPerChannel, sampleRate)
+
+	// Listeners hold on to the samples, so don't hand them the decode buffer.
+	pcm := append([]float32(nil), decoded...)
+
+	t.capture <- &router.CapturedSample{
+		Source:         t.source,
+		PCM:            pcm,
+		StartTimestamp: start,
+		EndTimestamp:   end,
 	}
 }
 
@@ -0,0 +1,95 @@
+package webrtcpeer
+
+import (
+	"encoding/json"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+// relayEvents sends status updates and document changes to whatever data channel is
+// currently open, until both streams are closed. When a new data channel opens, after
+// reconnecting, it first catches the room up on the latest status and the whole
+// document, since whatever happened in between was never sent. The document is
+// preceded by a reset, so transcriptions removed in between don't linger.
+func (s *Peer) relayEvents() {
+	statusStream := s.config.StatusStream
+	changeStream := s.config.ChangeStream
+
+	var status *router.Status
+	var document router.Document
+
+	for statusStream != nil || changeStream != nil {
+		select {
+		case st, ok := <-statusStream:
+			if !ok {
+				statusStream = nil
+				continue
+			}
+			status = st
+			s.sendEvent(statusEvent(st))
+		case change, ok := <-changeStream:
+			if !ok {
+				changeStream = nil
+				continue
+			}
+			document = change.Document
+			s.sendEvent(changeEvent(change))
+		case <-s.resync:
+			Logger.Infof("sending %d transcriptions to new data channel", document.Len())
+			if status != nil {
+				s.sendEvent(statusEvent(status))
+			}
+			s.sendEvent(map[string]any{"type": "reset"})
+			document.Each(func(t *router.Transcription) bool {
+				s.sendEvent(changeEvent(&router.DocumentChange{
+					Kind:          router.TranscriptionAdded,
+					Transcription: t,
+				}))
+				return true
+			})
+		}
+	}
+}
+
+func statusEvent(status *router.Status) map[string]any {
+	return map[string]any{
+		"type":   "status",
+		"detail": status,
+	}
+}
+
+func changeEvent(change *router.DocumentChange) map[string]any {
+	if change.Kind == router.TranscriptionRemoved {
+		return map[string]any{
+			"type":   "transcription_removed",
+			"detail": map[string]string{"id": change.ID()},
+		}
+	}
+	return map[string]any{
+		"type":   "transcription",
+		"detail": change.Transcription,
+	}
+}
+
+// sendEvent sends event on the current data channel. Events are dropped while no
+// data channel is open; the next one to open is resynced.
+func (s *Peer) sendEvent(event map[string]any) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		Logger.Error(err, "error marshalling event", "type", event["type"])
+		return
+	}
+
+	s.mu.Lock()
+	rtc := s.rtc
+	s.mu.Unlock()
+
+	if rtc == nil {
+		return
+	}
+	if err := rtc.SendEvent(data); err != nil {
+		Logger.Debugf("dropping %s event: %s", event["type"], err)
+		return
+	}
+	Logger.Debugf("sent %s on data channel", data)
+}
@@ -20,3 +20,15 @@ func NewOpusDecoder(sampleRate, channels int) (*OpusDecoder, error) {
 func (o *OpusDecoder) Decode(data []byte, buf []float32) (int, error) {
 	return o.dec.DecodeFloat32(data, buf)
 }
+
+// DecodeFEC recovers the packet lost right before data from the forward error
+// correction data in it. buf must be exactly as long as the lost packet.
+func (o *OpusDecoder) DecodeFEC(data []byte, buf []float32) error {
+	return o.dec.DecodeFECFloat32(data, buf)
+}
+
+// DecodePLC conceals a lost packet by extrapolating from the ones before it. buf
+// must be exactly as long as the lost packet.
+func (o *OpusDecoder) DecodePLC(buf []float32) error {
+	return o.dec.DecodePLCFloat32(buf)
+}
@@ -0,0 +1,191 @@
+// Package jitter puts the RTP packets of a stream back in order and decides when a
+// missing packet is lost for good, so whatever decodes them sees a continuous stream
+// even on a lossy network.
+package jitter
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// DefaultDelay is how long a packet waits for the ones before it.
+	DefaultDelay = 60 * time.Millisecond
+	// DefaultMaxPackets is how many packets are held at most. A buffer this full
+	// gives up on the packets it's waiting for, however recently the others came.
+	DefaultMaxPackets = 50
+	// maxGap is the most packets in a row we report as lost. A bigger jump means the
+	// sender restarted or paused its stream, and concealing all of it would only
+	// make up audio nobody sent.
+	maxGap = 25
+)
+
+// Frame is the next packet of the stream, or a hole where it should have been.
+type Frame struct {
+	// Packet is nil if the packet was lost.
+	Packet *rtp.Packet
+	// Next is the packet right after a lost one, if it has already arrived. Codecs
+	// with in-band forward error correction can recover the lost packet from it.
+	Next *rtp.Packet
+}
+
+func (f Frame) Lost() bool {
+	return f.Packet == nil
+}
+
+// Stats counts what happened to the packets of a stream.
+type Stats struct {
+	Received   int
+	Lost       int
+	Late       int
+	Duplicates int
+	Reordered  int
+	// Skipped counts packets missing from gaps too big to report as lost.
+	Skipped int
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("received=%d lost=%d late=%d duplicates=%d reordered=%d skipped=%d",
+		s.Received, s.Lost, s.Late, s.Duplicates, s.Reordered, s.Skipped)
+}
+
+type entry struct {
+	seq     int64
+	packet  *rtp.Packet
+	arrival time.Time
+}
+
+// Buffer reorders packets by sequence number. It isn't safe for concurrent use.
+type Buffer struct {
+	delay      time.Duration
+	maxPackets int
+
+	// packets waiting to be popped, sorted by sequence number
+	packets []entry
+
+	// next is the extended sequence number of the packet to pop next, and highest
+	// the highest one pushed so far.
+	next    int64
+	highest int64
+	started bool
+
+	stats Stats
+}
+
+// New returns a buffer that holds packets for up to delay and at most maxPackets at
+// a time. Zero picks DefaultDelay and DefaultMaxPackets.
+func New(delay time.Duration, maxPackets int) *Buffer {
+	if delay == 0 {
+		delay = DefaultDelay
+	}
+	if maxPackets == 0 {
+		maxPackets = DefaultMaxPackets
+	}
+	return &Buffer{delay: delay, maxPackets: maxPackets}
+}
+
+// Push adds a packet that arrived at now.
+func (b *Buffer) Push(pkt *rtp.Packet, now time.Time) {
+	if !b.started {
+		b.next = int64(pkt.SequenceNumber)
+		b.highest = b.next
+		b.started = true
+	}
+
+	// Like RTP timestamps, sequence numbers wrap around, so place each one relative
+	// to the highest seen so far.
+	seq := b.highest + int64(int16(pkt.SequenceNumber-uint16(b.highest)))
+
+	if seq < b.next {
+		b.stats.Late++
+		return
+	}
+
+	i := sort.Search(len(b.packets), func(i int) bool { return b.packets[i].seq >= seq })
+	if i < len(b.packets) && b.packets[i].seq == seq {
+		b.stats.Duplicates++
+		return
+	}
+
+	b.stats.Received++
+	if seq < b.highest {
+		b.stats.Reordered++
+	} else {
+		b.highest = seq
+	}
+
+	b.packets = append(b.packets, entry{})
+	copy(b.packets[i+1:], b.packets[i:])
+	b.packets[i] = entry{seq: seq, packet: pkt, arrival: now}
+}
+
+// Pop returns the next frame of the stream, if it is due at now: either its packet
+// has arrived, or it has been missing for so long it is lost.
+func (b *Buffer) Pop(now time.Time) (Frame, bool) {
+	return b.pop(now, false)
+}
+
+// pop returns the next frame; force gives up on missing packets right away.
+func (b *Buffer) pop(now time.Time, force bool) (Frame, bool) {
+	if len(b.packets) == 0 {
+		return Frame{}, false
+	}
+
+	first := b.packets[0]
+	if first.seq == b.next {
+		b.packets = b.packets[1:]
+		b.next++
+		return Frame{Packet: first.packet}, true
+	}
+
+	// Something is missing. Wait for it as long as the packets after it have been
+	// waiting.
+	if !force && now.Sub(b.oldestArrival()) < b.delay && len(b.packets) < b.maxPackets {
+		return Frame{}, false
+	}
+
+	if gap := first.seq - b.next; gap > maxGap {
+		b.stats.Skipped += int(gap)
+		b.next = first.seq
+		return b.pop(now, force)
+	}
+
+	b.stats.Lost++
+	b.next++
+
+	var next *rtp.Packet
+	if first.seq == b.next {
+		next = first.packet
+	}
+	return Frame{Next: next}, true
+}
+
+// Flush returns every frame still in the buffer, without waiting for anything
+// missing.
+func (b *Buffer) Flush() []Frame {
+	var frames []Frame
+	for {
+		f, ok := b.pop(time.Time{}, true)
+		if !ok {
+			return frames
+		}
+		frames = append(frames, f)
+	}
+}
+
+func (b *Buffer) oldestArrival() time.Time {
+	oldest := b.packets[0].arrival
+	for _, e := range b.packets[1:] {
+		if e.arrival.Before(oldest) {
+			oldest = e.arrival
+		}
+	}
+	return oldest
+}
+
+func (b *Buffer) Stats() Stats {
+	return b.stats
+}
@@ -0,0 +1,162 @@
+package jitter_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/webrtcpeer/jitter"
+	"github.com/pion/rtp"
+)
+
+func packet(seq uint16) *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{SequenceNumber: seq}}
+}
+
+// frames describes frames as their sequence numbers, with lost ones as "lost" or
+// "fec:<seq of the packet to recover them from>".
+func frames(fs ...jitter.Frame) string {
+	var s []string
+	for _, f := range fs {
+		switch {
+		case !f.Lost():
+			s = append(s, fmt.Sprint(f.Packet.SequenceNumber))
+		case f.Next != nil:
+			s = append(s, fmt.Sprintf("fec:%d", f.Next.SequenceNumber))
+		default:
+			s = append(s, "lost")
+		}
+	}
+	return fmt.Sprint(s)
+}
+
+func popAll(b *jitter.Buffer, now time.Time) []jitter.Frame {
+	var fs []jitter.Frame
+	for {
+		f, ok := b.Pop(now)
+		if !ok {
+			return fs
+		}
+		fs = append(fs, f)
+	}
+}
+
+func TestBuffer(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	testCases := []struct {
+		name string
+		// arrivals, in order, as sequence number and arrival time in ms
+		arrivals [][2]int
+		// when to pop, in ms
+		popAt int
+		want  string
+		stats jitter.Stats
+	}{
+		{
+			name:     "in order",
+			arrivals: [][2]int{{1, 0}, {2, 20}, {3, 40}},
+			popAt:    40,
+			want:     "[1 2 3]",
+			stats:    jitter.Stats{Received: 3},
+		},
+		{
+			name:     "reordered within the delay",
+			arrivals: [][2]int{{1, 0}, {3, 20}, {2, 30}, {4, 40}},
+			popAt:    40,
+			want:     "[1 2 3 4]",
+			stats:    jitter.Stats{Received: 4, Reordered: 1},
+		},
+		{
+			name:     "still waiting for a missing packet",
+			arrivals: [][2]int{{1, 0}, {3, 20}, {4, 40}},
+			popAt:    60,
+			want:     "[1]",
+			stats:    jitter.Stats{Received: 3},
+		},
+		{
+			name:     "lost, with the next packet there to recover it",
+			arrivals: [][2]int{{1, 0}, {3, 20}, {4, 40}},
+			popAt:    100,
+			want:     "[1 fec:3 3 4]",
+			stats:    jitter.Stats{Received: 3, Lost: 1},
+		},
+		{
+			name:     "burst loss",
+			arrivals: [][2]int{{1, 0}, {5, 80}},
+			popAt:    200,
+			want:     "[1 lost lost fec:5 5]",
+			stats:    jitter.Stats{Received: 2, Lost: 3},
+		},
+		{
+			name:     "late and duplicate packets",
+			arrivals: [][2]int{{1, 0}, {3, 20}, {3, 25}, {4, 40}, {2, 150}},
+			popAt:    100,
+			want:     "[1 fec:3 3 4]",
+			stats:    jitter.Stats{Received: 3, Lost: 1, Late: 1, Duplicates: 1},
+		},
+		{
+			name:     "wraparound",
+			arrivals: [][2]int{{65534, 0}, {0, 20}, {65535, 30}, {1, 40}},
+			popAt:    40,
+			want:     "[65534 65535 0 1]",
+			stats:    jitter.Stats{Received: 4, Reordered: 1},
+		},
+		{
+			name:     "stream restart",
+			arrivals: [][2]int{{1, 0}, {1000, 20}, {1001, 40}},
+			popAt:    200,
+			want:     "[1 1000 1001]",
+			stats:    jitter.Stats{Received: 3, Skipped: 998},
+		},
+	}
+
+	for _, tc := range testCases {
+		b := jitter.New(60*time.Millisecond, 0)
+
+		var got []jitter.Frame
+		for _, a := range tc.arrivals {
+			if a[1] > tc.popAt {
+				// Arrives after we pop.
+				got = append(got, popAll(b, at(tc.popAt))...)
+				tc.popAt = a[1]
+			}
+			b.Push(packet(uint16(a[0])), at(a[1]))
+		}
+		got = append(got, popAll(b, at(tc.popAt))...)
+
+		if s := frames(got...); s != tc.want {
+			t.Errorf("%s: got frames %s, want %s", tc.name, s, tc.want)
+		}
+		if s := b.Stats(); s != tc.stats {
+			t.Errorf("%s: got stats %s, want %s", tc.name, s, tc.stats)
+		}
+	}
+}
+
+func TestBufferOverflow(t *testing.T) {
+	now := time.Now()
+	b := jitter.New(time.Hour, 4)
+
+	b.Push(packet(1), now)
+	for seq := uint16(3); seq < 7; seq++ {
+		b.Push(packet(seq), now)
+	}
+
+	// However long the delay, a full buffer stops waiting.
+	if got := frames(popAll(b, now)...); got != "[1 fec:3 3 4 5 6]" {
+		t.Errorf("got frames %s", got)
+	}
+}
+
+func TestBufferFlush(t *testing.T) {
+	now := time.Now()
+	b := jitter.New(time.Hour, 0)
+
+	b.Push(packet(1), now)
+	b.Push(packet(3), now)
+	if got := frames(b.Flush()...); got != "[1 fec:3 3]" {
+		t.Errorf("got frames %s", got)
+	}
+}
@@ -0,0 +1,90 @@
+package webrtcpeer
+
+import (
+	"fmt"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v3"
+)
+
+// NetworkConfig controls how the peer gathers ICE candidates. The zero value uses no
+// STUN or TURN servers at all, which only works when the SFU is directly reachable.
+type NetworkConfig struct {
+	// ICEServers are the STUN and TURN servers to use, with credentials for TURN.
+	ICEServers []webrtc.ICEServer
+	// ICETransportPolicy set to relay only uses TURN.
+	ICETransportPolicy webrtc.ICETransportPolicy
+
+	// UDPPortMin and UDPPortMax, if set, restrict the local UDP ports used for media.
+	UDPPortMin uint16
+	UDPPortMax uint16
+
+	// NAT1To1IPs are public IPs to advertise in place of local ones when running
+	// behind a 1:1 NAT, as candidates of NAT1To1CandidateType (host by default).
+	NAT1To1IPs           []string
+	NAT1To1CandidateType webrtc.ICECandidateType
+
+	// Interfaces, if set, are the only network interfaces gathered from.
+	Interfaces []string
+}
+
+// DefaultNetworkConfig uses Google's public STUN server.
+func DefaultNetworkConfig() NetworkConfig {
+	return NetworkConfig{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+	}
+}
+
+// api builds the pion API and configuration every peer connection is created with.
+func (c NetworkConfig) api() (*webrtc.API, webrtc.Configuration, error) {
+	var se webrtc.SettingEngine
+
+	if c.UDPPortMin != 0 || c.UDPPortMax != 0 {
+		if err := se.SetEphemeralUDPPortRange(c.UDPPortMin, c.UDPPortMax); err != nil {
+			return nil, webrtc.Configuration{}, fmt.Errorf("invalid udp port range %d-%d: %w", c.UDPPortMin, c.UDPPortMax, err)
+		}
+	}
+
+	if len(c.NAT1To1IPs) > 0 {
+		candidateType := c.NAT1To1CandidateType
+		if candidateType == webrtc.ICECandidateType(0) {
+			candidateType = webrtc.ICECandidateTypeHost
+		}
+		se.SetNAT1To1IPs(c.NAT1To1IPs, candidateType)
+	}
+
+	if len(c.Interfaces) > 0 {
+		allowed := map[string]bool{}
+		for _, name := range c.Interfaces {
+			allowed[name] = true
+		}
+		se.SetInterfaceFilter(func(name string) bool {
+			return allowed[name]
+		})
+	}
+
+	// The same codecs and interceptors webrtc.NewPeerConnection would use.
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, webrtc.Configuration{}, err
+	}
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, webrtc.Configuration{}, err
+	}
+
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(i),
+		webrtc.WithSettingEngine(se),
+	)
+	config := webrtc.Configuration{
+		ICEServers:         c.ICEServers,
+		ICETransportPolicy: c.ICETransportPolicy,
+	}
+	return api, config, nil
+}
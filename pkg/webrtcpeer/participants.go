@@ -0,0 +1,83 @@
+package webrtcpeer
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ajbouh/bridge/pkg/router"
+)
+
+const (
+	// Opus encodes digital silence, which is what a muted microphone sends, in a
+	// handful of bytes.
+	silentPayloadSize = 3
+	// mutedAfter is how long a track can go without sound before its participant
+	// is considered muted.
+	mutedAfter = time.Second
+)
+
+// participants reports who joins and leaves the room. It outlives any one
+// connection, so participants keep their labels when we reconnect.
+type participants struct {
+	joined chan<- *router.Participant
+	left   chan<- string
+
+	mu     sync.Mutex
+	labels map[string]string
+}
+
+func newParticipants(joined chan<- *router.Participant, left chan<- string) *participants {
+	return &participants{
+		joined: joined,
+		left:   left,
+		labels: map[string]string{},
+	}
+}
+
+func (ps *participants) join(id string) router.Participant {
+	ps.mu.Lock()
+	label, ok := ps.labels[id]
+	if !ok {
+		label = fmt.Sprintf("Guest %d", len(ps.labels)+1)
+		ps.labels[id] = label
+	}
+	ps.mu.Unlock()
+
+	p := router.Participant{ID: id, Label: label}
+	ps.update(p)
+	return p
+}
+
+func (ps *participants) update(p router.Participant) {
+	if ps.joined != nil {
+		ps.joined <- &p
+	}
+}
+
+func (ps *participants) leave(id string) {
+	if ps.left != nil {
+		ps.left <- id
+	}
+}
+
+// watchMuted reports p as muted while its track carries no sound.
+func (ps *participants) watchMuted(p router.Participant, lastSound *atomic.Int64, stop <-chan struct{}) {
+	ticker := time.NewTicker(mutedAfter / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			muted := time.Since(time.Unix(0, lastSound.Load())) > mutedAfter
+			if muted == p.Muted {
+				continue
+			}
+			p.Muted = muted
+			ps.update(p)
+		case <-stop:
+			return
+		}
+	}
+}
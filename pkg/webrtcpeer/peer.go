@@ -2,10 +2,14 @@ package webrtcpeer
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
+	"sync"
+	"time"
 
 	logr "github.com/ajbouh/bridge/pkg/log"
+	"github.com/ajbouh/bridge/pkg/mediaclock"
 	"github.com/ajbouh/bridge/pkg/router"
 
 	"github.com/pion/webrtc/v3"
@@ -13,119 +17,404 @@ import (
 
 var Logger = logr.New()
 
+const (
+	minReconnectBackoff = 500 * time.Millisecond
+	maxReconnectBackoff = 30 * time.Second
+	// A connection that stayed up this long resets the backoff.
+	stableConnection = time.Minute
+
+	// iceRestartTimeout is how long an ICE restart gets to recover a failed
+	// connection before we renegotiate from scratch.
+	iceRestartTimeout = 10 * time.Second
+)
+
 type Config struct {
 	// ION room name to connect to
 	Room string
 	// URL for websocket server
 	Url url.URL
+	// Network controls ICE servers and which addresses and ports are used.
+	Network NetworkConfig
 
+	// Clock measures the timestamps of captured samples.
+	Clock          *mediaclock.Clock
 	CapturedSample chan<- *router.CapturedSample
 
-	StatusStream   <-chan *router.Status
-	DocumentStream <-chan router.Document
+	// Participant and ParticipantLeft are told who joins and leaves the room.
+	Participant     chan<- *router.Participant
+	ParticipantLeft chan<- string
+
+	StatusStream <-chan *router.Status
+	ChangeStream <-chan *router.DocumentChange
+	// SynthesizedAudio is played on the outgoing audio track, unless an
+	// Interruption stops it.
+	SynthesizedAudio <-chan *router.SynthesizedAudio
+	Interruption     <-chan *router.Interruption
+	// PlayedAudio is told what is played, as it starts playing.
+	PlayedAudio chan<- *router.PlayedAudio
 }
 
+// Peer keeps a connection to a room up, reconnecting whenever signaling or media
+// fails. The router and everything in it outlive individual connections.
 type Peer struct {
-	ws     *SocketConnection
-	rtc    *RTCConnection
-	config Config
-	ae     *AudioEngine
+	config       Config
+	api          *webrtc.API
+	rtcConfig    webrtc.Configuration
+	ae           *AudioEngine
+	participants *participants
+	playback     *playback
+
+	mu  sync.Mutex
+	ws  *SocketConnection
+	rtc *RTCConnection
+
+	// resync is signalled when a new data channel opens.
+	resync chan struct{}
 }
 
-func New(u url.URL, room string) router.MiddlewareFunc {
+func New(u url.URL, room string, network NetworkConfig) router.MiddlewareFunc {
 	return func(ctx context.Context, emit router.Emitters) (router.Listeners, error) {
-		peerDocumentStream := make(chan router.Document, 100)
+		changeStream := make(chan *router.DocumentChange, 100)
 		statusStream := make(chan *router.Status, 100)
+		synthesizedAudio := make(chan *router.SynthesizedAudio, 100)
+		interruption := make(chan *router.Interruption, 100)
 		sc, err := NewPeer(Config{
-			Url:            u,
-			Room:           room,
-			CapturedSample: emit.CapturedSample,
-			DocumentStream: peerDocumentStream,
-			StatusStream:   statusStream,
+			Url:             u,
+			Room:            room,
+			Network:         network,
+			Clock:           emit.Clock,
+			CapturedSample:  emit.CapturedSample,
+			Participant:     emit.Participant,
+			ParticipantLeft: emit.RemoveParticipant,
+			ChangeStream:    changeStream,
+			StatusStream:    statusStream,
+
+			SynthesizedAudio: synthesizedAudio,
+			Interruption:     interruption,
+			PlayedAudio:      emit.PlayedAudio,
 		})
 		if err != nil {
 			return router.Listeners{}, fmt.Errorf("creating peer client: %w", err)
 		}
 
+		go sc.relayEvents()
+		go sc.playSynthesizedAudio(ctx)
+		go sc.stopInterruptedAudio()
+
+		done := make(chan struct{})
 		go func() {
-			if err := sc.Start(); err != nil {
-				fmt.Printf("error starting peer client: %s\n", err)
-			}
+			defer close(done)
+			sc.Run(ctx)
 		}()
 
 		return router.Listeners{
-			DraftDocument: peerDocumentStream,
-			Status:        statusStream,
+			DocumentChange:   changeStream,
+			Status:           statusStream,
+			SynthesizedAudio: synthesizedAudio,
+			Interruption:     interruption,
+			Done:             done,
 		}, nil
 	}
 }
 
 func NewPeer(config Config) (*Peer, error) {
-	ae, err := NewAudioEngine(config.CapturedSample)
+	api, rtcConfig, err := config.Network.api()
 	if err != nil {
 		return nil, err
 	}
 
-	ws := NewSocketConnection(config.Url)
+	ae, err := NewAudioEngine(config.Clock, config.CapturedSample)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Peer{
+		config:       config,
+		api:          api,
+		rtcConfig:    rtcConfig,
+		ae:           ae,
+		participants: newParticipants(config.Participant, config.ParticipantLeft),
+		playback:     newPlayback(),
+		resync:       make(chan struct{}, 1),
+	}, nil
+}
+
+// Run stays connected to the room until ctx is done, reconnecting with exponential
+// backoff.
+func (s *Peer) Run(ctx context.Context) {
+	s.ae.Start()
+
+	backoff := minReconnectBackoff
+	for {
+		began := time.Now()
+		err := s.connect(ctx)
+		if ctx.Err() != nil {
+			Logger.Info("Socket done goodbye")
+			return
+		}
+
+		if time.Since(began) > stableConnection {
+			backoff = minReconnectBackoff
+		}
+		Logger.Error(err, "lost connection to room, reconnecting", "room", s.config.Room, "backoff", backoff)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// connect dials signaling, joins the room with new peer connections and keeps them
+// up until ctx is done or they fail for good. A failed publisher connection gets an
+// ICE restart first; if that doesn't recover it, or signaling or the subscriber
+// connection fail, connect returns so Run can renegotiate from scratch.
+func (s *Peer) connect(ctx context.Context) error {
+	ws := NewSocketConnection(s.config.Url)
+
+	type stateChange struct {
+		target int
+		state  webrtc.PeerConnectionState
+	}
+	states := make(chan stateChange, 10)
+	// closed lets go of state changes that arrive once we've given up on the
+	// connection.
+	closed := make(chan struct{})
+	defer close(closed)
 
 	rtc, err := NewRTCConnection(RTCConnectionParams{
+		api:           s.api,
+		configuration: s.rtcConfig,
 		trickleFn: func(candidate *webrtc.ICECandidate, target int) error {
 			return ws.SendTrickle(candidate, target)
 		},
-		rtpChan:        ae.RtpIn(),
-		documentStream: config.DocumentStream,
-		statusStream:   config.StatusStream,
-		mediaIn:        ae.MediaOut(),
+		addTrack:    s.ae.AddTrack,
+		mediaIn:     s.ae.MediaOut(),
+		dataChannel: s.config.ChangeStream != nil || s.config.StatusStream != nil,
+		onDataChannelOpen: func() {
+			select {
+			case s.resync <- struct{}{}:
+			default:
+			}
+		},
+		onStateChange: func(target int, state webrtc.PeerConnectionState) {
+			select {
+			case states <- stateChange{target, state}:
+			case <-closed:
+			}
+		},
+		participants: s.participants,
 	})
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("creating peer connections: %w", err)
 	}
+	defer rtc.Close()
+
+	ws.SetOnOffer(func(offer webrtc.SessionDescription) error {
+		ans, err := rtc.OnOffer(offer)
+		if err != nil {
+			Logger.Error(err, "error getting answer")
+			return err
+		}
+		return ws.SendAnswer(ans)
+	})
+	ws.SetOnAnswer(rtc.SetAnswer)
+	ws.SetOnTrickle(rtc.OnTrickle)
 
-	s := &Peer{
-		ws:     ws,
-		rtc:    rtc,
-		config: config,
-		ae:     ae,
+	if err := ws.Connect(); err != nil {
+		return fmt.Errorf("connecting to websocket: %w", err)
 	}
+	defer ws.Close()
 
-	s.ws.SetOnOffer(s.OnOffer)
-	s.ws.SetOnAnswer(s.OnAnswer)
-	s.ws.SetOnTrickle(s.rtc.OnTrickle)
+	offer, err := rtc.GetOffer()
+	if err != nil {
+		return fmt.Errorf("getting initial offer: %w", err)
+	}
+	if err := ws.Join(s.config.Room, offer); err != nil {
+		return fmt.Errorf("joining room: %w", err)
+	}
+
+	s.mu.Lock()
+	s.ws, s.rtc = ws, rtc
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.ws, s.rtc = nil, nil
+		s.mu.Unlock()
+	}()
+
+	// restartDeadline fires if an ICE restart hasn't recovered the connection.
+	var restartDeadline <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ws.done:
+			return errors.New("signaling connection closed")
+		case <-restartDeadline:
+			return errors.New("ice restart did not recover the connection")
+		case c := <-states:
+			switch c.state {
+			case webrtc.PeerConnectionStateConnected:
+				if c.target == targetPublisher && restartDeadline != nil {
+					Logger.Info("ice restart recovered the connection")
+					restartDeadline = nil
+				}
+			case webrtc.PeerConnectionStateFailed:
+				// Only the offering side can restart ICE, and the SFU offers the
+				// subscriber connection.
+				if c.target != targetPublisher || restartDeadline != nil {
+					return fmt.Errorf("peer connection for target %d failed", c.target)
+				}
 
-	return s, nil
+				Logger.Info("publisher connection failed, restarting ice")
+				offer, err := rtc.RestartICE()
+				if err != nil {
+					return fmt.Errorf("restarting ice: %w", err)
+				}
+				if err := ws.SendOffer(offer); err != nil {
+					return fmt.Errorf("sending ice restart offer: %w", err)
+				}
+				restartDeadline = time.After(iceRestartTimeout)
+			}
+		}
+	}
 }
 
-func (s *Peer) OnAnswer(answer webrtc.SessionDescription) error {
-	return s.rtc.SetAnswer(answer)
+// playSynthesizedAudio plays speech into the room, one after the other, until the
+// stream is closed. Cancelling ctx stops whatever is playing.
+func (s *Peer) playSynthesizedAudio(ctx context.Context) {
+	for audio := range s.config.SynthesizedAudio {
+		if audio.SampleRate <= 0 {
+			Logger.Error(fmt.Errorf("sample rate %d", audio.SampleRate), "skipping synthesized audio", "id", audio.ID)
+			continue
+		}
+
+		playing, ok := s.playback.start(ctx, audio.ID)
+		if !ok {
+			Logger.Infof("skipping %s from %s, it was interrupted", audio.ID, audio.Source)
+			continue
+		}
+
+		Logger.Infof("playing %s from %s", audio.ID, audio.Source)
+		start := s.config.Clock.Now()
+		s.config.PlayedAudio <- &router.PlayedAudio{
+			AudioID:        audio.ID,
+			Source:         audio.Source,
+			PCM:            audio.PCM,
+			SampleRate:     audio.SampleRate,
+			StartTimestamp: start,
+			EndTimestamp:   start + uint64(len(audio.PCM))*1000/uint64(audio.SampleRate),
+		}
+		err := s.ae.Play(playing, audio.PCM, 1, audio.SampleRate)
+		s.playback.finish(audio.ID)
+		if errors.Is(err, context.Canceled) {
+			Logger.Infof("stopped playing %s, it was interrupted", audio.ID)
+		} else if err != nil {
+			Logger.Error(err, "error playing synthesized audio", "id", audio.ID)
+		}
+	}
 }
 
-func (s *Peer) OnOffer(offer webrtc.SessionDescription) error {
-	ans, err := s.rtc.OnOffer(offer)
-	if err != nil {
-		Logger.Error(err, "error getting answer")
-		return err
+// stopInterruptedAudio stops speech as soon as somebody talks over it, until the
+// stream is closed.
+func (s *Peer) stopInterruptedAudio() {
+	for i := range s.config.Interruption {
+		s.playback.interrupt(i.AudioID)
 	}
+}
+
+const (
+	// interruptionTTL is how long an interruption is kept for speech that hasn't
+	// started playing, in case it's still on its way.
+	interruptionTTL = time.Minute
+	// maxFinished is how many IDs of speech done playing are remembered, so late
+	// interruptions for them are dropped rather than kept.
+	maxFinished = 64
+)
 
-	return s.ws.SendAnswer(ans)
+// playback keeps track of the speech being played, so it can be stopped when it's
+// interrupted. Interruptions can arrive before the speech they stop, or after it's
+// done playing.
+type playback struct {
+	mu      sync.Mutex
+	playing string
+	stop    context.CancelFunc
+	// interrupted holds when speech that hasn't started playing yet was
+	// interrupted, and finished the IDs of the latest speech done playing.
+	interrupted map[string]time.Time
+	finished    []string
 }
 
-func (s *Peer) Start() error {
-	if err := s.ws.Connect(); err != nil {
-		Logger.Error(err, "error connecting to websocket")
-		return err
+func newPlayback() *playback {
+	return &playback{interrupted: map[string]time.Time{}}
+}
+
+// start returns the context to play the speech with the given ID with, derived from
+// ctx, or false if it was already interrupted.
+func (p *playback) start(ctx context.Context, id string) (context.Context, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.interrupted[id]; ok {
+		delete(p.interrupted, id)
+		p.done(id)
+		return nil, false
 	}
-	offer, err := s.rtc.GetOffer()
-	if err != nil {
-		Logger.Error(err, "error getting intial offer")
+
+	ctx, stop := context.WithCancel(ctx)
+	p.playing = id
+	p.stop = stop
+	return ctx, true
+}
+
+func (p *playback) finish(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.playing == id {
+		p.stop()
+		p.playing = ""
+		p.stop = nil
+	}
+	p.done(id)
+}
+
+func (p *playback) interrupt(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.playing == id {
+		p.stop()
+		return
 	}
-	if err := s.ws.Join(s.config.Room, offer); err != nil {
-		Logger.Error(err, "error joining room")
-		return err
+	for _, finished := range p.finished {
+		if finished == id {
+			return
+		}
 	}
 
-	s.ae.Start()
+	now := time.Now()
+	for other, at := range p.interrupted {
+		if now.Sub(at) > interruptionTTL {
+			delete(p.interrupted, other)
+		}
+	}
+	p.interrupted[id] = now
+}
 
-	s.ws.WaitForDone()
-	Logger.Info("Socket done goodbye")
-	return nil
+// done remembers that the speech with the given ID won't play again.
+func (p *playback) done(id string) {
+	if len(p.finished) >= maxFinished {
+		p.finished = append(p.finished[:0], p.finished[1:]...)
+	}
+	p.finished = append(p.finished, id)
 }
@@ -1,7 +1,6 @@
 package webrtcpeer
 
 import (
-	"os"
 	"sync"
 
 	"github.com/pion/webrtc/v3"
@@ -13,22 +12,14 @@ type PeerConn struct {
 	mu                sync.Mutex
 }
 
-func NewPeerConn(onICECandidate func(candidate *webrtc.ICECandidate)) PeerConn {
-	// Prepare the configuration
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	}
+func NewPeerConn(api *webrtc.API, config webrtc.Configuration, onICECandidate func(candidate *webrtc.ICECandidate), onStateChange func(webrtc.PeerConnectionState)) (*PeerConn, error) {
 	// Create a new RTCPeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := api.NewPeerConnection(config)
 	if err != nil {
-		Logger.Fatal(err, "pc err")
+		return nil, err
 	}
 
-	pc := PeerConn{
+	pc := &PeerConn{
 		conn:              peerConnection,
 		pendingCandidates: make([]webrtc.ICECandidateInit, 0),
 	}
@@ -40,16 +31,14 @@ func NewPeerConn(onICECandidate func(candidate *webrtc.ICECandidate)) PeerConn {
 	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
 		Logger.Infof("Peer Connection State has changed: %s\n", s.String())
 
-		if s == webrtc.PeerConnectionStateFailed {
-			// Wait until PeerConnection has had no network activity for 30 seconds or another failure. It may be reconnected using an ICE Restart.
-			// Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
-			// Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
-			Logger.Info("Peer Connection has gone to failed exiting")
-			os.Exit(0)
+		// A failed connection may be recovered with an ICE restart, which is up to
+		// whoever is watching.
+		if onStateChange != nil {
+			onStateChange(s)
 		}
 	})
 
-	return pc
+	return pc, nil
 	// defer func() {
 	// 	if err := peerConnection.Close(); err != nil {
 	// 		fmt.Printf("cannot close peerConnection: %v\n", err)
@@ -57,11 +46,11 @@ func NewPeerConn(onICECandidate func(candidate *webrtc.ICECandidate)) PeerConn {
 	// }()
 }
 
-func (c PeerConn) Offer(offer webrtc.SessionDescription) error {
+func (c *PeerConn) Offer(offer webrtc.SessionDescription) error {
 	return c.conn.SetRemoteDescription(offer)
 }
 
-func (c PeerConn) Answer() (webrtc.SessionDescription, error) {
+func (c *PeerConn) Answer() (webrtc.SessionDescription, error) {
 	var answer = webrtc.SessionDescription{}
 
 	answer, err := c.conn.CreateAnswer(nil)
@@ -79,7 +68,7 @@ func (c PeerConn) Answer() (webrtc.SessionDescription, error) {
 	return answer, nil
 }
 
-func (c PeerConn) flushCandidates() error {
+func (c *PeerConn) flushCandidates() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -93,7 +82,7 @@ func (c PeerConn) flushCandidates() error {
 	return nil
 }
 
-func (c PeerConn) GetOffer() (webrtc.SessionDescription, error) {
+func (c *PeerConn) GetOffer() (webrtc.SessionDescription, error) {
 	var offer = webrtc.SessionDescription{}
 	offer, err := c.conn.CreateOffer(nil)
 	if err != nil {
@@ -102,7 +91,16 @@ func (c PeerConn) GetOffer() (webrtc.SessionDescription, error) {
 	return offer, c.conn.SetLocalDescription(offer)
 }
 
-func (c PeerConn) SetAnswer(answer webrtc.SessionDescription) error {
+// RestartICE creates and applies an offer that gathers new ICE credentials.
+func (c *PeerConn) RestartICE() (webrtc.SessionDescription, error) {
+	offer, err := c.conn.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return offer, err
+	}
+	return offer, c.conn.SetLocalDescription(offer)
+}
+
+func (c *PeerConn) SetAnswer(answer webrtc.SessionDescription) error {
 	if err := c.conn.SetRemoteDescription(answer); err != nil {
 		return err
 	}
@@ -113,7 +111,7 @@ func (c PeerConn) SetAnswer(answer webrtc.SessionDescription) error {
 	return nil
 }
 
-func (c PeerConn) AddIceCandidate(candidate webrtc.ICECandidateInit) error {
+func (c *PeerConn) AddIceCandidate(candidate webrtc.ICECandidateInit) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -1,79 +1,113 @@
 package webrtcpeer
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
+	"sync/atomic"
+	"time"
 
-	"github.com/ajbouh/bridge/pkg/router"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media"
 )
 
+const (
+	// targets, as ion-sfu numbers them in trickle messages
+	targetPublisher  = 0
+	targetSubscriber = 1
+)
+
 type RTCConnection struct {
-	sub PeerConn
-	pub PeerConn
-	// channel that incoming audio rtp packets will be relayed on
-	rtpIn chan<- *rtp.Packet
+	sub *PeerConn
+	pub *PeerConn
+	// addTrack returns the channel the rtp packets of a new incoming audio track
+	// will be relayed on
+	addTrack func(source string, clockRate uint32) (chan<- *rtp.Packet, error)
 	// channel to send outgoing audio samples to
 	mediaIn    <-chan media.Sample
 	audioTrack *webrtc.TrackLocalStaticSample
+	events     *webrtc.DataChannel
+
+	participants *participants
+
+	// closed stops the goroutines of this connection, which matters when we
+	// reconnect with a new one.
+	closed chan struct{}
 }
 
 type RTCConnectionParams struct {
-	trickleFn      func(*webrtc.ICECandidate, int) error
-	rtpChan        chan<- *rtp.Packet
-	statusStream   <-chan *router.Status
-	documentStream <-chan router.Document
-	mediaIn        <-chan media.Sample
+	api           *webrtc.API
+	configuration webrtc.Configuration
+
+	trickleFn func(*webrtc.ICECandidate, int) error
+	addTrack  func(source string, clockRate uint32) (chan<- *rtp.Packet, error)
+	mediaIn   <-chan media.Sample
+
+	// dataChannel creates the events data channel; onDataChannelOpen is called each
+	// time it opens.
+	dataChannel       bool
+	onDataChannelOpen func()
+
+	// onStateChange is told about the connection state of each target.
+	onStateChange func(target int, state webrtc.PeerConnectionState)
+
+	participants *participants
 }
 
-// FIXME if documentStream AND mediaIn are not provided this will blow up
 func NewRTCConnection(params RTCConnectionParams) (*RTCConnection, error) {
 	rtc := &RTCConnection{
-		rtpIn:   params.rtpChan,
-		mediaIn: params.mediaIn,
+		addTrack:     params.addTrack,
+		mediaIn:      params.mediaIn,
+		participants: params.participants,
+		closed:       make(chan struct{}),
 	}
 
-	rtc.sub = NewPeerConn(func(candidate *webrtc.ICECandidate) {
-		params.trickleFn(candidate, 1)
-	})
+	stateChange := func(target int) func(webrtc.PeerConnectionState) {
+		return func(s webrtc.PeerConnectionState) {
+			if params.onStateChange != nil {
+				params.onStateChange(target, s)
+			}
+		}
+	}
+
+	var err error
+	rtc.sub, err = NewPeerConn(params.api, params.configuration, func(candidate *webrtc.ICECandidate) {
+		params.trickleFn(candidate, targetSubscriber)
+	}, stateChange(targetSubscriber))
+	if err != nil {
+		return nil, err
+	}
 	rtc.sub.conn.OnTrack(func(t *webrtc.TrackRemote, r *webrtc.RTPReceiver) {
 		kind := "unknown kind"
 		if t.Kind() == webrtc.RTPCodecTypeVideo {
 			kind = "video"
 		} else if t.Kind() == webrtc.RTPCodecTypeAudio {
 			kind = "audio"
-			go func() {
-				Logger.Infof("starting audio read loop: codec=%#v", t.Codec())
-				for {
-					pkt, _, err := t.ReadRTP()
-					if err != nil {
-						Logger.Error(err, "err reading rtp")
-						return
-					}
-					rtc.rtpIn <- pkt
-				}
-			}()
+			go rtc.readAudio(t)
 		}
 		Logger.Debugf("got track %s", kind)
 	})
 
-	rtc.pub = NewPeerConn(func(candidate *webrtc.ICECandidate) {
-		params.trickleFn(candidate, 0)
-	})
+	rtc.pub, err = NewPeerConn(params.api, params.configuration, func(candidate *webrtc.ICECandidate) {
+		params.trickleFn(candidate, targetPublisher)
+	}, stateChange(targetPublisher))
+	if err != nil {
+		rtc.sub.conn.Close()
+		return nil, err
+	}
 
 	if params.mediaIn != nil {
 		audioTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: "audio/opus"}, "audio", "saturday_audio")
 		if err != nil {
 			Logger.Error(err, "error creating local audio track")
+			rtc.Close()
 			return nil, err
 		}
 
 		_, err = rtc.pub.conn.AddTransceiverFromTrack(audioTrack, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
 		if err != nil {
 			Logger.Error(err, "error adding local audio transceiver")
+			rtc.Close()
 			return nil, err
 		}
 
@@ -84,79 +118,135 @@ func NewRTCConnection(params RTCConnectionParams) (*RTCConnection, error) {
 		Logger.Info("mediaIn not provided... audio relay is disabled")
 	}
 
-	if params.documentStream != nil {
+	if params.dataChannel {
+		// Document changes build on each other, so none may be lost or reordered.
 		ordered := true
-		maxRetransmits := uint16(0)
 
 		dc, err := rtc.pub.conn.CreateDataChannel(
 			"events",
 			&webrtc.DataChannelInit{
-				Ordered:        &ordered,
-				MaxRetransmits: &maxRetransmits,
+				Ordered: &ordered,
 			})
 		if err != nil {
+			rtc.Close()
 			return nil, err
 		}
 
 		dc.OnOpen(func() {
 			Logger.Info("data channel opened...")
-
-			for {
-				select {
-				case status := <-params.statusStream:
-					data, err := json.Marshal(map[string]any{
-						"type":   "status",
-						"detail": status,
-					})
-					if err != nil {
-						Logger.Error(err, "error marshalling status")
-
-					} else {
-						Logger.Infof("sending status %s on data channel", string(data))
-						dc.Send(data)
-					}
-				case doc := <-params.documentStream:
-					// Only send the last transcript.
-					transcription := doc.Transcriptions[len(doc.Transcriptions)-1]
-					data, err := json.Marshal(map[string]any{
-						"type":   "transcription",
-						"detail": transcription,
-					})
-					if err != nil {
-						Logger.Error(err, "error marshalling transcript")
-					} else {
-						Logger.Infof("sending transcript %s on data channel", string(data))
-						dc.Send(data)
-					}
-				}
+			if params.onDataChannelOpen != nil {
+				params.onDataChannelOpen()
 			}
 		})
 
+		rtc.events = dc
 	} else {
-		Logger.Info("documentEventStream not provided... transcription relay is disabled")
+		Logger.Info("data channel not requested... transcription relay is disabled")
 	}
 
 	return rtc, nil
 }
 
+// SendEvent sends data on the events data channel.
+func (r *RTCConnection) SendEvent(data []byte) error {
+	if r.events == nil {
+		return errors.New("no data channel")
+	}
+	if r.events.ReadyState() != webrtc.DataChannelStateOpen {
+		return fmt.Errorf("data channel is %s", r.events.ReadyState())
+	}
+	return r.events.Send(data)
+}
+
+// readAudio relays the packets of an incoming audio track to a pipeline of its own
+// until the track ends. The track's stream stands in for the participant who
+// published it.
+func (r *RTCConnection) readAudio(t *webrtc.TrackRemote) {
+	Logger.Infof("starting audio read loop: codec=%#v", t.Codec())
+
+	p := r.participants.join(t.StreamID())
+	defer r.participants.leave(p.ID)
+
+	rtpIn, err := r.addTrack(p.ID, t.Codec().ClockRate)
+	if err != nil {
+		Logger.Error(err, "error adding audio track", "source", p.ID)
+		return
+	}
+	defer close(rtpIn)
+
+	var lastSound atomic.Int64
+	lastSound.Store(time.Now().UnixNano())
+
+	stop := make(chan struct{})
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		r.participants.watchMuted(p, &lastSound, stop)
+	}()
+	// Wait for watchMuted to be done, so it can't report p again once p left.
+	defer func() {
+		close(stop)
+		<-watching
+	}()
+
+	for {
+		pkt, _, err := t.ReadRTP()
+		if err != nil {
+			Logger.Error(err, "err reading rtp")
+			return
+		}
+		if len(pkt.Payload) > silentPayloadSize {
+			lastSound.Store(time.Now().UnixNano())
+		}
+		rtpIn <- pkt
+	}
+}
+
 // processIncomingMedia sends the provided samples on the audioTrack
 func (r *RTCConnection) processOutgoingMedia() {
 	if r.mediaIn == nil {
 		Logger.Info("MediaIn not provided... skipping relay")
 		return
 	}
-	for sample := range r.mediaIn {
-		if err := r.audioTrack.WriteSample(sample); err != nil {
-			Logger.Error(err, "error writing sample")
+	for {
+		select {
+		case sample, ok := <-r.mediaIn:
+			if !ok {
+				return
+			}
+			if err := r.audioTrack.WriteSample(sample); err != nil {
+				Logger.Error(err, "error writing sample")
+			}
+		case <-r.closed:
+			return
 		}
 	}
 }
 
+// Close closes both peer connections.
+func (r *RTCConnection) Close() error {
+	select {
+	case <-r.closed:
+		return nil
+	default:
+		close(r.closed)
+	}
+
+	var errs []error
+	if r.pub != nil {
+		errs = append(errs, r.pub.conn.Close())
+	}
+	if r.sub != nil {
+		errs = append(errs, r.sub.conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
 func (r *RTCConnection) OnTrickle(candidate webrtc.ICECandidateInit, target int) error {
 	switch target {
-	case 0:
+	case targetPublisher:
 		return r.pub.AddIceCandidate(candidate)
-	case 1:
+	case targetSubscriber:
 		return r.sub.AddIceCandidate(candidate)
 	default:
 		err := errors.New(fmt.Sprintf("unknown target %d for candidate", target))
@@ -169,6 +259,12 @@ func (r *RTCConnection) GetOffer() (webrtc.SessionDescription, error) {
 	return r.pub.GetOffer()
 }
 
+// RestartICE returns an offer that restarts ICE on the publisher connection, to be
+// sent to the SFU over the existing signaling connection.
+func (r *RTCConnection) RestartICE() (webrtc.SessionDescription, error) {
+	return r.pub.RestartICE()
+}
+
 func (r *RTCConnection) SetAnswer(answer webrtc.SessionDescription) error {
 	return r.pub.SetAnswer(answer)
 }
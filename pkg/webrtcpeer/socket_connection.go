@@ -9,6 +9,9 @@ import (
 	"github.com/pion/webrtc/v3"
 )
 
+// UID is the peer ID rtc-peer joins rooms as.
+const UID = "SaturdayClient"
+
 // JoinConfig allow adding more control to the peers joining a SessionLocal.
 type JoinConfig struct {
 	// If true the peer will not be allowed to publish tracks to SessionLocal.
@@ -74,6 +77,14 @@ func (s *SocketConnection) WaitForDone() {
 	<-s.done
 }
 
+// Close closes the websocket, which stops readMessages and releases WaitForDone.
+func (s *SocketConnection) Close() error {
+	if s.ws == nil {
+		return nil
+	}
+	return s.ws.Close()
+}
+
 func (s *SocketConnection) SetOnOffer(onOffer func(offer webrtc.SessionDescription) error) {
 	s.onOffer = onOffer
 }
@@ -102,7 +113,7 @@ func (s *SocketConnection) Join(room string, offer webrtc.SessionDescription) er
 		Method: "join",
 		Params: Join{
 			SID:   room,
-			UID:   "SaturdayClient",
+			UID:   UID,
 			Offer: offer,
 		},
 	}
@@ -229,6 +240,21 @@ func (s *SocketConnection) SendTrickle(candidate *webrtc.ICECandidate, target in
 	return s.sendMessage(msg)
 }
 
+// SendOffer renegotiates the publisher connection, e.g. to restart ICE. The answer
+// arrives through onAnswer.
+func (s *SocketConnection) SendOffer(offer webrtc.SessionDescription) error {
+	msg := Message[Negotiation]{
+		Method: "offer",
+		Params: Negotiation{
+			Desc: offer,
+		},
+	}
+
+	Logger.Debug("Sending offer")
+
+	return s.sendMessage(msg)
+}
+
 func (s *SocketConnection) SendAnswer(answer webrtc.SessionDescription) error {
 	msg := Message[Negotiation]{
 		Method: "answer",
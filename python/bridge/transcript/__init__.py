@@ -1,7 +1,11 @@
+import json
+import sys
 import time
-from fastapi import FastAPI
-from pydantic import BaseModel
-from typing import Dict, List, Optional, Callable
+from array import array
+from fastapi import FastAPI, HTTPException, Request
+from fastapi.concurrency import run_in_threadpool
+from pydantic import BaseModel, ValidationError
+from typing import Dict, List, Optional, Callable, Type, TypeVar
 
 class Word(BaseModel):
     start: float
@@ -10,8 +14,11 @@ class Word(BaseModel):
     prob: float
 
 class Audio(BaseModel):
-    waveform: List[float]
+    waveform: Optional[List[float]]
     sample_rate: int
+    # encoding is how the waveform was sent when it came separately, in a multipart
+    # request. By the time a request is handled it has been decoded into waveform.
+    encoding: Optional[str]
 
 class TranscriptionSegment(BaseModel):
     id: Optional[int]
@@ -71,11 +78,14 @@ class TranscriptionRequest(BaseModel):
     text: Optional[str]
     segments: Optional[TranscriptionSegment]
 
+    # prompt is text that came before the audio, which the model continues.
+    prompt: Optional[str]
+
 
 class DiarizationSegment(BaseModel):
     start: float
     end: float
-    track: int
+    track: str
     label: str
 
 class DiarizationRequest(BaseModel):
@@ -83,8 +93,52 @@ class DiarizationRequest(BaseModel):
     task: str
     segments: Optional[DiarizationSegment]
 
+    min_speakers: Optional[int]
+    max_speakers: Optional[int]
+
 class DiarizationResponse(BaseModel):
     segments: List[DiarizationSegment]
+    # embeddings holds a voice embedding for each label, which callers compare to
+    # recognize speakers across requests.
+    embeddings: Optional[Dict[str, List[float]]]
+
+# How the samples of each binary encoding are laid out, as array typecodes, and the
+# full scale of each.
+PCM_ENCODINGS = {
+    'f32le': ('f', 1.0),
+    's16le': ('h', 32767.0),
+}
+
+Model = TypeVar('Model', bound=BaseModel)
+
+async def read_request(request: Request, model: Type[Model]) -> Model:
+    """
+    Parses a request sent as JSON, or as a multipart form with the request as JSON in
+    its "request" field and the samples of its audio as little endian PCM in its
+    "waveform" field.
+    """
+
+    content_type = request.headers.get('content-type', '')
+    try:
+        if not content_type.startswith('multipart/form-data'):
+            return model.parse_obj(await request.json())
+
+        form = await request.form()
+        parsed = model.parse_obj(json.loads(form['request']))
+    except (ValidationError, ValueError, KeyError) as e:
+        raise HTTPException(status_code=422, detail=str(e))
+
+    audio = parsed.audio
+    if audio is None or audio.encoding not in PCM_ENCODINGS:
+        raise HTTPException(status_code=415, detail=f"unsupported audio encoding {audio and audio.encoding}")
+
+    typecode, scale = PCM_ENCODINGS[audio.encoding]
+    samples = array(typecode, await form['waveform'].read())
+    if sys.byteorder != 'little':
+        samples.byteswap()
+    audio.waveform = [s / scale for s in samples] if scale != 1.0 else samples.tolist()
+    audio.encoding = None
+    return parsed
 
 def new_v1_api_app(
         diarize: Optional[Callable[[DiarizationRequest], DiarizationResponse]]=None,
@@ -94,11 +148,13 @@ def new_v1_api_app(
 
     if transcribe:
         @app.post('/v1/transcribe')
-        def do_transcribe(request: TranscriptionRequest) -> TranscriptionResponse:
+        async def do_transcribe(raw: Request) -> TranscriptionResponse:
+            request = await read_request(raw, TranscriptionRequest)
+
             # Perform transcription on the audio data
 
             start = time.time()
-            transcription = transcribe(request)
+            transcription = await run_in_threadpool(transcribe, request)
             end = time.time()
 
             print("Took:", end - start)
@@ -106,11 +162,13 @@ def new_v1_api_app(
     
     if diarize:
         @app.post('/v1/diarize')
-        def do_diarize(request: DiarizationRequest) -> DiarizationResponse:
+        async def do_diarize(raw: Request) -> DiarizationResponse:
+            request = await read_request(raw, DiarizationRequest)
+
             # Perform transcription on the audio data
 
             start = time.time()
-            transcription = diarize(request)
+            transcription = await run_in_threadpool(diarize, request)
             end = time.time()
 
             print("Took:", end - start)
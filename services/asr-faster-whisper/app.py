@@ -18,6 +18,8 @@ def transcribe(request: TranscriptionRequest) -> TranscriptionResponse:
         beam_size=5,
         word_timestamps=True,
         task=request.task,
+        language=request.source_language,
+        initial_prompt=request.prompt,
     )
 
     return TranscriptionResponse(
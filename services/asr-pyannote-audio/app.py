@@ -1,33 +1,54 @@
 from bridge.transcript import DiarizationRequest, DiarizationResponse, DiarizationSegment, new_v1_api_app
 import os
-from pyannote.audio import Pipeline
+from pyannote.audio import Inference, Model, Pipeline
+from typing import Dict, List
 import torch
 
 # Need to request access to pyannote/speaker-diarization and pyannote/segmentation
 MODEL_NAME = os.environ.get("MODEL_NAME", "pyannote/speaker-diarization@2.1")
 HF_AUTH_TOKEN = os.environ.get("HF_AUTH_TOKEN", None)
 MODEL_DEVICE = torch.device(os.environ.get("MODEL_DEVICE", "cpu"))
+# Embeddings of each speaker let callers tell who is who across requests. Set to an
+# empty string to leave them out.
+EMBEDDING_MODEL_NAME = os.environ.get("EMBEDDING_MODEL_NAME", "pyannote/embedding")
+# Turns shorter than this, in seconds, make for unreliable embeddings.
+MIN_EMBEDDING_DURATION = float(os.environ.get("MIN_EMBEDDING_DURATION", "0.5"))
 
 model = Pipeline.from_pretrained(MODEL_NAME, use_auth_token=HF_AUTH_TOKEN).to(MODEL_DEVICE)
 
+inference = None
+if EMBEDDING_MODEL_NAME:
+    embedding_model = Model.from_pretrained(EMBEDDING_MODEL_NAME, use_auth_token=HF_AUTH_TOKEN)
+    inference = Inference(embedding_model, window="whole", device=MODEL_DEVICE)
+
+def embeddings(audio_data, annotation) -> Dict[str, List[float]]:
+    result = {}
+    for label in annotation.labels():
+        # The longest turn of a speaker is the least likely to have anybody else in it.
+        turn = max(annotation.label_timeline(label), key=lambda segment: segment.duration)
+        if turn.duration < MIN_EMBEDDING_DURATION:
+            continue
+        result[label] = inference.crop(audio_data, turn).reshape(-1).tolist()
+    return result
+
 def diarize(request: DiarizationRequest) -> DiarizationResponse:
     n_samples = len(request.audio.waveform)
     audio_data = {
-        # 'waveform': torch.from_numpy(audio[None, :]),
-        'waveform': torch.cuda.FloatTensor([request.audio.waveform]).reshape(n_samples, 1),
-        'sample_rate': request.audio.sample_Rate,
+        'waveform': torch.tensor(request.audio.waveform, dtype=torch.float32).reshape(1, n_samples),
+        'sample_rate': request.audio.sample_rate,
     }
-    segments = model(audio_data, min_speakers=request.min_speakers, max_speakers=request.max_speakers)
+    annotation = model(audio_data, min_speakers=request.min_speakers, max_speakers=request.max_speakers)
     return DiarizationResponse(
         segments=[
             DiarizationSegment(
                 start=segment.start,
                 end=segment.end,
-                track=track,
+                track=str(track),
                 label=label,
             )
-            for segment, track, label in segments.itertracks(yield_label=True)
-        ]
+            for segment, track, label in annotation.itertracks(yield_label=True)
+        ],
+        embeddings=embeddings(audio_data, annotation) if inference else None,
     )
 
 app = new_v1_api_app(
@@ -2,20 +2,34 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/ajbouh/bridge/pkg/asr"
 	"github.com/ajbouh/bridge/pkg/assistant"
+	"github.com/ajbouh/bridge/pkg/diarization"
+	"github.com/ajbouh/bridge/pkg/echo"
 	logr "github.com/ajbouh/bridge/pkg/log"
+	"github.com/ajbouh/bridge/pkg/rooms"
 	"github.com/ajbouh/bridge/pkg/router"
+	"github.com/ajbouh/bridge/pkg/session"
 	"github.com/ajbouh/bridge/pkg/transcriber"
 	"github.com/ajbouh/bridge/pkg/translator"
+	"github.com/ajbouh/bridge/pkg/tts"
 	"github.com/ajbouh/bridge/pkg/vad"
 	"github.com/ajbouh/bridge/pkg/webrtcpeer"
 
+	"github.com/pion/webrtc/v3"
 	"golang.org/x/exp/slog"
 )
 
@@ -42,16 +56,54 @@ func main() {
 		logr.SetLevel(slog.LevelDebug)
 	}
 
-	r := router.New(context.Background())
-	r.Start()
+	var middlewares []func(r *router.Router) error
+	install := func(policies router.Policies, fn router.MiddlewareFunc) {
+		// Each draft of the document replaces the one before it, so whoever listens to
+		// drafts only needs the latest.
+		policies.DraftDocument = router.PolicyCoalesceLatest
+		middlewares = append(middlewares, func(r *router.Router) error {
+			_, err := r.InstallMiddlewareWithPolicies(policies, fn)
+			return err
+		})
+	}
+
+	// Pools of ASR endpoints serve their stats on the admin api, by the name of what
+	// they're for.
+	pools := map[string]*asr.Pool{}
+	newBackend := func(name, url string) (asr.Backend, error) {
+		backend, err := asr.NewBackend(url)
+		if pool, ok := backend.(*asr.Pool); ok {
+			pools[name] = pool
+		}
+		return backend, err
+	}
 
+	// The transcribers of every room count what they do together, and serve it on
+	// the admin api.
+	transcriptionMetrics := transcriber.NewMetrics()
 	transcriptionService := os.Getenv("BRIDGE_TRANSCRIPTION")
 	if transcriptionService != "" {
-		fn, err := transcriber.New(transcriptionService)
+		backend, err := newBackend("transcription", transcriptionService)
 		if err != nil {
 			logger.Fatal(err, "error creating transcriber")
 		}
-		r.InstallMiddleware(fn)
+		config := transcriber.DefaultConfig()
+		config.Metrics = transcriptionMetrics
+		if concurrency := os.Getenv("BRIDGE_TRANSCRIPTION_CONCURRENCY"); concurrency != "" {
+			config.Concurrency, err = strconv.Atoi(concurrency)
+			if err != nil {
+				logger.Fatal(err, "error parsing BRIDGE_TRANSCRIPTION_CONCURRENCY")
+			}
+		}
+		install(router.Policies{}, transcriber.NewWithConfig(backend, config))
+	}
+
+	if diarizationService := os.Getenv("BRIDGE_DIARIZATION"); diarizationService != "" {
+		fn, err := diarization.New(diarizationService)
+		if err != nil {
+			logger.Fatal(err, "error creating diarization")
+		}
+		install(router.Policies{}, fn)
 	}
 
 	translators := getenvPrefixMap("BRIDGE_TRANSLATOR_")
@@ -62,34 +114,274 @@ func main() {
 		if modality == "audio" {
 			useAudio = true
 		}
-		fn, err := translator.New(translatorService, useAudio, targetLanguages[0], targetLanguages[1:]...)
+		backend, err := newBackend("translator_"+translatorConfig, translatorService)
 		if err != nil {
 			logger.Fatal(err, "error creating translator")
 		}
+		fn := translator.NewWithBackend(backend, useAudio, targetLanguages[0], targetLanguages[1:]...)
 
-		r.InstallMiddleware(fn)
+		install(router.Policies{
+			FinalDocument: router.PolicyDropOldest,
+		}, fn)
 	}
 
 	assistants := getenvPrefixMap("BRIDGE_ASSISTANT_")
 	for assistantName, assistantService := range assistants {
-		r.InstallMiddleware(assistant.New(assistantName, assistantService))
+		// Assistants only look at the most recent document and can spend a long time
+		// waiting on the LLM, so don't let them hold up everyone else.
+		install(router.Policies{
+			FinalDocument: router.PolicyCoalesceLatest,
+		}, assistant.New(assistantName, assistantService))
 	}
 
-	r.InstallMiddleware(vad.New(vad.Config{
-		SampleRate:   16000,
-		SampleWindow: 24 * time.Second,
-	}))
+	// Speech played into a room comes back through the microphones in it, so
+	// recognize it whenever there's speech to play.
+	var echoConfig *echo.Config
+
+	if ttsService := os.Getenv("BRIDGE_TTS"); ttsService != "" {
+		// Speak what every assistant says, each as its own participant.
+		sources := map[string]string{}
+		for assistantName := range assistants {
+			sources[assistantName] = assistant.ParticipantID(assistantName)
+		}
+		fn, err := tts.New(ttsService, os.Getenv("BRIDGE_TTS_VOICE"), sources)
+		if err != nil {
+			logger.Fatal(err, "error creating tts")
+		}
+		// Captured audio is only watched for people talking over the assistants,
+		// which doesn't need every draft.
+		install(router.Policies{
+			CapturedAudio: router.PolicyDropOldest,
+		}, fn)
+		echoConfig = &echo.Config{}
+	}
 
 	webrtcpeerURL := os.Getenv("BRIDGE_WEBRTC_URL")
-	if webrtcpeerURL != "" {
-		room := os.Getenv("BRIDGE_WEBRTC_ROOM")
-		if room == "" {
-			room = "test"
+	network, err := networkConfig()
+	if err != nil {
+		logger.Fatal(err, "error configuring webrtc network")
+	}
+	sessionLog := os.Getenv("BRIDGE_SESSION_LOG")
+
+	// Every room gets its own router and its own instance of each middleware, but
+	// the clients of the shared services above are created once.
+	stack := func(room string, r *router.Router) error {
+		if sessionLog != "" {
+			if _, err := r.InstallMiddleware(session.NewRecorder(filepath.Join(sessionLog, room))); err != nil {
+				return fmt.Errorf("creating session recorder: %w", err)
+			}
+		}
+
+		for _, m := range middlewares {
+			if err := m(r); err != nil {
+				return err
+			}
+		}
+
+		if _, err := r.InstallMiddleware(vad.New(vad.Config{
+			SampleRate:   16000,
+			SampleWindow: 24 * time.Second,
+			Detector:     vad.DetectorKind(os.Getenv("BRIDGE_VAD_DETECTOR")),
+			Echo:         echoConfig,
+		})); err != nil {
+			return err
+		}
+
+		if webrtcpeerURL != "" {
+			url := url.URL{Scheme: "ws", Host: webrtcpeerURL, Path: "/ws"}
+			// The peer only needs the latest status to show who's in the room.
+			if _, err := r.InstallMiddlewareWithPolicies(router.Policies{
+				Status: router.PolicyCoalesceLatest,
+			}, webrtcpeer.New(url, room, network)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m := rooms.NewManager(ctx, stack)
+
+	var followed bool
+
+	if roomsURL := os.Getenv("BRIDGE_WEBRTC_ROOMS_URL"); roomsURL != "" {
+		watcher := &rooms.Watcher{
+			URL:          roomsURL,
+			Ignore:       webrtcpeer.UID,
+			Interval:     2 * time.Second,
+			EmptyTimeout: 30 * time.Second,
+		}
+		go watcher.Run(ctx, m)
+		followed = true
+	}
+
+	if addr := os.Getenv("BRIDGE_ROOMS_ADMIN_ADDR"); addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/rooms", m)
+		mux.Handle("/rooms/", m)
+		mux.Handle("/transcription", transcriptionMetrics)
+		for name, pool := range pools {
+			mux.Handle("/asr/"+name, pool)
+		}
+		go func() {
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				logger.Fatal(err, "error serving rooms admin api")
+			}
+		}()
+		followed = true
+	}
+
+	// Without a way to learn about rooms, serve a single fixed one like before.
+	room := os.Getenv("BRIDGE_WEBRTC_ROOM")
+	if room == "" && !followed {
+		room = "test"
+	}
+	if room != "" {
+		rm, err := m.Open(room, true)
+		if err != nil {
+			logger.Fatal(err, "error opening room")
+		}
+
+		if replay := os.Getenv("BRIDGE_REPLAY"); replay != "" {
+			config, err := replayConfig()
+			if err != nil {
+				logger.Fatal(err, "error configuring replay")
+			}
+			if _, err := rm.Router.InstallMiddleware(session.NewReplayer(replay, config)); err != nil {
+				logger.Fatal(err, "error creating replayer")
+			}
+		}
+	}
+
+	go logDeliveryStats(m, time.Minute)
+
+	sig, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-sig.Done()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	if err := m.Shutdown(shutdownCtx); err != nil {
+		logger.Error(err, "error shutting down rooms")
+	}
+}
+
+// replayConfig reads BRIDGE_REPLAY_SPEED (default 1, 0 for as fast as possible) and
+// BRIDGE_REPLAY_STREAMS, a comma separated subset of samples, audio and
+// transcriptions (default samples).
+func replayConfig() (session.ReplayConfig, error) {
+	config := session.ReplayConfig{Speed: 1}
+
+	if speed := os.Getenv("BRIDGE_REPLAY_SPEED"); speed != "" {
+		var err error
+		config.Speed, err = strconv.ParseFloat(speed, 64)
+		if err != nil {
+			return config, err
 		}
+	}
 
-		url := url.URL{Scheme: "ws", Host: webrtcpeerURL, Path: "/ws"}
-		r.InstallMiddleware(webrtcpeer.New(url, room))
+	streams := os.Getenv("BRIDGE_REPLAY_STREAMS")
+	if streams == "" {
+		streams = "samples"
+	}
+	for _, s := range strings.Split(streams, ",") {
+		switch strings.TrimSpace(s) {
+		case "samples":
+			config.CapturedSamples = true
+		case "audio":
+			config.CapturedAudio = true
+		case "transcriptions":
+			config.Transcriptions = true
+		default:
+			return config, fmt.Errorf("unknown replay stream %q", s)
+		}
 	}
 
-	r.WaitForDone()
+	return config, nil
+}
+
+// networkConfig reads the webrtc network settings:
+//
+//   - BRIDGE_WEBRTC_ICE_SERVERS, a JSON list of ICE servers in the format of
+//     RTCIceServer, e.g. [{"urls":["turn:turn.example.com:3478"],"username":"u","credential":"p"}].
+//     Defaults to Google's public STUN server; set it to [] to use none.
+//   - BRIDGE_WEBRTC_ICE_TRANSPORT_POLICY, all (the default) or relay.
+//   - BRIDGE_WEBRTC_UDP_PORTS, a port range such as 50000-50100.
+//   - BRIDGE_WEBRTC_NAT_1TO1_IPS, a comma separated list of public IPs, and
+//     BRIDGE_WEBRTC_NAT_1TO1_CANDIDATE_TYPE, host (the default) or srflx.
+//   - BRIDGE_WEBRTC_INTERFACES, a comma separated list of network interfaces.
+func networkConfig() (webrtcpeer.NetworkConfig, error) {
+	config := webrtcpeer.DefaultNetworkConfig()
+
+	if servers, ok := os.LookupEnv("BRIDGE_WEBRTC_ICE_SERVERS"); ok {
+		config.ICEServers = nil
+		if err := json.Unmarshal([]byte(servers), &config.ICEServers); err != nil {
+			return config, fmt.Errorf("parsing BRIDGE_WEBRTC_ICE_SERVERS: %w", err)
+		}
+	}
+
+	if policy := os.Getenv("BRIDGE_WEBRTC_ICE_TRANSPORT_POLICY"); policy != "" {
+		config.ICETransportPolicy = webrtc.NewICETransportPolicy(policy)
+		if config.ICETransportPolicy.String() != policy {
+			return config, fmt.Errorf("unknown ice transport policy %q", policy)
+		}
+	}
+
+	if ports := os.Getenv("BRIDGE_WEBRTC_UDP_PORTS"); ports != "" {
+		min, max, _ := strings.Cut(ports, "-")
+		portMin, err := strconv.ParseUint(min, 10, 16)
+		if err != nil {
+			return config, fmt.Errorf("parsing BRIDGE_WEBRTC_UDP_PORTS: %w", err)
+		}
+		portMax, err := strconv.ParseUint(max, 10, 16)
+		if err != nil {
+			return config, fmt.Errorf("parsing BRIDGE_WEBRTC_UDP_PORTS: %w", err)
+		}
+		config.UDPPortMin, config.UDPPortMax = uint16(portMin), uint16(portMax)
+	}
+
+	if ips := os.Getenv("BRIDGE_WEBRTC_NAT_1TO1_IPS"); ips != "" {
+		config.NAT1To1IPs = splitList(ips)
+	}
+	if candidateType := os.Getenv("BRIDGE_WEBRTC_NAT_1TO1_CANDIDATE_TYPE"); candidateType != "" {
+		var err error
+		config.NAT1To1CandidateType, err = webrtc.NewICECandidateType(candidateType)
+		if err != nil {
+			return config, fmt.Errorf("parsing BRIDGE_WEBRTC_NAT_1TO1_CANDIDATE_TYPE: %w", err)
+		}
+	}
+
+	if interfaces := os.Getenv("BRIDGE_WEBRTC_INTERFACES"); interfaces != "" {
+		config.Interfaces = splitList(interfaces)
+	}
+
+	return config, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// logDeliveryStats periodically reports listeners that a room's router had to drop
+// values for.
+func logDeliveryStats(m *rooms.Manager, interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, rm := range m.Rooms() {
+			for _, s := range rm.Router.Stats() {
+				if s.Dropped == 0 {
+					continue
+				}
+				logger.Warnf("middleware %s in room %s is falling behind on %s: policy=%s delivered=%d dropped=%d", s.Middleware, rm.Name, s.Stream, s.Policy, s.Delivered, s.Dropped)
+			}
+		}
+	}
 }
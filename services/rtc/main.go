@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 
@@ -72,6 +73,28 @@ func main() {
 
 	}))
 
+	// Report which rooms have peers so that rtc-peer can follow them.
+	http.HandleFunc("/rooms", func(w http.ResponseWriter, r *http.Request) {
+		type room struct {
+			ID    string   `json:"id"`
+			Peers []string `json:"peers"`
+		}
+
+		rooms := []room{}
+		for _, session := range s.GetSessions() {
+			rm := room{ID: session.ID(), Peers: []string{}}
+			for _, p := range session.Peers() {
+				rm.Peers = append(rm.Peers, p.ID())
+			}
+			rooms = append(rooms, rm)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(rooms); err != nil {
+			logger.Error(err, "error writing rooms")
+		}
+	})
+
 	port := 8088
 	// transcriptionService := os.Getenv("TRANSCRIPTION_SERVICE")
 	// translatorService := os.Getenv("TRANSLATOR_SERVICE")
@@ -25,14 +25,27 @@ interface BridgeEvent0<T extends string, D=unknown> {
   detail: D
 }
 
+export interface Participant {
+  id: string
+  label: string
+  isAssistent: boolean
+  muted: boolean
+  speaking: boolean
+}
+
 interface Status {
-  
+  participants: Participant[] | null
+  // unix milliseconds that transcript timestamps are measured from
+  startedAt?: number
 }
 
 export type TranscriptionEvent = BridgeEvent0<'transcription', Transcript[]>
+export type TranscriptionRemovedEvent = BridgeEvent0<'transcription_removed', { id: string }>
 export type StatusEvent = BridgeEvent0<'status', Status>
+// ResetEvent comes before the whole transcript is sent again, after reconnecting.
+export type ResetEvent = BridgeEvent0<'reset', undefined>
 
-export type BridgeEvent = TranscriptionEvent | StatusEvent
+export type BridgeEvent = TranscriptionEvent | TranscriptionRemovedEvent | StatusEvent | ResetEvent
 export type BridgeEventHandler<T extends BridgeEvent=BridgeEvent> = (event: T) => void
 
 
@@ -3,6 +3,8 @@ export interface TranscriptWord {
   end: number
   word: string
   prob: number
+  // stable is set on the words of a draft that won't change before it's final
+  stable?: boolean
 }
 
 export interface TranscriptSegment {
@@ -27,6 +29,8 @@ export interface Transcript {
   language_prob: number
   id: string
   final: boolean
+  // truncated is set on speech that was cut off because somebody talked over it
+  truncated?: boolean
   audio: {
     start: number
     end: number
@@ -65,6 +69,7 @@ export interface RenderedTranscriptEntry {
   sessionTime: number
   speakerLabel: string
   final: boolean
+  truncated: boolean
   text: string
   words: RenderedTranscriptWord[]
   debug: {
@@ -78,7 +83,7 @@ export interface RenderedTranscriptEntry {
   }[]
 }
 
-export function renderableTranscriptSession(transcriptions: Transcript[]): RenderedTranscriptSession {
+export function renderableTranscriptSession(transcriptions: Transcript[], startedAt?: number): RenderedTranscriptSession {
   const participants = new Set<string>()
   const session: RenderedTranscriptSession = {
     get participants() {
@@ -96,8 +101,7 @@ export function renderableTranscriptSession(transcriptions: Transcript[]): Rende
     return session
   }
 
-  // const startedAtMs = doc.startedAt * 1000
-  const startedAtMs = +new Date()
+  const startedAtMs = startedAt ?? +new Date()
   session.date = new Date(startedAtMs)
 
   let lastSegmentSessionEndTimeS
@@ -119,6 +123,7 @@ export function renderableTranscriptSession(transcriptions: Transcript[]): Rende
           (lastEntry.words == null) === (segment.words == null) &&
           precedingSilence < 1) {
         lastEntry.text += segment.text || ''
+        lastEntry.truncated = transcript.truncated || false
         if (lastEntry.words) {
           lastEntry.words = lastEntry.words.concat(segment.words)
         }
@@ -128,6 +133,7 @@ export function renderableTranscriptSession(transcriptions: Transcript[]): Rende
         lastEntry = {
           speakerLabel: segment.speaker,
           final: transcript.final,
+          truncated: transcript.truncated || false,
           isAssistant: segment.is_assistant || false,
           language: transcript.language,
           precedingSilence,